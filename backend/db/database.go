@@ -53,6 +53,60 @@ func InitDB(dataPath string) error {
 		log.Printf("Migration warning: %v", err)
 	}
 
+	// Migration: Add reading state columns if they don't exist
+	for _, column := range []string{
+		"status TEXT DEFAULT ''",
+		"started_at DATETIME",
+		"finished_at DATETIME",
+		"rating INTEGER DEFAULT 0",
+		"favorite INTEGER DEFAULT 0",
+		"review TEXT DEFAULT ''",
+	} {
+		_, err = DB.Exec(`ALTER TABLE books ADD COLUMN ` + column)
+		if err != nil && !strings.Contains(strings.ToLower(err.Error()), "duplicate column") {
+			log.Printf("Migration warning: %v", err)
+		}
+	}
+
+	// Migration: Add structured progress columns if they don't exist
+	for _, column := range []string{
+		"progress_format TEXT",
+		"progress_cfi TEXT",
+		"progress_page INTEGER",
+		"progress_total_pages INTEGER",
+		"progress_fraction REAL",
+		"progress_chapter TEXT",
+		"progress_device TEXT",
+		"progress_updated_at DATETIME",
+	} {
+		_, err = DB.Exec(`ALTER TABLE books ADD COLUMN ` + column)
+		if err != nil && !strings.Contains(strings.ToLower(err.Error()), "duplicate column") {
+			log.Printf("Migration warning: %v", err)
+		}
+	}
+
+	// Migration: Move legacy reading_progress JSON into the progress columns
+	_, err = DB.Exec(`
+		UPDATE books SET
+			progress_format = json_extract(reading_progress, '$.type'),
+			progress_cfi = json_extract(reading_progress, '$.cfi'),
+			progress_page = json_extract(reading_progress, '$.page'),
+			progress_total_pages = json_extract(reading_progress, '$.totalPages'),
+			progress_fraction = CASE
+				WHEN json_extract(reading_progress, '$.type') = 'pdf' AND json_extract(reading_progress, '$.totalPages') > 0
+				THEN CAST(json_extract(reading_progress, '$.page') AS REAL) / json_extract(reading_progress, '$.totalPages')
+				ELSE COALESCE(json_extract(reading_progress, '$.fraction'), 0)
+			END,
+			progress_chapter = NULL,
+			progress_device = NULL,
+			progress_updated_at = CURRENT_TIMESTAMP,
+			reading_progress = NULL
+		WHERE reading_progress IS NOT NULL AND reading_progress != '' AND json_valid(reading_progress)
+	`)
+	if err != nil {
+		log.Printf("Migration warning: %v", err)
+	}
+
 	_, err = DB.Exec(`
 		CREATE TABLE IF NOT EXISTS annotations (
 			id TEXT PRIMARY KEY,
@@ -70,6 +124,501 @@ func InitDB(dataPath string) error {
 		log.Printf("Annotations table warning: %v", err)
 	}
 
+	// Shelves with an empty query are manual; otherwise the query is evaluated
+	// on every read and shelf_books is ignored.
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS shelves (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			query TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS shelf_books (
+			shelf_id TEXT NOT NULL,
+			book_id TEXT NOT NULL,
+			added_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (shelf_id, book_id),
+			FOREIGN KEY (shelf_id) REFERENCES shelves(id) ON DELETE CASCADE,
+			FOREIGN KEY (book_id) REFERENCES books(id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_shelf_books_book ON shelf_books(book_id);
+	`)
+	if err != nil {
+		log.Printf("Shelves table warning: %v", err)
+	}
+
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS reading_sessions (
+			id TEXT PRIMARY KEY,
+			book_id TEXT NOT NULL,
+			started_at DATETIME NOT NULL,
+			ended_at DATETIME NOT NULL,
+			start_position TEXT,
+			end_position TEXT,
+			start_fraction REAL DEFAULT 0,
+			end_fraction REAL DEFAULT 0,
+			pages_read INTEGER DEFAULT 0,
+			FOREIGN KEY (book_id) REFERENCES books(id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_sessions_book ON reading_sessions(book_id, ended_at DESC);
+		CREATE INDEX IF NOT EXISTS idx_sessions_started ON reading_sessions(started_at);
+	`)
+	if err != nil {
+		log.Printf("Reading sessions table warning: %v", err)
+	}
+
+	// Migration: device_progress gained a user_id column as part of its primary key
+	var hasDeviceTable, hasDeviceUser int
+	DB.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'device_progress'`).Scan(&hasDeviceTable)
+	DB.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('device_progress') WHERE name = 'user_id'`).Scan(&hasDeviceUser)
+	if hasDeviceTable == 1 && hasDeviceUser == 0 {
+		_, err = DB.Exec(`ALTER TABLE device_progress RENAME TO device_progress_old`)
+		if err != nil {
+			log.Printf("Migration warning: %v", err)
+		}
+	}
+
+	// Latest position reported by each of a user's devices; the user's
+	// position in user_books is resolved from these.
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS device_progress (
+			user_id TEXT NOT NULL DEFAULT '',
+			book_id TEXT NOT NULL,
+			device TEXT NOT NULL DEFAULT '',
+			format TEXT NOT NULL,
+			cfi TEXT,
+			page INTEGER,
+			total_pages INTEGER,
+			fraction REAL DEFAULT 0,
+			chapter TEXT,
+			updated_at DATETIME NOT NULL,
+			PRIMARY KEY (user_id, book_id, device, format),
+			FOREIGN KEY (book_id) REFERENCES books(id) ON DELETE CASCADE
+		);
+		INSERT OR IGNORE INTO device_progress (user_id, book_id, device, format, cfi, page, total_pages, fraction, chapter, updated_at)
+			SELECT '', id, COALESCE(progress_device, ''), progress_format, progress_cfi, progress_page, progress_total_pages,
+				COALESCE(progress_fraction, 0), progress_chapter, COALESCE(progress_updated_at, CURRENT_TIMESTAMP)
+			FROM books WHERE progress_format IS NOT NULL AND progress_format != '';
+	`)
+	if err != nil {
+		log.Printf("Device progress table warning: %v", err)
+	}
+	if hasDeviceTable == 1 && hasDeviceUser == 0 {
+		_, err = DB.Exec(`
+			INSERT OR IGNORE INTO device_progress (user_id, book_id, device, format, cfi, page, total_pages, fraction, chapter, updated_at)
+				SELECT '', book_id, device, format, cfi, page, total_pages, fraction, chapter, updated_at FROM device_progress_old;
+			DROP TABLE device_progress_old;
+		`)
+		if err != nil {
+			log.Printf("Migration warning: %v", err)
+		}
+	}
+
+	// Migration: a device keeps a position per format, since a book can have
+	// several files
+	var deviceKeyColumns int
+	DB.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('device_progress') WHERE pk > 0`).Scan(&deviceKeyColumns)
+	if deviceKeyColumns == 3 {
+		// In one transaction, so that a failure leaves the old table in place
+		tx, err := DB.Begin()
+		if err == nil {
+			_, err = tx.Exec(`
+				ALTER TABLE device_progress RENAME TO device_progress_old;
+				CREATE TABLE device_progress (
+					user_id TEXT NOT NULL DEFAULT '',
+					book_id TEXT NOT NULL,
+					device TEXT NOT NULL DEFAULT '',
+					format TEXT NOT NULL,
+					cfi TEXT,
+					page INTEGER,
+					total_pages INTEGER,
+					fraction REAL DEFAULT 0,
+					chapter TEXT,
+					updated_at DATETIME NOT NULL,
+					PRIMARY KEY (user_id, book_id, device, format),
+					FOREIGN KEY (book_id) REFERENCES books(id) ON DELETE CASCADE
+				);
+				INSERT INTO device_progress SELECT user_id, book_id, device, format, cfi, page, total_pages, fraction, chapter, updated_at
+					FROM device_progress_old;
+				DROP TABLE device_progress_old;
+			`)
+			if err == nil {
+				err = tx.Commit()
+			} else {
+				tx.Rollback()
+			}
+		}
+		if err != nil {
+			log.Printf("Migration warning: %v", err)
+		}
+	}
+
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS users (
+			id TEXT PRIMARY KEY,
+			username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+			password_hash TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS sessions (
+			token_hash TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+	`)
+	if err != nil {
+		log.Printf("Users table warning: %v", err)
+	}
+
+	// Per-user reading state. The matching columns on books only hold data from
+	// before accounts existed, until the first user claims it.
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS user_books (
+			user_id TEXT NOT NULL,
+			book_id TEXT NOT NULL,
+			progress_format TEXT,
+			progress_cfi TEXT,
+			progress_page INTEGER,
+			progress_total_pages INTEGER,
+			progress_fraction REAL,
+			progress_chapter TEXT,
+			progress_device TEXT,
+			progress_updated_at DATETIME,
+			status TEXT DEFAULT '',
+			started_at DATETIME,
+			finished_at DATETIME,
+			rating INTEGER DEFAULT 0,
+			favorite INTEGER DEFAULT 0,
+			review TEXT DEFAULT '',
+			PRIMARY KEY (user_id, book_id),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (book_id) REFERENCES books(id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_user_books_book ON user_books(book_id);
+	`)
+	if err != nil {
+		log.Printf("User books table warning: %v", err)
+	}
+
+	// Migration: Add roles; whoever signed up first administers the library
+	_, err = DB.Exec(`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'reader'`)
+	if err != nil && !strings.Contains(strings.ToLower(err.Error()), "duplicate column") {
+		log.Printf("Migration warning: %v", err)
+	}
+	_, err = DB.Exec(`
+		UPDATE users SET role = 'admin'
+		WHERE id = (SELECT id FROM users ORDER BY created_at LIMIT 1)
+			AND NOT EXISTS (SELECT 1 FROM users WHERE role = 'admin')
+	`)
+	if err != nil {
+		log.Printf("Migration warning: %v", err)
+	}
+
+	// Migration: Link users to accounts at an OpenID Connect provider
+	for _, column := range []string{"oidc_issuer TEXT", "oidc_subject TEXT"} {
+		_, err = DB.Exec(`ALTER TABLE users ADD COLUMN ` + column)
+		if err != nil && !strings.Contains(strings.ToLower(err.Error()), "duplicate column") {
+			log.Printf("Migration warning: %v", err)
+		}
+	}
+	_, err = DB.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_oidc ON users(oidc_issuer, oidc_subject)`)
+	if err != nil {
+		log.Printf("Migration warning: %v", err)
+	}
+
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS api_tokens (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			scope TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			last_used_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_api_tokens_user ON api_tokens(user_id);
+	`)
+	if err != nil {
+		log.Printf("API tokens table warning: %v", err)
+	}
+
+	// Libraries split the catalog; users only see the libraries they have been
+	// granted. Everything from before libraries existed is in the default one,
+	// which everyone is granted.
+	var hasLibraries int
+	DB.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'libraries'`).Scan(&hasLibraries)
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS libraries (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS library_roots (
+			library_id TEXT NOT NULL,
+			path TEXT NOT NULL UNIQUE,
+			PRIMARY KEY (library_id, path),
+			FOREIGN KEY (library_id) REFERENCES libraries(id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS library_grants (
+			library_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			PRIMARY KEY (library_id, user_id),
+			FOREIGN KEY (library_id) REFERENCES libraries(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_library_grants_user ON library_grants(user_id);
+		INSERT OR IGNORE INTO libraries (id, name) VALUES ('default', 'Library');
+	`)
+	if err != nil {
+		log.Printf("Libraries table warning: %v", err)
+	}
+	if hasLibraries == 0 {
+		_, err = DB.Exec(`INSERT OR IGNORE INTO library_grants (library_id, user_id) SELECT 'default', id FROM users`)
+		if err != nil {
+			log.Printf("Migration warning: %v", err)
+		}
+	}
+
+	// Migration: Add library_id column if it doesn't exist
+	_, err = DB.Exec(`ALTER TABLE books ADD COLUMN library_id TEXT NOT NULL DEFAULT 'default'`)
+	if err != nil && !strings.Contains(strings.ToLower(err.Error()), "duplicate column") {
+		log.Printf("Migration warning: %v", err)
+	}
+	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS idx_books_library ON books(library_id)`)
+	if err != nil {
+		log.Printf("Migration warning: %v", err)
+	}
+
+	// Migration: Add path templates the scanner infers metadata from, one per line
+	_, err = DB.Exec(`ALTER TABLE libraries ADD COLUMN path_templates TEXT NOT NULL DEFAULT ''`)
+	if err != nil && !strings.Contains(strings.ToLower(err.Error()), "duplicate column") {
+		log.Printf("Migration warning: %v", err)
+	}
+
+	// Migration: Add file_hash column to recognise duplicate uploads
+	_, err = DB.Exec(`ALTER TABLE books ADD COLUMN file_hash TEXT`)
+	if err != nil && !strings.Contains(strings.ToLower(err.Error()), "duplicate column") {
+		log.Printf("Migration warning: %v", err)
+	}
+	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS idx_books_hash ON books(library_id, file_hash)`)
+	if err != nil {
+		log.Printf("Migration warning: %v", err)
+	}
+
+	// Migration: Add deleted_at column for the trash
+	_, err = DB.Exec(`ALTER TABLE books ADD COLUMN deleted_at DATETIME`)
+	if err != nil && !strings.Contains(strings.ToLower(err.Error()), "duplicate column") {
+		log.Printf("Migration warning: %v", err)
+	}
+
+	// Migration: Add isbn_checked_at so ISBN detection runs once per book
+	_, err = DB.Exec(`ALTER TABLE books ADD COLUMN isbn_checked_at DATETIME`)
+	if err != nil && !strings.Contains(strings.ToLower(err.Error()), "duplicate column") {
+		log.Printf("Migration warning: %v", err)
+	}
+
+	// Migration: Add catalog metadata columns brought in by imports
+	for _, column := range []string{
+		"series TEXT DEFAULT ''",
+		"series_index REAL",
+		"description TEXT DEFAULT ''",
+	} {
+		_, err = DB.Exec(`ALTER TABLE books ADD COLUMN ` + column)
+		if err != nil && !strings.Contains(strings.ToLower(err.Error()), "duplicate column") {
+			log.Printf("Migration warning: %v", err)
+		}
+	}
+
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS book_tags (
+			book_id TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (book_id, tag)
+		);
+		CREATE INDEX IF NOT EXISTS idx_book_tags_tag ON book_tags(tag);
+		CREATE TABLE IF NOT EXISTS book_identifiers (
+			book_id TEXT NOT NULL,
+			type TEXT NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY (book_id, type)
+		);
+		CREATE INDEX IF NOT EXISTS idx_book_identifiers_value ON book_identifiers(type, value);
+		CREATE TABLE IF NOT EXISTS book_formats (
+			book_id TEXT NOT NULL,
+			file_type TEXT NOT NULL,
+			file_path TEXT NOT NULL UNIQUE,
+			file_size INTEGER,
+			PRIMARY KEY (book_id, file_type)
+		);
+	`)
+	if err != nil {
+		log.Printf("Book metadata tables warning: %v", err)
+	}
+
+	// Migration: Every book's file is one of its formats
+	_, err = DB.Exec(`ALTER TABLE book_formats ADD COLUMN file_hash TEXT`)
+	if err != nil && !strings.Contains(strings.ToLower(err.Error()), "duplicate column") {
+		log.Printf("Migration warning: %v", err)
+	}
+	_, err = DB.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_book_formats_hash ON book_formats(file_hash);
+		INSERT OR IGNORE INTO book_formats (book_id, file_type, file_path, file_size, file_hash)
+			SELECT id, file_type, file_path, file_size, file_hash FROM books
+			WHERE id NOT IN (SELECT book_id FROM book_formats WHERE file_type = books.file_type);
+	`)
+	if err != nil {
+		log.Printf("Migration warning: %v", err)
+	}
+
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			at DATETIME NOT NULL,
+			actor_id TEXT NOT NULL DEFAULT '',
+			actor_name TEXT NOT NULL DEFAULT '',
+			action TEXT NOT NULL,
+			target_type TEXT NOT NULL,
+			target_id TEXT NOT NULL,
+			before TEXT,
+			after TEXT
+		);
+		CREATE INDEX IF NOT EXISTS idx_audit_at ON audit_log(at);
+		CREATE INDEX IF NOT EXISTS idx_audit_target ON audit_log(target_type, target_id);
+		CREATE INDEX IF NOT EXISTS idx_audit_actor ON audit_log(actor_id);
+	`)
+	if err != nil {
+		log.Printf("Audit log table warning: %v", err)
+	}
+
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS uploads (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			library_id TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			length INTEGER NOT NULL,
+			received INTEGER NOT NULL DEFAULT 0,
+			book_id TEXT,
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		log.Printf("Uploads table warning: %v", err)
+	}
+
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS url_imports (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			library_id TEXT NOT NULL,
+			url TEXT NOT NULL,
+			status TEXT NOT NULL,
+			error TEXT NOT NULL DEFAULT '',
+			book_id TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		log.Printf("URL imports table warning: %v", err)
+	}
+
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS calibre_imports (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			library_id TEXT NOT NULL,
+			path TEXT NOT NULL,
+			status TEXT NOT NULL,
+			error TEXT NOT NULL DEFAULT '',
+			total INTEGER NOT NULL DEFAULT 0,
+			imported INTEGER NOT NULL DEFAULT 0,
+			skipped INTEGER NOT NULL DEFAULT 0,
+			failed INTEGER NOT NULL DEFAULT 0,
+			failures TEXT NOT NULL DEFAULT '[]',
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		log.Printf("Calibre imports table warning: %v", err)
+	}
+
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS metadata_cache (
+			provider TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			key TEXT NOT NULL,
+			response TEXT NOT NULL,
+			fetched_at DATETIME NOT NULL,
+			PRIMARY KEY (provider, kind, key)
+		)
+	`)
+	if err != nil {
+		log.Printf("Metadata cache table warning: %v", err)
+	}
+
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS book_validations (
+			book_id TEXT PRIMARY KEY,
+			checked_at DATETIME NOT NULL,
+			valid INTEGER NOT NULL,
+			issues TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		log.Printf("Book validations table warning: %v", err)
+	}
+
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS book_conversions (
+			book_id TEXT NOT NULL,
+			format TEXT NOT NULL,
+			source_type TEXT NOT NULL,
+			source_path TEXT NOT NULL,
+			source_modified DATETIME NOT NULL,
+			file_path TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL,
+			error TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL,
+			PRIMARY KEY (book_id, format)
+		)
+	`)
+	if err != nil {
+		log.Printf("Book conversions table warning: %v", err)
+	}
+
+	// Files in scan roots whose books were purged from the trash, so that
+	// scans do not add them again
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS purged_files (
+			file_path TEXT PRIMARY KEY,
+			file_hash TEXT NOT NULL DEFAULT '',
+			purged_at DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		log.Printf("Purged files table warning: %v", err)
+	}
+
+	// Migration: Scope annotations, shelves and sessions to a user
+	for _, table := range []string{"annotations", "shelves", "reading_sessions"} {
+		_, err = DB.Exec(`ALTER TABLE ` + table + ` ADD COLUMN user_id TEXT NOT NULL DEFAULT ''`)
+		if err != nil && !strings.Contains(strings.ToLower(err.Error()), "duplicate column") {
+			log.Printf("Migration warning: %v", err)
+		}
+		_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS idx_` + table + `_user ON ` + table + `(user_id)`)
+		if err != nil {
+			log.Printf("Migration warning: %v", err)
+		}
+	}
+
 	log.Println("Database initialized successfully")
 	return nil
 }
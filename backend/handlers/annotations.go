@@ -15,9 +15,14 @@ func GetAnnotations(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bookID := vars["id"]
 
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
 	rows, err := db.DB.Query(
-		"SELECT id, book_id, cfi, text, note, color, created_at FROM annotations WHERE book_id = ? ORDER BY created_at DESC",
-		bookID,
+		"SELECT id, book_id, cfi, text, note, color, created_at FROM annotations WHERE book_id = ? AND user_id = ? ORDER BY created_at DESC",
+		bookID, user.ID,
 	)
 	if err != nil {
 		http.Error(w, "Failed to fetch annotations", http.StatusInternalServerError)
@@ -47,6 +52,11 @@ func CreateAnnotation(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bookID := vars["id"]
 
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
 	var input struct {
 		CFI   string `json:"cfi"`
 		Text  string `json:"text"`
@@ -67,6 +77,12 @@ func CreateAnnotation(w http.ResponseWriter, r *http.Request) {
 		input.Color = "yellow"
 	}
 
+	var exists string
+	if err := db.DB.QueryRow("SELECT b.id FROM books b"+bookAccess+" WHERE b.id = ?", user.ID, bookID).Scan(&exists); err != nil {
+		http.Error(w, "Book not found", http.StatusNotFound)
+		return
+	}
+
 	annotation := models.Annotation{
 		ID:        uuid.New().String(),
 		BookID:    bookID,
@@ -78,8 +94,8 @@ func CreateAnnotation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	_, err := db.DB.Exec(
-		"INSERT INTO annotations (id, book_id, cfi, text, note, color, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		annotation.ID, annotation.BookID, annotation.CFI, annotation.Text, annotation.Note, annotation.Color, annotation.CreatedAt,
+		"INSERT INTO annotations (id, book_id, user_id, cfi, text, note, color, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		annotation.ID, annotation.BookID, user.ID, annotation.CFI, annotation.Text, annotation.Note, annotation.Color, annotation.CreatedAt,
 	)
 	if err != nil {
 		http.Error(w, "Failed to create annotation", http.StatusInternalServerError)
@@ -95,6 +111,11 @@ func UpdateAnnotation(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	annotationID := vars["annotationId"]
 
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
 	var input struct {
 		Note  string `json:"note"`
 		Color string `json:"color"`
@@ -105,8 +126,8 @@ func UpdateAnnotation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	_, err := db.DB.Exec(
-		"UPDATE annotations SET note = ?, color = ? WHERE id = ?",
-		input.Note, input.Color, annotationID,
+		"UPDATE annotations SET note = ?, color = ? WHERE id = ? AND user_id = ?",
+		input.Note, input.Color, annotationID, user.ID,
 	)
 	if err != nil {
 		http.Error(w, "Failed to update annotation", http.StatusInternalServerError)
@@ -121,11 +142,31 @@ func DeleteAnnotation(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	annotationID := vars["annotationId"]
 
-	_, err := db.DB.Exec("DELETE FROM annotations WHERE id = ?", annotationID)
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var a models.Annotation
+	var note *string
+	err := db.DB.QueryRow(
+		"SELECT id, book_id, cfi, text, note, color, created_at FROM annotations WHERE id = ? AND user_id = ?",
+		annotationID, user.ID,
+	).Scan(&a.ID, &a.BookID, &a.CFI, &a.Text, &note, &a.Color, &a.CreatedAt)
+	if err != nil {
+		http.Error(w, "Annotation not found", http.StatusNotFound)
+		return
+	}
+	if note != nil {
+		a.Note = *note
+	}
+
+	_, err = db.DB.Exec("DELETE FROM annotations WHERE id = ? AND user_id = ?", annotationID, user.ID)
 	if err != nil {
 		http.Error(w, "Failed to delete annotation", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, AuditAnnotationDelete, "annotation", a.ID, a, nil)
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
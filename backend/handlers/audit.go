@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditBookUpload       = "book.upload"
+	AuditBookImport       = "book.import"
+	AuditBookMerge        = "book.merge"
+	AuditBookDelete       = "book.delete"
+	AuditBookRestore      = "book.restore"
+	AuditBookPurge        = "book.purge"
+	AuditBookUpdate       = "book.update"
+	AuditBookCover        = "book.cover"
+	AuditAnnotationDelete = "annotation.delete"
+	AuditLibraryCreate    = "library.create"
+	AuditLibraryUpdate    = "library.update"
+	AuditLibraryDelete    = "library.delete"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// recordAudit appends an entry to the audit log on behalf of the request's
+// user, or of no one when r is nil. before and after are stored as JSON and
+// may be nil. Failures are logged rather than failing the change that was
+// already made.
+func recordAudit(r *http.Request, action, targetType, targetID string, before, after any) {
+	var actorID, actorName string
+	if r != nil {
+		if user := CurrentUser(r); user != nil {
+			actorID, actorName = user.ID, user.Username
+		}
+	}
+
+	_, err := db.DB.Exec(
+		`INSERT INTO audit_log (at, actor_id, actor_name, action, target_type, target_id, before, after)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		time.Now(), actorID, actorName, action, targetType, targetID, auditJSON(before), auditJSON(after),
+	)
+	if err != nil {
+		log.Printf("Failed to record %s of %s %s: %v", action, targetType, targetID, err)
+	}
+}
+
+func auditJSON(v any) any {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return string(data)
+}
+
+// bookRecord is the catalog side of a book as it appears in the audit log.
+type bookRecord struct {
+	Title     string `json:"title"`
+	Author    string `json:"author"`
+	LibraryID string `json:"libraryId"`
+	CoverPath string `json:"coverPath,omitempty"`
+	FilePath  string `json:"filePath"`
+	FileSize  int64  `json:"fileSize"`
+	FileType  string `json:"fileType"`
+}
+
+func loadBookRecord(bookID string) (*bookRecord, error) {
+	var b bookRecord
+	err := db.DB.QueryRow(
+		"SELECT title, COALESCE(author, ''), library_id, COALESCE(cover_path, ''), file_path, file_size, file_type FROM books WHERE id = ?",
+		bookID,
+	).Scan(&b.Title, &b.Author, &b.LibraryID, &b.CoverPath, &b.FilePath, &b.FileSize, &b.FileType)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// GetAudit lists audit entries, newest first. Filters: actor (user ID or
+// username), action, type and target, since and until (RFC 3339 or
+// YYYY-MM-DD), plus limit and offset.
+func GetAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var conditions []string
+	var args []any
+	if actor := query.Get("actor"); actor != "" {
+		conditions = append(conditions, "(actor_id = ? OR actor_name = ? COLLATE NOCASE)")
+		args = append(args, actor, actor)
+	}
+	if action := query.Get("action"); action != "" {
+		// "book" matches every book.* action.
+		if strings.Contains(action, ".") {
+			conditions = append(conditions, "action = ?")
+			args = append(args, action)
+		} else {
+			conditions = append(conditions, "action LIKE ?")
+			args = append(args, action+".%")
+		}
+	}
+	if targetType := query.Get("type"); targetType != "" {
+		conditions = append(conditions, "target_type = ?")
+		args = append(args, targetType)
+	}
+	if target := query.Get("target"); target != "" {
+		conditions = append(conditions, "target_id = ?")
+		args = append(args, target)
+	}
+	for _, bound := range []struct {
+		param, op string
+		endOfDay  bool
+	}{{"since", ">=", false}, {"until", "<", true}} {
+		value := query.Get(bound.param)
+		if value == "" {
+			continue
+		}
+		t, ok := parseAuditTime(value, bound.endOfDay)
+		if !ok {
+			http.Error(w, "Invalid "+bound.param+" (expected RFC 3339 or YYYY-MM-DD)", http.StatusBadRequest)
+			return
+		}
+		conditions = append(conditions, "at "+bound.op+" ?")
+		args = append(args, t)
+	}
+
+	limit := intParam(r, "limit", defaultAuditLimit)
+	if limit > maxAuditLimit {
+		limit = maxAuditLimit
+	}
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	sqlQuery := "SELECT id, at, actor_id, actor_name, action, target_type, target_id, before, after FROM audit_log"
+	if len(conditions) > 0 {
+		sqlQuery += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sqlQuery += " ORDER BY id DESC LIMIT " + strconv.Itoa(limit) + " OFFSET " + strconv.Itoa(offset)
+
+	rows, err := db.DB.Query(sqlQuery, args...)
+	if err != nil {
+		http.Error(w, "Failed to fetch audit log", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := make([]models.AuditEntry, 0)
+	for rows.Next() {
+		var e models.AuditEntry
+		var before, after *string
+		if err := rows.Scan(&e.ID, &e.At, &e.ActorID, &e.ActorName, &e.Action, &e.TargetType, &e.TargetID, &before, &after); err != nil {
+			continue
+		}
+		if before != nil {
+			e.Before = json.RawMessage(*before)
+		}
+		if after != nil {
+			e.After = json.RawMessage(*after)
+		}
+		entries = append(entries, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// parseAuditTime accepts an RFC 3339 timestamp or a date. A date used as an
+// upper bound includes the whole day. Entries are stored as text in local
+// time and compared as such, so the result is in local time too.
+func parseAuditTime(value string, endOfDay bool) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Local(), true
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, true
+}
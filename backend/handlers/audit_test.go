@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAuditTimeBoundsAcrossOffsets(t *testing.T) {
+	// The server's zone is five hours ahead of UTC, and the bounds are given
+	// in UTC and in a zone ahead of both
+	local := time.Local
+	time.Local = time.FixedZone("PKT", 5*60*60)
+	t.Cleanup(func() { time.Local = local })
+
+	user := setupTestDB(t)
+	router := mux.NewRouter()
+	router.HandleFunc("/api/audit", GetAudit).Methods("GET")
+
+	// Written the way recordAudit writes them, with time.Now() in local time
+	for i, hour := range []int{8, 12, 16} {
+		at := time.Date(2024, time.May, 1, hour, 0, 0, 0, time.Local)
+		_, err := db.DB.Exec(
+			"INSERT INTO audit_log (at, actor_id, actor_name, action, target_type, target_id) VALUES (?, ?, ?, ?, ?, ?)",
+			at, user.ID, user.Username, AuditBookUpdate, "book", []string{"eight", "noon", "four"}[i],
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		// 12:00 local is 07:00 UTC and 16:00 in UTC+9
+		{"since=2024-05-01T07:00:00Z", []string{"four", "noon"}},
+		{"since=2024-05-01T07:00:01Z", []string{"four"}},
+		{"until=2024-05-01T07:00:00Z", []string{"eight"}},
+		{"since=2024-05-01T16:00:00%2B09:00", []string{"four", "noon"}},
+		{"since=2024-05-01T04:00:00Z&until=2024-05-01T11:00:00Z", []string{"noon"}},
+		{"since=2024-05-01&until=2024-05-01", []string{"four", "noon", "eight"}},
+		{"until=2024-04-30", nil},
+	}
+	for _, tt := range tests {
+		var entries []models.AuditEntry
+		decodeResponse(t, serveAs(router, user, "GET", "/api/audit?"+tt.query, ""), &entries)
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.TargetID)
+		}
+		if !slices.Equal(got, tt.want) {
+			query, _ := url.QueryUnescape(tt.query)
+			t.Errorf("%s: entries %v, want %v", query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,632 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	sessionCookieName = "bookland_session"
+	sessionLifetime   = 30 * 24 * time.Hour
+
+	// How long verified HTTP Basic passwords are remembered.
+	passwordCacheLifetime = 5 * time.Minute
+
+	// PBKDF2-SHA256 parameters for new password hashes. Stored hashes carry
+	// their own iteration count so this can be raised later.
+	passwordIterations = 210000
+	passwordSaltLength = 16
+	passwordKeyLength  = 32
+
+	minPasswordLength = 8
+	maxUsernameLength = 64
+)
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errUsernameTaken      = errors.New("username already taken")
+	errNotFirstUser       = errors.New("an account already exists")
+)
+
+// unknownUserHash is verified against when a login names no existing user.
+var unknownUserHash = fmt.Sprintf("pbkdf2-sha256$%d$AAAAAAAAAAAAAAAAAAAAAA$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", passwordIterations)
+
+type contextKey string
+
+const (
+	userContextKey  contextKey = "user"
+	scopeContextKey contextKey = "scope"
+)
+
+// CurrentUser returns the user attached to the request by SessionMiddleware, or nil.
+func CurrentUser(r *http.Request) *models.User {
+	user, _ := r.Context().Value(userContextKey).(*models.User)
+	return user
+}
+
+// currentUserID returns the signed-in user's ID, or "" for anonymous requests.
+func currentUserID(r *http.Request) string {
+	if user := CurrentUser(r); user != nil {
+		return user.ID
+	}
+	return ""
+}
+
+// requireUser returns the signed-in user, replying 401 when there is none.
+func requireUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	user := CurrentUser(r)
+	if user == nil {
+		unauthorized(w, r, "Authentication required")
+		return nil, false
+	}
+	return user, true
+}
+
+// unauthorized replies 401. Clients other than the web UI, such as e-readers,
+// are also sent a Basic challenge so they prompt for credentials.
+func unauthorized(w http.ResponseWriter, r *http.Request, message string) {
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode == "" || mode == "navigate" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Bookland", charset="UTF-8"`)
+	}
+	http.Error(w, message, http.StatusUnauthorized)
+}
+
+// AuthMiddleware identifies the caller from a bearer token, HTTP Basic
+// credentials or the session cookie, and attaches the user and the scope
+// they are acting with to the request context. Requests without credentials
+// pass through anonymously; Require decides whether that is enough.
+// Credentials that are present but wrong are rejected outright.
+func AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user *models.User
+		var scope string
+		var err error
+
+		authorization := r.Header.Get("Authorization")
+		switch {
+		case authorization != "":
+			user, scope, err = userForAuthorization(authorization)
+			if err != nil {
+				unauthorized(w, r, "Invalid credentials")
+				return
+			}
+		default:
+			if cookie, cookieErr := r.Cookie(sessionCookieName); cookieErr == nil && cookie.Value != "" {
+				if user, err = userForSession(cookie.Value); err == nil {
+					scope = ScopeAdmin
+				} else {
+					user = nil
+				}
+			}
+		}
+
+		if user != nil {
+			ctx := context.WithValue(r.Context(), userContextKey, user)
+			ctx = context.WithValue(ctx, scopeContextKey, scope)
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// userForAuthorization resolves an Authorization header. Basic credentials
+// may carry either the account password or an API token as the password.
+func userForAuthorization(header string) (*models.User, string, error) {
+	scheme, credentials, _ := strings.Cut(header, " ")
+	credentials = strings.TrimSpace(credentials)
+
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		return userForToken(credentials)
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return nil, "", errInvalidCredentials
+		}
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return nil, "", errInvalidCredentials
+		}
+		if strings.HasPrefix(password, apiTokenPrefix) {
+			user, scope, err := userForToken(password)
+			if err != nil || !strings.EqualFold(user.Username, username) {
+				return nil, "", errInvalidCredentials
+			}
+			return user, scope, nil
+		}
+		user, err := userForPassword(username, password)
+		if err != nil {
+			return nil, "", err
+		}
+		return user, ScopeAdmin, nil
+	}
+	return nil, "", errInvalidCredentials
+}
+
+// userForPassword checks a username and password. Successful checks are
+// remembered for a few minutes so clients sending Basic credentials with every
+// request do not pay for a password hash each time.
+func userForPassword(username, password string) (*models.User, error) {
+	key := hashToken(strings.ToLower(strings.TrimSpace(username)) + "\x00" + password)
+	if user := passwordCache.get(key); user != nil {
+		return user, nil
+	}
+
+	var user models.User
+	var passwordHash string
+	err := db.DB.QueryRow(
+		"SELECT id, username, password_hash, role, created_at FROM users WHERE username = ?",
+		strings.TrimSpace(username),
+	).Scan(&user.ID, &user.Username, &passwordHash, &user.Role, &user.CreatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == sql.ErrNoRows {
+		// Spend the same time hashing as for a real account so response times
+		// do not reveal which usernames exist.
+		passwordHash = unknownUserHash
+	}
+	if !verifyPassword(password, passwordHash) || err == sql.ErrNoRows {
+		return nil, errInvalidCredentials
+	}
+
+	passwordCache.put(key, &user)
+	return &user, nil
+}
+
+type cachedLogin struct {
+	user    *models.User
+	expires time.Time
+}
+
+// loginCache holds recently verified Basic credentials, keyed by a hash of
+// the username and password.
+type loginCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedLogin
+}
+
+var passwordCache = &loginCache{entries: make(map[string]cachedLogin)}
+
+func (c *loginCache) get(key string) *models.User {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry.user
+}
+
+func (c *loginCache) put(key string, user *models.User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedLogin{user: user, expires: now.Add(passwordCacheLifetime)}
+}
+
+// forget drops every cached login for userID.
+func (c *loginCache) forget(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, entry := range c.entries {
+		if entry.user.ID == userID {
+			delete(c.entries, k)
+		}
+	}
+}
+
+func userForSession(token string) (*models.User, error) {
+	var user models.User
+	err := db.DB.QueryRow(
+		`SELECT u.id, u.username, u.role, u.created_at FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND s.expires_at > ?`,
+		hashToken(token), time.Now(),
+	).Scan(&user.ID, &user.Username, &user.Role, &user.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashPassword returns an encoded PBKDF2-SHA256 hash of the form
+// pbkdf2-sha256$<iterations>$<salt>$<key>.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, passwordIterations, passwordKeyLength)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func verifyPassword(password, encoded string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got := pbkdf2SHA256([]byte(password), salt, iterations, len(want))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// pbkdf2SHA256 implements PBKDF2 (RFC 8018) with HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLength int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLength := prf.Size()
+	blocks := (keyLength + hashLength - 1) / hashLength
+
+	key := make([]byte, 0, blocks*hashLength)
+	u := make([]byte, hashLength)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u = prf.Sum(u[:0])
+		t := make([]byte, hashLength)
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLength]
+}
+
+func createSession(w http.ResponseWriter, r *http.Request, userID string) error {
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	expires := now.Add(sessionLifetime)
+	_, err = db.DB.Exec(
+		"INSERT INTO sessions (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		hashToken(token), userID, now, expires,
+	)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// noUsersYet limits an INSERT ... SELECT to when there are no accounts, so
+// that two sign-ups at once cannot both become the first account.
+const noUsersYet = "WHERE NOT EXISTS (SELECT 1 FROM users)"
+
+func userCount() (int, error) {
+	var count int
+	err := db.DB.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	return count, err
+}
+
+// GetAuthSession reports the signed-in user, what they may do, and whether
+// the first account still has to be created.
+func GetAuthSession(w http.ResponseWriter, r *http.Request) {
+	count, err := userCount()
+	if err != nil {
+		http.Error(w, "Failed to fetch session", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"user":          CurrentUser(r),
+		"permissions":   permissionsFor(r),
+		"setupRequired": count == 0,
+	}
+	if OIDC != nil {
+		response["oidc"] = map[string]string{"name": OIDC.Name, "loginUrl": "/api/auth/oidc/login"}
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Register creates the first account, which becomes an administrator and
+// takes over the reading data recorded before accounts existed. Later
+// accounts are created by administrators through CreateUser.
+func Register(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if message := validateCredentials(input.Username, input.Password); message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	count, err := userCount()
+	if err != nil {
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+	if count > 0 {
+		http.Error(w, "Accounts are created by an administrator", http.StatusForbidden)
+		return
+	}
+
+	// Another first account may have been created since it was counted
+	user, err := insertUser(input.Username, input.Password, RoleAdmin, true)
+	if err == errNotFirstUser {
+		http.Error(w, "Accounts are created by an administrator", http.StatusForbidden)
+		return
+	}
+	if err == errUsernameTaken {
+		http.Error(w, "Username already taken", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+
+	if err := claimLegacyData(user.ID); err != nil {
+		log.Printf("Failed to assign existing reading data to %s: %v", user.Username, err)
+	}
+	if err := createSession(w, r, user.ID); err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+// validateCredentials returns a message describing what is wrong with a new
+// username and password, or "" if they are acceptable.
+func validateCredentials(username, password string) string {
+	username = strings.TrimSpace(username)
+	if username == "" || len(username) > maxUsernameLength {
+		return fmt.Sprintf("Username must be 1-%d characters", maxUsernameLength)
+	}
+	if len(password) < minPasswordLength {
+		return fmt.Sprintf("Password must be at least %d characters", minPasswordLength)
+	}
+	return ""
+}
+
+// insertUser adds a local account. With first set it is only added if there
+// are no accounts yet, checked in the same statement, and errNotFirstUser is
+// returned otherwise.
+func insertUser(username, password, role string, first bool) (*models.User, error) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user := models.User{
+		ID:        uuid.New().String(),
+		Username:  strings.TrimSpace(username),
+		Role:      role,
+		CreatedAt: time.Now(),
+	}
+	insert := "INSERT INTO users (id, username, password_hash, role, created_at) VALUES (?, ?, ?, ?, ?)"
+	if first {
+		insert = "INSERT INTO users (id, username, password_hash, role, created_at) SELECT ?, ?, ?, ?, ? " + noUsersYet
+	}
+	result, err := db.DB.Exec(insert, user.ID, user.Username, hash, user.Role, user.CreatedAt)
+	if err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "unique") {
+			return nil, errUsernameTaken
+		}
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, errNotFirstUser
+	}
+	if err := grantLibraries(user.ID, []string{DefaultLibraryID}); err != nil {
+		return nil, err
+	}
+	user.Libraries = []string{DefaultLibraryID}
+	return &user, nil
+}
+
+// claimLegacyData hands progress, reading state, annotations, shelves and
+// sessions recorded before accounts existed to userID.
+func claimLegacyData(userID string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`INSERT OR IGNORE INTO user_books (user_id, book_id, progress_format, progress_cfi, progress_page, progress_total_pages,
+			progress_fraction, progress_chapter, progress_device, progress_updated_at, status, started_at, finished_at, rating, favorite, review)
+		SELECT ?, id, progress_format, progress_cfi, progress_page, progress_total_pages,
+			progress_fraction, progress_chapter, progress_device, progress_updated_at,
+			COALESCE(status, ''), started_at, finished_at, COALESCE(rating, 0), COALESCE(favorite, 0), COALESCE(review, '')
+		FROM books
+		WHERE COALESCE(progress_format, '') != '' OR COALESCE(status, '') != '' OR COALESCE(rating, 0) != 0
+			OR COALESCE(favorite, 0) != 0 OR COALESCE(review, '') != ''`,
+		`UPDATE annotations SET user_id = ? WHERE user_id = ''`,
+		`UPDATE shelves SET user_id = ? WHERE user_id = ''`,
+		`UPDATE reading_sessions SET user_id = ? WHERE user_id = ''`,
+		`UPDATE device_progress SET user_id = ? WHERE user_id = ''`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, userID); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`UPDATE books SET progress_format = NULL, progress_cfi = NULL, progress_page = NULL, progress_total_pages = NULL,
+		progress_fraction = NULL, progress_chapter = NULL, progress_device = NULL, progress_updated_at = NULL,
+		status = '', started_at = NULL, finished_at = NULL, rating = 0, favorite = 0, review = ''`)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func Login(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := userForPassword(input.Username, input.Password)
+	if err == errInvalidCredentials {
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
+	}
+
+	if err := createSession(w, r, user.ID); err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+func Logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if _, err := db.DB.Exec("DELETE FROM sessions WHERE token_hash = ?", hashToken(cookie.Value)); err != nil {
+			log.Printf("Failed to delete session: %v", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// ChangePassword updates the signed-in user's password and ends their other sessions.
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(input.NewPassword) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	var passwordHash string
+	if err := db.DB.QueryRow("SELECT password_hash FROM users WHERE id = ?", user.ID).Scan(&passwordHash); err != nil {
+		http.Error(w, "Failed to change password", http.StatusInternalServerError)
+		return
+	}
+	if !verifyPassword(input.CurrentPassword, passwordHash) {
+		http.Error(w, "Current password is incorrect", http.StatusForbidden)
+		return
+	}
+
+	hash, err := hashPassword(input.NewPassword)
+	if err != nil {
+		http.Error(w, "Failed to change password", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.DB.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, user.ID); err != nil {
+		http.Error(w, "Failed to change password", http.StatusInternalServerError)
+		return
+	}
+	passwordCache.forget(user.ID)
+
+	keep := ""
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		keep = hashToken(cookie.Value)
+	}
+	if _, err := db.DB.Exec("DELETE FROM sessions WHERE user_id = ? AND token_hash != ?", user.ID, keep); err != nil {
+		log.Printf("Failed to end other sessions for %s: %v", user.Username, err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
@@ -3,13 +3,18 @@ package handlers
 import (
 	"bookland/db"
 	"bookland/models"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -19,64 +24,327 @@ import (
 
 var DataPath string
 
-func UploadBook(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseMultipartForm(100 << 20) // 100MB max
+// BooksPath is the default library's books directory. Imports leave files
+// that are already inside it where they are instead of copying them.
+var BooksPath string
+
+// MaxUploadSize is the largest book file UploadBook accepts, in bytes.
+var MaxUploadSize int64 = 100 << 20
+
+// supportedTypes maps the extensions of the book formats Bookland accepts to
+// their file types.
+var supportedTypes = map[string]string{
+	".epub": "epub",
+	".pdf":  "pdf",
+	".mobi": "mobi",
+	".azw3": "azw3",
+	".fb2":  "fb2",
+	".cbz":  "cbz",
+}
+
+// maxUploadParts limits how many files and fields one upload request may carry.
+const maxUploadParts = 1000
+
+// errUploadTooLarge is recorded for files over MaxUploadSize.
+var errUploadTooLarge = errors.New("upload too large")
+
+func uploadTooLarge(w http.ResponseWriter) {
+	http.Error(w, fmt.Sprintf("File too large: the limit is %d MB", MaxUploadSize>>20), http.StatusRequestEntityTooLarge)
+}
+
+// stagedFile is an uploaded file held in the staging directory until it is
+// moved into a book's storage directory.
+type stagedFile struct {
+	Filename string
+	Path     string
+	Size     int64
+	Hash     string
+	Err      error
+}
+
+func (f *stagedFile) remove() {
+	if f.Path != "" {
+		os.Remove(f.Path)
+	}
+}
+
+func stagingDir() string {
+	return filepath.Join(DataPath, "uploads")
+}
+
+// stageFile copies src, up to MaxUploadSize bytes, into a new file in the
+// staging directory, hashing it on the way.
+func stageFile(filename string, src io.Reader) stagedFile {
+	staged := stagedFile{Filename: sanitizeFilename(filename)}
+	if err := os.MkdirAll(stagingDir(), 0755); err != nil {
+		staged.Err = err
+		return staged
+	}
+	temp, err := os.CreateTemp(stagingDir(), ".upload-*")
 	if err != nil {
-		http.Error(w, "File too large", http.StatusBadRequest)
-		return
+		staged.Err = err
+		return staged
 	}
+	staged.Path = temp.Name()
 
-	file, header, err := r.FormFile("book")
+	hash := sha256.New()
+	staged.Size, err = io.Copy(io.MultiWriter(temp, hash), io.LimitReader(src, MaxUploadSize+1))
+	if err == nil && staged.Size > MaxUploadSize {
+		err = errUploadTooLarge
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		// Try legacy field name for backwards compatibility
-		file, header, err = r.FormFile("epub")
-		if err != nil {
-			http.Error(w, "Failed to read file", http.StatusBadRequest)
-			return
-		}
+		staged.remove()
+		staged.Path = ""
+		staged.Err = err
+		return staged
+	}
+	staged.Hash = hex.EncodeToString(hash.Sum(nil))
+	return staged
+}
+
+// hashFile returns the hex SHA-256 of a file's contents.
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
 	}
 	defer file.Close()
 
-	fileExt := strings.ToLower(filepath.Ext(header.Filename))
-	supportedTypes := map[string]string{
-		".epub": "epub",
-		".pdf":  "pdf",
-		".mobi": "mobi",
-		".azw3": "azw3",
-		".fb2":  "fb2",
-		".cbz":  "cbz",
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// receiveUpload streams the multipart body to the staging directory without
+// buffering it in memory. Every file part named "book" (or "epub", from older
+// clients) is staged; a file that fails, such as one over the size limit,
+// carries its error and the rest are still received. Other parts are
+// returned as form fields.
+func receiveUpload(r *http.Request) ([]stagedFile, map[string]string, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []stagedFile
+	fields := make(map[string]string)
+	for parts := 0; ; parts++ {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err == nil && parts >= maxUploadParts {
+			err = fmt.Errorf("more than %d parts", maxUploadParts)
+		}
+		if err != nil {
+			for i := range files {
+				files[i].remove()
+			}
+			return nil, nil, err
+		}
+
+		name := part.FormName()
+		if (name == "book" || name == "epub") && part.FileName() != "" {
+			files = append(files, stageFile(part.FileName(), part))
+			continue
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, 4096))
+		if err != nil {
+			for i := range files {
+				files[i].remove()
+			}
+			return nil, nil, err
+		}
+		fields[name] = string(value)
 	}
-	fileType, ok := supportedTypes[fileExt]
+	return files, fields, nil
+}
+
+// errUnsupportedFormat is returned by storeBook for files that are not books.
+var errUnsupportedFormat = errors.New("unsupported file format")
+
+// storeBook moves a staged file into a new book's storage directory and adds
+// it to the library. With dedupe set, a file identical to one already in the
+// library is not added again; the existing book's ID is returned instead.
+func storeBook(r *http.Request, libraryID string, staged *stagedFile, dedupe bool) (book models.Book, duplicateOf string, err error) {
+	fileType, ok := supportedTypes[strings.ToLower(filepath.Ext(staged.Filename))]
 	if !ok {
-		http.Error(w, "Unsupported file format", http.StatusBadRequest)
-		return
+		return book, "", errUnsupportedFormat
+	}
+	if err := validateBookFile(staged.Path, fileType); err != nil {
+		return book, "", err
+	}
+
+	if dedupe {
+		err := db.DB.QueryRow(
+			`SELECT b.id FROM books b JOIN book_formats f ON f.book_id = b.id
+			WHERE b.library_id = ? AND f.file_hash = ? AND b.deleted_at IS NULL`,
+			libraryID, staged.Hash,
+		).Scan(&duplicateOf)
+		if err == nil {
+			return book, duplicateOf, nil
+		}
 	}
 
 	bookID := uuid.New().String()
-	storageDir := filepath.Join(DataPath, "books", bookID)
-	err = os.MkdirAll(storageDir, 0755)
+	storageDir := bookStorageDir(bookID)
+	if err := os.MkdirAll(storageDir, 0755); err != nil {
+		return book, "", err
+	}
+	filePath := filepath.Join(storageDir, staged.Filename)
+	if err := os.Rename(staged.Path, filePath); err != nil {
+		os.RemoveAll(storageDir)
+		return book, "", err
+	}
+
+	book, err = addBook(r, bookID, libraryID, filePath, fileType, staged.Size, staged.Hash)
 	if err != nil {
-		http.Error(w, "Failed to create book directory", http.StatusInternalServerError)
-		return
+		// Put the file back so the caller still owns it.
+		os.Rename(filePath, staged.Path)
+		os.RemoveAll(storageDir)
+		return book, "", err
 	}
+	staged.Path = ""
+	return book, "", nil
+}
 
-	filePath := filepath.Join(storageDir, header.Filename)
-	dst, err := os.Create(filePath)
+// UploadBook adds uploaded books to a library. A request with a single book
+// file gets the new book back. A request with several files, or a zip of
+// books, gets a result for each file instead, and files already in the
+// library are reported as duplicates rather than added again.
+func UploadBook(w http.ResponseWriter, r *http.Request) {
+	files, fields, err := receiveUpload(r)
 	if err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		http.Error(w, "Failed to read upload", http.StatusBadRequest)
+		log.Println("Upload error:", err)
+		return
+	}
+	defer func() {
+		for i := range files {
+			files[i].remove()
+		}
+	}()
+	if len(files) == 0 {
+		http.Error(w, "No book file in the upload", http.StatusBadRequest)
+		return
+	}
+
+	libraryID := fields["library"]
+	if libraryID == "" {
+		libraryID = r.URL.Query().Get("library")
+	}
+	if libraryID == "" {
+		libraryID = DefaultLibraryID
+	}
+	if !canAccessLibrary(r, libraryID) {
+		http.Error(w, "Library not found", http.StatusNotFound)
 		return
 	}
-	defer dst.Close()
 
-	fileSize, err := io.Copy(dst, file)
+	if len(files) == 1 && !isBundle(files[0].Filename) {
+		uploadSingleBook(w, r, libraryID, &files[0])
+		return
+	}
+
+	results := make([]models.UploadResult, 0, len(files))
+	for i := range files {
+		if isBundle(files[i].Filename) && files[i].Err == nil {
+			results = append(results, storeBundle(r, libraryID, &files[i])...)
+			continue
+		}
+		results = append(results, storeUploadResult(r, libraryID, &files[i], files[i].Filename))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func uploadSingleBook(w http.ResponseWriter, r *http.Request, libraryID string, staged *stagedFile) {
+	switch {
+	case errors.Is(staged.Err, errUploadTooLarge):
+		uploadTooLarge(w)
+		return
+	case staged.Err != nil:
+		http.Error(w, "Failed to read file", http.StatusBadRequest)
+		log.Println("Upload error:", staged.Err)
+		return
+	}
+
+	book, _, err := storeBook(r, libraryID, staged, false)
+	var invalid invalidBookError
+	if errors.Is(err, errUnsupportedFormat) {
+		http.Error(w, "Unsupported file format", http.StatusBadRequest)
+		return
+	}
+	if errors.As(err, &invalid) {
+		http.Error(w, invalid.Error(), http.StatusUnprocessableEntity)
+		return
+	}
 	if err != nil {
-		os.Remove(filePath)
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		http.Error(w, "Failed to save book metadata", http.StatusInternalServerError)
+		log.Println("DB error:", err)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(book)
+}
+
+// storeUploadResult stores one staged file of a bulk upload and describes
+// the outcome. name is how the file is reported, which for zip entries
+// includes the bundle.
+func storeUploadResult(r *http.Request, libraryID string, staged *stagedFile, name string) models.UploadResult {
+	result := models.UploadResult{File: name}
+	if staged.Err != nil {
+		result.Status = models.UploadFailed
+		result.Error = "Failed to read file"
+		if errors.Is(staged.Err, errUploadTooLarge) {
+			result.Error = fmt.Sprintf("File too large: the limit is %d MB", MaxUploadSize>>20)
+		}
+		return result
+	}
+
+	book, duplicateOf, err := storeBook(r, libraryID, staged, true)
+	var invalid invalidBookError
+	switch {
+	case errors.Is(err, errUnsupportedFormat):
+		result.Status = models.UploadFailed
+		result.Error = "Unsupported file format"
+	case errors.As(err, &invalid):
+		result.Status = models.UploadFailed
+		result.Error = invalid.Error()
+	case err != nil:
+		log.Printf("Failed to add %s: %v", name, err)
+		result.Status = models.UploadFailed
+		result.Error = "Failed to save book metadata"
+	case duplicateOf != "":
+		result.Status = models.UploadDuplicate
+		result.BookID = duplicateOf
+	default:
+		result.Status = models.UploadCreated
+		result.BookID = book.ID
+		result.Title = book.Title
+	}
+	return result
+}
+
+// addBook extracts the metadata of a book file already stored in its storage
+// directory and adds it to the catalog.
+func addBook(r *http.Request, bookID, libraryID, filePath, fileType string, fileSize int64, fileHash string) (models.Book, error) {
+	storageDir := bookStorageDir(bookID)
+	filename := filepath.Base(filePath)
+
 	// Get original filename without extension for title fallback
-	originalName := strings.TrimSuffix(header.Filename, filepath.Ext(header.Filename))
+	originalName := strings.TrimSuffix(filename, filepath.Ext(filename))
 
 	var title, author, coverPath string
 	switch fileType {
@@ -101,6 +369,7 @@ func UploadBook(w http.ResponseWriter, r *http.Request) {
 
 	book := models.Book{
 		ID:        bookID,
+		LibraryID: libraryID,
 		Title:     title,
 		Author:    author,
 		CoverPath: coverPath,
@@ -110,22 +379,195 @@ func UploadBook(w http.ResponseWriter, r *http.Request) {
 		AddedAt:   time.Now(),
 	}
 
-	_, err = db.DB.Exec(
-		"INSERT INTO books (id, title, author, cover_path, file_path, file_size, file_type, added_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
-		book.ID, book.Title, book.Author, book.CoverPath, book.FilePath, book.FileSize, book.FileType, book.AddedAt,
+	if err := insertBook(book, fileHash); err != nil {
+		return book, err
+	}
+	book.Formats = []string{fileType}
+	if after, err := loadBookRecord(book.ID); err == nil {
+		recordAudit(r, AuditBookUpload, "book", book.ID, nil, after)
+	}
+	validateNewBook(book.ID, filePath, fileType)
+	detectNewBookISBN(book.ID, filePath, fileType)
+
+	return book, nil
+}
+
+// bookFormatPath returns the file of one of a book's formats.
+func bookFormatPath(bookID, fileType string) (string, error) {
+	var filePath string
+	err := db.DB.QueryRow("SELECT file_path FROM book_formats WHERE book_id = ? AND file_type = ?", bookID, fileType).Scan(&filePath)
+	return filePath, err
+}
+
+// insertBook saves a new book, with its catalog metadata, tags and
+// identifiers, and its file as the book's only format.
+func insertBook(book models.Book, fileHash string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO books (id, library_id, title, author, cover_path, file_path, file_size, file_type, file_hash, added_at, series, series_index, description)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		book.ID, book.LibraryID, book.Title, book.Author, book.CoverPath, book.FilePath, book.FileSize, book.FileType, fileHash, book.AddedAt,
+		book.Series, book.SeriesIndex, book.Description,
 	)
 	if err != nil {
-		http.Error(w, "Failed to save book metadata", http.StatusInternalServerError)
-		log.Println("DB error:", err)
-		return
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO book_formats (book_id, file_type, file_path, file_size, file_hash) VALUES (?, ?, ?, ?, ?)",
+		book.ID, book.FileType, book.FilePath, book.FileSize, fileHash,
+	)
+	if err != nil {
+		return err
 	}
+	if err := insertTagsAndIdentifiers(tx, book.ID, book.Tags, book.Identifiers); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(book)
+// insertTagsAndIdentifiers adds tags and identifiers to a book, skipping
+// empty values.
+func insertTagsAndIdentifiers(tx *sql.Tx, bookID string, tags []string, identifiers map[string]string) error {
+	for _, tag := range tags {
+		if tag = strings.TrimSpace(tag); tag == "" {
+			continue
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO book_tags (book_id, tag) VALUES (?, ?)", bookID, tag); err != nil {
+			return err
+		}
+	}
+	for kind, value := range identifiers {
+		kind, value = strings.ToLower(strings.TrimSpace(kind)), strings.TrimSpace(value)
+		if kind == "" || value == "" {
+			continue
+		}
+		if _, err := tx.Exec("INSERT OR REPLACE INTO book_identifiers (book_id, type, value) VALUES (?, ?, ?)", bookID, kind, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bookColumns lists the columns read by scanBook, in order. Select them with
+// bookFrom, which limits books to the libraries of the user bound as its
+// argument and joins that user's reading state.
+const bookColumns = "b.id, b.library_id, b.title, b.author, b.cover_path, b.file_path, b.file_size, b.file_type, b.added_at, b.deleted_at, " +
+	"b.series, b.series_index, b.description, " +
+	"(SELECT group_concat(file_type) FROM book_formats WHERE book_id = b.id), " +
+	"ub.progress_format, ub.progress_cfi, ub.progress_page, ub.progress_total_pages, ub.progress_fraction, ub.progress_chapter, ub.progress_device, ub.progress_updated_at, " +
+	"ub.status, ub.started_at, ub.finished_at, ub.rating, ub.favorite, ub.review"
+
+const bookFrom = " FROM books b" + bookAccess + " LEFT JOIN user_books ub ON ub.book_id = b.id AND ub.user_id = u.id"
+
+// bookAccess joins the user bound as its argument to the books b they may see:
+// those in libraries they have been granted, or every book for administrators,
+// leaving out books in the trash.
+const bookAccess = bookVisible + " AND b.deleted_at IS NULL"
+
+// bookVisible is bookAccess including trashed books.
+const bookVisible = " JOIN users u ON u.id = ? AND (u.role = '" + RoleAdmin + "' OR b.library_id IN (SELECT library_id FROM library_grants WHERE user_id = u.id))"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanBook reads a row selected with bookColumns, followed by any extra destinations.
+func scanBook(row rowScanner, extra ...any) (models.Book, error) {
+	var book models.Book
+	var progressFormat, progressCFI, progressChapter, progressDevice sql.NullString
+	var progressPage, progressTotalPages sql.NullInt64
+	var progressFraction sql.NullFloat64
+	var progressUpdatedAt, deletedAt sql.NullTime
+	var series, description sql.NullString
+	var seriesIndex sql.NullFloat64
+	var formats sql.NullString
+	var status, review sql.NullString
+	var startedAt, finishedAt sql.NullTime
+	var rating sql.NullInt64
+	var favorite sql.NullBool
+	dest := []any{&book.ID, &book.LibraryID, &book.Title, &book.Author, &book.CoverPath, &book.FilePath, &book.FileSize, &book.FileType, &book.AddedAt, &deletedAt,
+		&series, &seriesIndex, &description, &formats,
+		&progressFormat, &progressCFI, &progressPage, &progressTotalPages, &progressFraction, &progressChapter, &progressDevice, &progressUpdatedAt,
+		&status, &startedAt, &finishedAt, &rating, &favorite, &review}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return book, err
+	}
+	if progressFormat.Valid && progressFormat.String != "" {
+		book.Progress = &models.ReadingProgress{
+			Format:     progressFormat.String,
+			CFI:        progressCFI.String,
+			Page:       int(progressPage.Int64),
+			TotalPages: int(progressTotalPages.Int64),
+			Fraction:   progressFraction.Float64,
+			Chapter:    progressChapter.String,
+			Device:     progressDevice.String,
+			Timestamp:  progressUpdatedAt.Time,
+		}
+		book.ProgressPercent = book.Progress.Percent()
+	}
+	if deletedAt.Valid {
+		book.DeletedAt = &deletedAt.Time
+	}
+	book.Series = series.String
+	if seriesIndex.Valid {
+		book.SeriesIndex = &seriesIndex.Float64
+	}
+	book.Description = description.String
+	if formats.Valid {
+		// The main format first, then the rest alphabetically.
+		book.Formats = strings.Split(formats.String, ",")
+		slices.SortFunc(book.Formats, func(a, b string) int {
+			if (a == book.FileType) != (b == book.FileType) {
+				if a == book.FileType {
+					return -1
+				}
+				return 1
+			}
+			return strings.Compare(a, b)
+		})
+	}
+	book.Status = status.String
+	if startedAt.Valid {
+		book.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		book.FinishedAt = &finishedAt.Time
+	}
+	book.Rating = int(rating.Int64)
+	book.Favorite = favorite.Bool
+	book.Review = review.String
+	return book, nil
 }
 
+// GetBooks lists the books the user can see, optionally only those in one
+// ?library= or with an ?isbn=, which matches in either its 10 or 13 digit form.
 func GetBooks(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.DB.Query("SELECT id, title, author, cover_path, file_path, file_size, file_type, added_at, reading_progress FROM books ORDER BY added_at DESC")
+	query := "SELECT " + bookColumns + bookFrom
+	args := []any{currentUserID(r)}
+	var conditions []string
+	if libraryID := r.URL.Query().Get("library"); libraryID != "" {
+		conditions = append(conditions, "b.library_id = ?")
+		args = append(args, libraryID)
+	}
+	if isbn := r.URL.Query().Get("isbn"); isbn != "" {
+		long := isbn13(isbn)
+		if long == "" {
+			http.Error(w, "isbn is not a valid ISBN", http.StatusBadRequest)
+			return
+		}
+		conditions = append(conditions, `b.id IN (SELECT book_id FROM book_identifiers
+			WHERE type = 'isbn' AND REPLACE(REPLACE(UPPER(value), '-', ''), ' ', '') IN (?, ?))`)
+		args = append(args, long, isbn10(long))
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := db.DB.Query(query+" ORDER BY b.added_at DESC", args...)
 	if err != nil {
 		http.Error(w, "Failed to fetch books", http.StatusInternalServerError)
 		return
@@ -134,16 +576,11 @@ func GetBooks(w http.ResponseWriter, r *http.Request) {
 
 	books := make([]models.Book, 0)
 	for rows.Next() {
-		var book models.Book
-		var readingProgress sql.NullString
-		err := rows.Scan(&book.ID, &book.Title, &book.Author, &book.CoverPath, &book.FilePath, &book.FileSize, &book.FileType, &book.AddedAt, &readingProgress)
+		book, err := scanBook(rows)
 		if err != nil {
 			log.Println("Scan error:", err)
 			continue
 		}
-		if readingProgress.Valid {
-			book.ReadingProgress = readingProgress.String
-		}
 		books = append(books, book)
 	}
 
@@ -155,66 +592,220 @@ func GetBook(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bookID := vars["id"]
 
-	var book models.Book
-	var readingProgress sql.NullString
-	err := db.DB.QueryRow(
-		"SELECT id, title, author, cover_path, file_path, file_size, file_type, added_at, reading_progress FROM books WHERE id = ?",
-		bookID,
-	).Scan(&book.ID, &book.Title, &book.Author, &book.CoverPath, &book.FilePath, &book.FileSize, &book.FileType, &book.AddedAt, &readingProgress)
-
+	book, err := scanBook(db.DB.QueryRow("SELECT "+bookColumns+bookFrom+" WHERE b.id = ?", currentUserID(r), bookID))
 	if err != nil {
 		http.Error(w, "Book not found", http.StatusNotFound)
 		return
 	}
-
-	if readingProgress.Valid {
-		book.ReadingProgress = readingProgress.String
+	if err := loadBookMetadata(&book); err != nil {
+		http.Error(w, "Failed to fetch book", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(book)
 }
 
+// loadBookMetadata fills in a book's tags and identifiers, which live in
+// their own tables.
+func loadBookMetadata(book *models.Book) error {
+	rows, err := db.DB.Query("SELECT tag FROM book_tags WHERE book_id = ? ORDER BY tag", book.ID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err == nil {
+			book.Tags = append(book.Tags, tag)
+		}
+	}
+	rows.Close()
+
+	rows, err = db.DB.Query("SELECT type, value FROM book_identifiers WHERE book_id = ?", book.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind, value string
+		if err := rows.Scan(&kind, &value); err == nil {
+			if book.Identifiers == nil {
+				book.Identifiers = map[string]string{}
+			}
+			book.Identifiers[kind] = value
+		}
+	}
+	return rows.Err()
+}
+
+// SaveProgress records the reader's position. The body is a ReadingProgress
+// in any of the book's formats, the main one if left out; the legacy
+// {"progress": "<json>"} form is still accepted. The response reports the
+// resolved position in the same format.
 func SaveProgress(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bookID := vars["id"]
 
-	var payload struct {
-		Progress string `json:"progress"`
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+
+	current, err := decodeProgress(r.Body)
+	if err != nil {
 		log.Printf("SaveProgress decode error: %v", err)
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	_, err := db.DB.Exec("UPDATE books SET reading_progress = ? WHERE id = ?", payload.Progress, bookID)
+	book, err := scanBook(db.DB.QueryRow("SELECT "+bookColumns+bookFrom+" WHERE b.id = ?", user.ID, bookID))
+	if err != nil {
+		http.Error(w, "Book not found", http.StatusNotFound)
+		return
+	}
+
+	formats, err := progressFormats(bookID)
+	if err != nil {
+		http.Error(w, "Failed to save progress", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	if err := validateProgress(&current, book.FileType, formats, now); err != nil {
+		http.Error(w, "Invalid progress: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	devices, err := loadDeviceProgress(user.ID, bookID)
 	if err != nil {
 		log.Printf("SaveProgress DB error for book %s: %v", bookID, err)
 		http.Error(w, "Failed to save progress", http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	// Each device keeps a position per format, and only positions in the
+	// same format are compared
+	var previous *models.ReadingProgress
+	for i := range devices {
+		if devices[i].Device == current.Device && devices[i].Format == current.Format {
+			previous = &devices[i]
+		}
+	}
+	if previous != nil && previous.Timestamp.After(current.Timestamp) {
+		// A delayed update from this device; it already reported a newer position.
+		inFormat := progressIn(devices, current.Format)
+		resolved := resolveProgress(inFormat, ProgressStrategy)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(saveProgressResponse{
+			Status:          "ok",
+			Accepted:        false,
+			Progress:        resolved,
+			ProgressPercent: resolved.Percent(),
+			Ahead:           deviceAhead(inFormat, current.Device, previous.Fraction),
+		})
+		return
+	}
+
+	_, err = db.DB.Exec(
+		`INSERT INTO device_progress (user_id, book_id, device, format, cfi, page, total_pages, fraction, chapter, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, book_id, device, format) DO UPDATE SET cfi = excluded.cfi, page = excluded.page,
+			total_pages = excluded.total_pages, fraction = excluded.fraction, chapter = excluded.chapter, updated_at = excluded.updated_at`,
+		user.ID, bookID, current.Device, current.Format, current.CFI, current.Page, current.TotalPages, current.Fraction, current.Chapter, current.Timestamp,
+	)
+	if err != nil {
+		log.Printf("SaveProgress DB error for book %s: %v", bookID, err)
+		http.Error(w, "Failed to save progress", http.StatusInternalServerError)
+		return
+	}
+	if previous != nil {
+		previousCopy := *previous
+		*previous = current
+		previous = &previousCopy
+	} else {
+		devices = append(devices, current)
+	}
+
+	inFormat := progressIn(devices, current.Format)
+	resolved := resolveProgress(inFormat, ProgressStrategy)
+	book.Progress = bookProgress(devices, book.FileType)
+	applyStatus(&book, statusForProgress(book.Status, resolved.Percent()), now)
+
+	if err := saveUserBook(user.ID, &book); err != nil {
+		log.Printf("SaveProgress DB error for book %s: %v", bookID, err)
+		http.Error(w, "Failed to save progress", http.StatusInternalServerError)
+		return
+	}
+
+	if err := recordSession(user.ID, bookID, previous, &current, now); err != nil {
+		log.Printf("SaveProgress session error for book %s: %v", bookID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(saveProgressResponse{
+		Status:          "ok",
+		Accepted:        true,
+		Progress:        resolved,
+		ProgressPercent: resolved.Percent(),
+		Ahead:           deviceAhead(inFormat, current.Device, current.Fraction),
+	})
+}
+
+// saveUserBook stores the per-user fields of book (progress and reading state) for userID.
+func saveUserBook(userID string, book *models.Book) error {
+	var p models.ReadingProgress
+	var progressFormat, progressUpdatedAt any
+	if book.Progress != nil {
+		p = *book.Progress
+		progressFormat = p.Format
+		progressUpdatedAt = p.Timestamp
+	}
+	_, err := db.DB.Exec(
+		`INSERT INTO user_books (user_id, book_id, progress_format, progress_cfi, progress_page, progress_total_pages, progress_fraction,
+			progress_chapter, progress_device, progress_updated_at, status, started_at, finished_at, rating, favorite, review)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, book_id) DO UPDATE SET progress_format = excluded.progress_format, progress_cfi = excluded.progress_cfi,
+			progress_page = excluded.progress_page, progress_total_pages = excluded.progress_total_pages,
+			progress_fraction = excluded.progress_fraction, progress_chapter = excluded.progress_chapter,
+			progress_device = excluded.progress_device, progress_updated_at = excluded.progress_updated_at,
+			status = excluded.status, started_at = excluded.started_at, finished_at = excluded.finished_at,
+			rating = excluded.rating, favorite = excluded.favorite, review = excluded.review`,
+		userID, book.ID, progressFormat, p.CFI, p.Page, p.TotalPages, p.Fraction,
+		p.Chapter, p.Device, progressUpdatedAt, book.Status, book.StartedAt, book.FinishedAt, book.Rating, book.Favorite, book.Review,
+	)
+	return err
 }
 
+// ServeBookFile sends a book's file: its main one, or with ?format= the file
+// of another format the book has.
 func ServeBookFile(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bookID := vars["id"]
 
 	var filePath, fileType string
-	err := db.DB.QueryRow("SELECT file_path, file_type FROM books WHERE id = ?", bookID).Scan(&filePath, &fileType)
+	err := db.DB.QueryRow("SELECT b.file_path, b.file_type FROM books b"+bookAccess+" WHERE b.id = ?", currentUserID(r), bookID).Scan(&filePath, &fileType)
 	if err != nil {
 		http.Error(w, "Book not found", http.StatusNotFound)
 		return
 	}
+	if format := strings.ToLower(r.URL.Query().Get("format")); format != "" && format != fileType {
+		filePath, err = bookFormatPath(bookID, format)
+		if err != nil && format == "epub" {
+			serveConvertedEPUB(w, r, bookID)
+			return
+		}
+		if err != nil {
+			http.Error(w, "The book is not available as "+format, http.StatusNotFound)
+			return
+		}
+		fileType = format
+	}
 
 	// Set appropriate content type based on file type
 	contentTypes := map[string]string{
 		"epub": "application/epub+zip",
 		"pdf":  "application/pdf",
 		"mobi": "application/x-mobipocket-ebook",
+		"azw3": "application/vnd.amazon.ebook",
 		"fb2":  "application/x-fictionbook+xml",
 		"cbz":  "application/vnd.comicbook+zip",
 	}
@@ -232,7 +823,7 @@ func ServeCover(w http.ResponseWriter, r *http.Request) {
 	bookID := vars["id"]
 
 	var coverPath string
-	err := db.DB.QueryRow("SELECT cover_path FROM books WHERE id = ?", bookID).Scan(&coverPath)
+	err := db.DB.QueryRow("SELECT b.cover_path FROM books b"+bookAccess+" WHERE b.id = ?", currentUserID(r), bookID).Scan(&coverPath)
 	if err != nil || coverPath == "" {
 		http.Error(w, "Cover not found", http.StatusNotFound)
 		return
@@ -258,27 +849,102 @@ func DeleteBook(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bookID := vars["id"]
 
-	var coverPath string
-	err := db.DB.QueryRow("SELECT cover_path FROM books WHERE id = ?", bookID).Scan(&coverPath)
+	var exists string
+	err := db.DB.QueryRow("SELECT b.id FROM books b"+bookAccess+" WHERE b.id = ?", currentUserID(r), bookID).Scan(&exists)
 	if err != nil {
 		http.Error(w, "Book not found", http.StatusNotFound)
 		return
 	}
+	before, _ := loadBookRecord(bookID)
 
-	_, err = db.DB.Exec("DELETE FROM books WHERE id = ?", bookID)
+	_, err = db.DB.Exec("UPDATE books SET deleted_at = ? WHERE id = ?", time.Now(), bookID)
 	if err != nil {
 		http.Error(w, "Failed to delete book", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, AuditBookDelete, "book", bookID, before, nil)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+// UpdateBook edits a book's catalog metadata. Only the fields present in the
+// body are changed.
+func UpdateBook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bookID := vars["id"]
+
+	var input struct {
+		Title  *string `json:"title"`
+		Author *string `json:"author"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
 
-	if coverPath != "" {
-		if err := os.Remove(coverPath); err != nil {
-			log.Printf("Warning: failed to delete cover file %s: %v", coverPath, err)
+	var exists string
+	if err := db.DB.QueryRow("SELECT b.id FROM books b"+bookAccess+" WHERE b.id = ?", currentUserID(r), bookID).Scan(&exists); err != nil {
+		http.Error(w, "Book not found", http.StatusNotFound)
+		return
+	}
+	before, err := loadBookRecord(bookID)
+	if err != nil {
+		http.Error(w, "Failed to update book", http.StatusInternalServerError)
+		return
+	}
+
+	after := *before
+	if input.Title != nil {
+		after.Title = strings.TrimSpace(*input.Title)
+		if after.Title == "" {
+			http.Error(w, "Title cannot be empty", http.StatusBadRequest)
+			return
 		}
 	}
+	if input.Author != nil {
+		after.Author = strings.TrimSpace(*input.Author)
+	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+	_, err = db.DB.Exec("UPDATE books SET title = ?, author = ? WHERE id = ?", after.Title, after.Author, bookID)
+	if err != nil {
+		http.Error(w, "Failed to update book", http.StatusInternalServerError)
+		return
+	}
+	if after != *before {
+		recordAudit(r, AuditBookUpdate, "book", bookID,
+			map[string]string{"title": before.Title, "author": before.Author},
+			map[string]string{"title": after.Title, "author": after.Author})
+	}
+
+	book, err := scanBook(db.DB.QueryRow("SELECT "+bookColumns+bookFrom+" WHERE b.id = ?", currentUserID(r), bookID))
+	if err != nil {
+		http.Error(w, "Failed to update book", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(book)
+}
+
+// saveCover stores a cover image in a book's storage directory, returning
+// its path.
+func saveCover(bookID string, data []byte) (string, error) {
+	// Determine extension based on content
+	ext := ".jpg"
+	if len(data) > 4 && data[0] == 0x89 && data[1] == 0x50 {
+		ext = ".png"
+	}
+
+	storageDir := filepath.Join(DataPath, "books", bookID)
+	if err := os.MkdirAll(storageDir, 0755); err != nil {
+		return "", err
+	}
+	coverPath := filepath.Join(storageDir, "cover"+ext)
+	if err := os.WriteFile(coverPath, data, 0644); err != nil {
+		return "", err
+	}
+	return coverPath, nil
 }
 
 func UploadCover(w http.ResponseWriter, r *http.Request) {
@@ -286,8 +952,8 @@ func UploadCover(w http.ResponseWriter, r *http.Request) {
 	bookID := vars["id"]
 
 	// Verify book exists
-	var filePath string
-	err := db.DB.QueryRow("SELECT file_path FROM books WHERE id = ?", bookID).Scan(&filePath)
+	var filePath, previousCover string
+	err := db.DB.QueryRow("SELECT b.file_path, COALESCE(b.cover_path, '') FROM books b"+bookAccess+" WHERE b.id = ?", currentUserID(r), bookID).Scan(&filePath, &previousCover)
 	if err != nil {
 		http.Error(w, "Book not found", http.StatusNotFound)
 		return
@@ -318,28 +984,11 @@ func UploadCover(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Determine extension based on content
-	ext := ".jpg"
-	if len(data) > 4 && data[0] == 0x89 && data[1] == 0x50 {
-		ext = ".png"
-	}
-
-	storageDir := filepath.Join(DataPath, "books", bookID)
-	if err := os.MkdirAll(storageDir, 0755); err != nil {
-		http.Error(w, "Failed to create storage directory", http.StatusInternalServerError)
-		return
-	}
-	coverPath := filepath.Join(storageDir, "cover"+ext)
-	outFile, err := os.Create(coverPath)
+	coverPath, err := saveCover(bookID, data)
 	if err != nil {
 		http.Error(w, "Failed to save cover", http.StatusInternalServerError)
 		return
 	}
-	defer outFile.Close()
-	if _, err := outFile.Write(data); err != nil {
-		http.Error(w, "Failed to write cover", http.StatusInternalServerError)
-		return
-	}
 
 	// Update database
 	_, err = db.DB.Exec("UPDATE books SET cover_path = ? WHERE id = ?", coverPath, bookID)
@@ -347,6 +996,8 @@ func UploadCover(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to update book", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, AuditBookCover, "book", bookID,
+		map[string]string{"coverPath": previousCover}, map[string]string{"coverPath": coverPath})
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"coverPath": coverPath})
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bookland/models"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxBundleEntries limits how many files a zip of books may hold.
+const maxBundleEntries = 1000
+
+var imageExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+}
+
+// isBundle reports whether an uploaded file is a zip to unpack into books.
+func isBundle(filename string) bool {
+	return strings.ToLower(filepath.Ext(filename)) == ".zip"
+}
+
+// ignoredEntry reports whether a zip entry is a directory or an archiver's
+// hidden file, which are skipped without a result.
+func ignoredEntry(f *zip.File) bool {
+	if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") {
+		return true
+	}
+	return strings.HasPrefix(path.Base(f.Name), ".")
+}
+
+// storeBundle adds every book in a zip. A zip that holds only images is a
+// comic and is added as a single CBZ instead.
+func storeBundle(r *http.Request, libraryID string, bundle *stagedFile) []models.UploadResult {
+	if err := validateArchive(bundle.Path); err != nil {
+		return []models.UploadResult{{File: bundle.Filename, Status: models.UploadFailed, Error: err.Error()}}
+	}
+	archive, err := zip.OpenReader(bundle.Path)
+	if err != nil {
+		return []models.UploadResult{{File: bundle.Filename, Status: models.UploadFailed, Error: "Not a valid zip file"}}
+	}
+	defer archive.Close()
+
+	var entries []*zip.File
+	comic := true
+	for _, f := range archive.File {
+		if ignoredEntry(f) {
+			continue
+		}
+		entries = append(entries, f)
+		if !imageExtensions[strings.ToLower(path.Ext(f.Name))] {
+			comic = false
+		}
+	}
+	if len(entries) == 0 {
+		return []models.UploadResult{{File: bundle.Filename, Status: models.UploadFailed, Error: "The zip file is empty"}}
+	}
+	if comic {
+		bundle.Filename = strings.TrimSuffix(bundle.Filename, filepath.Ext(bundle.Filename)) + ".cbz"
+		return []models.UploadResult{storeUploadResult(r, libraryID, bundle, bundle.Filename)}
+	}
+	if len(entries) > maxBundleEntries {
+		return []models.UploadResult{{File: bundle.Filename, Status: models.UploadFailed, Error: "The zip file holds too many files"}}
+	}
+
+	results := make([]models.UploadResult, 0, len(entries))
+	for _, f := range entries {
+		name := bundle.Filename + "/" + f.Name
+		if _, ok := supportedTypes[strings.ToLower(path.Ext(f.Name))]; !ok {
+			results = append(results, models.UploadResult{File: name, Status: models.UploadFailed, Error: "Unsupported file format"})
+			continue
+		}
+
+		src, err := f.Open()
+		if err != nil {
+			results = append(results, models.UploadResult{File: name, Status: models.UploadFailed, Error: "Failed to read file"})
+			continue
+		}
+		staged := stageFile(path.Base(f.Name), src)
+		src.Close()
+
+		results = append(results, storeUploadResult(r, libraryID, &staged, name))
+		staged.remove()
+	}
+	return results
+}
@@ -0,0 +1,425 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// maxImportFailures caps how many failed books an import job lists.
+const maxImportFailures = 100
+
+// calibreFormatOrder ranks formats for the file a Calibre title is read from
+// by default; all of them become formats of the same book.
+var calibreFormatOrder = []string{"epub", "azw3", "mobi", "fb2", "pdf", "cbz"}
+
+// calibreBook is a title in a Calibre library's metadata.db.
+type calibreBook struct {
+	ID          int64
+	UUID        string
+	Title       string
+	Path        string
+	AddedAt     time.Time
+	SeriesIndex float64
+	HasCover    bool
+	Authors     []string
+	Series      string
+	Tags        []string
+	Rating      int
+	Identifiers map[string]string
+	Comments    string
+	Formats     map[string]string
+}
+
+// ImportCalibre queues a Calibre library on the server to be imported into a
+// library. The import runs in the background; poll GetCalibreImport for progress.
+func ImportCalibre(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Path    string `json:"path"`
+		Library string `json:"library"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	libraryPath := filepath.Clean(strings.TrimSpace(input.Path))
+	if !filepath.IsAbs(libraryPath) {
+		http.Error(w, "path must be an absolute path", http.StatusBadRequest)
+		return
+	}
+	if info, err := os.Stat(filepath.Join(libraryPath, "metadata.db")); err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "No Calibre library (metadata.db) found at "+libraryPath, http.StatusBadRequest)
+		return
+	}
+
+	libraryID := input.Library
+	if libraryID == "" {
+		libraryID = DefaultLibraryID
+	}
+	var exists string
+	if err := db.DB.QueryRow("SELECT id FROM libraries WHERE id = ?", libraryID).Scan(&exists); err != nil {
+		http.Error(w, "Library not found", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	job := models.CalibreImport{
+		ID:        uuid.New().String(),
+		Path:      libraryPath,
+		LibraryID: libraryID,
+		Status:    models.ImportPending,
+		Failures:  []models.ImportFailure{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	_, err := db.DB.Exec(
+		"INSERT INTO calibre_imports (id, user_id, library_id, path, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		job.ID, currentUserID(r), job.LibraryID, job.Path, job.Status, job.CreatedAt, job.UpdatedAt,
+	)
+	if err != nil {
+		http.Error(w, "Failed to queue import", http.StatusInternalServerError)
+		return
+	}
+
+	background := r.WithContext(context.WithoutCancel(r.Context()))
+	go runCalibreImport(background, job)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/books/import-calibre/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// GetCalibreImport reports the progress of a Calibre import.
+func GetCalibreImport(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var job models.CalibreImport
+	var failures string
+	err := db.DB.QueryRow(
+		`SELECT id, path, library_id, status, error, total, imported, skipped, failed, failures, created_at, updated_at
+		FROM calibre_imports WHERE id = ? AND user_id = ?`,
+		vars["id"], currentUserID(r),
+	).Scan(&job.ID, &job.Path, &job.LibraryID, &job.Status, &job.Error, &job.Total, &job.Imported, &job.Skipped, &job.Failed,
+		&failures, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		http.Error(w, "Import not found", http.StatusNotFound)
+		return
+	}
+	if err := json.Unmarshal([]byte(failures), &job.Failures); err != nil {
+		job.Failures = []models.ImportFailure{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+func saveCalibreImport(job *models.CalibreImport) {
+	job.UpdatedAt = time.Now()
+	_, err := db.DB.Exec(
+		`UPDATE calibre_imports SET status = ?, error = ?, total = ?, imported = ?, skipped = ?, failed = ?, failures = ?, updated_at = ?
+		WHERE id = ?`,
+		job.Status, job.Error, job.Total, job.Imported, job.Skipped, job.Failed, auditJSON(job.Failures), job.UpdatedAt, job.ID,
+	)
+	if err != nil {
+		log.Printf("Warning: Failed to update Calibre import %s: %v", job.ID, err)
+	}
+}
+
+func runCalibreImport(r *http.Request, job models.CalibreImport) {
+	job.Status = models.ImportRunning
+	saveCalibreImport(&job)
+
+	books, err := readCalibreLibrary(job.Path)
+	if err != nil {
+		log.Printf("Calibre import from %s failed: %v", job.Path, err)
+		job.Status = models.ImportFailed
+		job.Error = "Failed to read the Calibre library's metadata.db"
+		saveCalibreImport(&job)
+		return
+	}
+	job.Total = len(books)
+	saveCalibreImport(&job)
+
+	for i := range books {
+		imported, err := importCalibreBook(r, job.Path, job.LibraryID, &books[i])
+		switch {
+		case err != nil:
+			job.Failed++
+			if len(job.Failures) < maxImportFailures {
+				job.Failures = append(job.Failures, models.ImportFailure{Title: books[i].Title, Reason: err.Error()})
+			}
+		case imported:
+			job.Imported++
+		default:
+			job.Skipped++
+		}
+		if (i+1)%25 == 0 {
+			saveCalibreImport(&job)
+		}
+	}
+
+	job.Status = models.ImportDone
+	saveCalibreImport(&job)
+	log.Printf("Calibre import from %s: %d imported, %d skipped, %d failed", job.Path, job.Imported, job.Skipped, job.Failed)
+}
+
+// readCalibreLibrary reads every title from a Calibre library's metadata.db,
+// without writing to it.
+func readCalibreLibrary(libraryPath string) ([]calibreBook, error) {
+	calibre, err := sql.Open("sqlite", "file:"+filepath.Join(libraryPath, "metadata.db")+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer calibre.Close()
+
+	rows, err := calibre.Query("SELECT id, COALESCE(uuid, ''), title, path, COALESCE(timestamp, ''), COALESCE(series_index, 1), has_cover FROM books ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	var books []calibreBook
+	index := map[int64]*calibreBook{}
+	for rows.Next() {
+		var book calibreBook
+		var added string
+		if err := rows.Scan(&book.ID, &book.UUID, &book.Title, &book.Path, &added, &book.SeriesIndex, &book.HasCover); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		book.AddedAt = parseCalibreTime(added)
+		book.Identifiers = map[string]string{}
+		book.Formats = map[string]string{}
+		books = append(books, book)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range books {
+		index[books[i].ID] = &books[i]
+	}
+
+	// Each linked table is read in one pass and attached to its books.
+	links := []struct {
+		query string
+		apply func(book *calibreBook, a, b string)
+	}{
+		{"SELECT l.book, a.name, '' FROM books_authors_link l JOIN authors a ON a.id = l.author ORDER BY l.id",
+			func(book *calibreBook, name, _ string) { book.Authors = append(book.Authors, name) }},
+		{"SELECT l.book, s.name, '' FROM books_series_link l JOIN series s ON s.id = l.series",
+			func(book *calibreBook, name, _ string) { book.Series = name }},
+		{"SELECT l.book, t.name, '' FROM books_tags_link l JOIN tags t ON t.id = l.tag ORDER BY t.name",
+			func(book *calibreBook, name, _ string) { book.Tags = append(book.Tags, name) }},
+		{"SELECT l.book, CAST(r.rating AS TEXT), '' FROM books_ratings_link l JOIN ratings r ON r.id = l.rating",
+			func(book *calibreBook, rating, _ string) { fmt.Sscan(rating, &book.Rating) }},
+		{"SELECT book, type, val FROM identifiers",
+			func(book *calibreBook, kind, value string) { book.Identifiers[strings.ToLower(kind)] = value }},
+		{"SELECT book, text, '' FROM comments",
+			func(book *calibreBook, text, _ string) { book.Comments = text }},
+		{"SELECT book, format, name FROM data",
+			func(book *calibreBook, format, name string) { book.Formats[strings.ToLower(format)] = name }},
+	}
+	for _, link := range links {
+		rows, err := calibre.Query(link.query)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var bookID int64
+			var a, b sql.NullString
+			if err := rows.Scan(&bookID, &a, &b); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if book, ok := index[bookID]; ok {
+				link.apply(book, a.String, b.String)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return books, nil
+}
+
+// parseCalibreTime reads the timestamps Calibre stores as text, falling back
+// to now.
+func parseCalibreTime(value string) time.Time {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999-07:00", "2006-01-02 15:04:05-07:00", time.RFC3339Nano, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Now()
+}
+
+// underBooksPath reports whether a file already sits in the books directory.
+func underBooksPath(filePath string) bool {
+	if BooksPath == "" {
+		return false
+	}
+	rel, err := filepath.Rel(BooksPath, filePath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// calibreFile is one format of a Calibre title, as found on disk and as
+// stored in Bookland.
+type calibreFile struct {
+	fileType string
+	source   string
+	path     string
+	size     int64
+}
+
+// importCalibreBook adds one Calibre title with all its supported formats,
+// returning false when it was imported into the library before.
+func importCalibreBook(r *http.Request, libraryPath, libraryID string, cb *calibreBook) (bool, error) {
+	if cb.UUID != "" {
+		var existing string
+		err := db.DB.QueryRow(
+			`SELECT b.id FROM books b JOIN book_identifiers i ON i.book_id = b.id
+			WHERE b.library_id = ? AND b.deleted_at IS NULL AND i.type = 'calibre' AND i.value = ?`,
+			libraryID, cb.UUID,
+		).Scan(&existing)
+		if err == nil {
+			return false, nil
+		}
+	}
+
+	bookID := uuid.New().String()
+	storageDir := bookStorageDir(bookID)
+	bookDir := filepath.Join(libraryPath, filepath.FromSlash(cb.Path))
+	inPlace := underBooksPath(bookDir)
+
+	var files []calibreFile
+	for _, fileType := range calibreFormatOrder {
+		name, ok := cb.Formats[fileType]
+		if !ok {
+			continue
+		}
+		source := filepath.Join(bookDir, name+"."+fileType)
+		info, err := os.Stat(source)
+		if err != nil {
+			continue
+		}
+		file := calibreFile{fileType: fileType, source: source, path: source, size: info.Size()}
+		if !inPlace {
+			file.path = filepath.Join(storageDir, sanitizeFilename(name+"."+fileType))
+			if err := copyFile(source, file.path); err != nil {
+				removeBookStorage(bookID)
+				return false, fmt.Errorf("failed to copy %s", filepath.Base(source))
+			}
+		}
+		files = append(files, file)
+	}
+	if len(files) == 0 {
+		return false, fmt.Errorf("no supported book file found")
+	}
+	primary := files[0]
+
+	coverPath := ""
+	if cb.HasCover {
+		cover := filepath.Join(bookDir, "cover.jpg")
+		if inPlace {
+			coverPath = cover
+		} else if err := copyFile(cover, filepath.Join(storageDir, "cover.jpg")); err == nil {
+			coverPath = filepath.Join(storageDir, "cover.jpg")
+		}
+	}
+	if coverPath == "" {
+		switch primary.fileType {
+		case "epub":
+			_, _, coverPath = ExtractEPUBMetadata(primary.path, storageDir, cb.Title)
+		case "pdf":
+			coverPath = ExtractPDFCover(primary.path, storageDir, bookID)
+		case "cbz":
+			coverPath = ExtractCBZCover(primary.path, storageDir)
+		}
+	}
+
+	fileHash, err := hashFile(primary.path)
+	if err != nil {
+		log.Printf("Failed to hash %s: %v", primary.path, err)
+	}
+
+	var seriesIndex any
+	if cb.Series != "" {
+		seriesIndex = cb.SeriesIndex
+	}
+	identifiers := map[string]string{"calibre": cb.UUID}
+	for kind, value := range cb.Identifiers {
+		identifiers[kind] = value
+	}
+
+	err = func() error {
+		tx, err := db.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		_, err = tx.Exec(
+			`INSERT INTO books (id, library_id, title, author, cover_path, file_path, file_size, file_type, file_hash, added_at, series, series_index, description)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			bookID, libraryID, cb.Title, strings.Join(cb.Authors, " & "), coverPath, primary.path, primary.size, primary.fileType, fileHash,
+			cb.AddedAt, cb.Series, seriesIndex, cb.Comments,
+		)
+		if err != nil {
+			return err
+		}
+		if err := insertTagsAndIdentifiers(tx, bookID, cb.Tags, identifiers); err != nil {
+			return err
+		}
+		for _, file := range files {
+			hash := fileHash
+			if file.path != primary.path {
+				hash, _ = hashFile(file.path)
+			}
+			_, err := tx.Exec(
+				"INSERT INTO book_formats (book_id, file_type, file_path, file_size, file_hash) VALUES (?, ?, ?, ?, ?)",
+				bookID, file.fileType, file.path, file.size, hash,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		removeBookStorage(bookID)
+		log.Printf("Failed to import Calibre book %d (%s): %v", cb.ID, cb.Title, err)
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return false, fmt.Errorf("its file is already in Bookland")
+		}
+		return false, fmt.Errorf("failed to save the book")
+	}
+
+	// Calibre keeps one rating per title; it becomes the importing user's.
+	if user := CurrentUser(r); user != nil && cb.Rating > 0 {
+		book := models.Book{ID: bookID, Rating: (cb.Rating + 1) / 2}
+		if err := saveUserBook(user.ID, &book); err != nil {
+			log.Printf("Failed to save rating of %s: %v", cb.Title, err)
+		}
+	}
+
+	if after, err := loadBookRecord(bookID); err == nil {
+		recordAudit(r, AuditBookImport, "book", bookID, nil, after)
+	}
+	validateNewBook(bookID, primary.path, primary.fileType)
+	detectNewBookISBN(bookID, primary.path, primary.fileType)
+	return true, nil
+}
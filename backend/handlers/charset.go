@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// windows1251High maps the upper half of Windows-1251, the usual encoding of
+// Russian FB2 books, from 0x80 to 0xBF; 0xC0 to 0xFF are А to я in order.
+var windows1251High = [64]rune{
+	'Ђ', 'Ѓ', '‚', 'ѓ', '„', '…', '†', '‡', '€', '‰', 'Љ', '‹', 'Њ', 'Ќ', 'Ћ', 'Џ',
+	'ђ', '‘', '’', '“', '”', '•', '–', '—', 0x98, '™', 'љ', '›', 'њ', 'ќ', 'ћ', 'џ',
+	0xA0, 'Ў', 'ў', 'Ј', '¤', 'Ґ', '¦', '§', 'Ё', '©', 'Є', '«', '¬', 0xAD, '®', 'Ї',
+	'°', '±', 'І', 'і', 'ґ', 'µ', '¶', '·', 'ё', '№', 'є', '»', 'ј', 'Ѕ', 'ѕ', 'ї',
+}
+
+// windows1252Controls maps 0x80 to 0x9F of Windows-1252, which older MOBI
+// books are written in; the rest of it matches Latin-1.
+var windows1252Controls = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+}
+
+// decodeCharset converts text in the named character set to UTF-8.
+func decodeCharset(charset string, data []byte) ([]byte, error) {
+	var decode func(b byte) rune
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8":
+		if !utf8.Valid(data) {
+			return bytes.ToValidUTF8(data, []byte("�")), nil
+		}
+		return data, nil
+	case "windows-1251", "cp1251":
+		decode = func(b byte) rune {
+			if b >= 0xC0 {
+				return 'А' + rune(b-0xC0)
+			}
+			return windows1251High[b-0x80]
+		}
+	case "windows-1252", "cp1252", "iso-8859-1", "latin1", "us-ascii", "ascii":
+		decode = func(b byte) rune {
+			if b < 0xA0 {
+				return windows1252Controls[b-0x80]
+			}
+			return rune(b)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported character set %q", charset)
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(data) + len(data)/4)
+	for _, b := range data {
+		if b < 0x80 {
+			out.WriteByte(b)
+		} else {
+			out.WriteRune(decode(b))
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// xmlCharsetReader lets an xml.Decoder read documents that declare one of the
+// character sets decodeCharset knows.
+func xmlCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := decodeCharset(charset, data)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(decoded), nil
+}
@@ -0,0 +1,327 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxActiveConversions limits how many books are converted at once.
+const maxActiveConversions = 2
+
+// convertibleFormats are the formats an EPUB can be made from, in the order
+// they are used when a book has several.
+var convertibleFormats = []string{"fb2", "mobi", "azw3"}
+
+var errNotConvertible = errors.New("the book has no format that can be converted to EPUB")
+
+var (
+	conversionSlots = make(chan struct{}, maxActiveConversions)
+	// conversionsMu keeps two requests from starting the same conversion
+	conversionsMu sync.Mutex
+)
+
+// convertedEPUBPath is where the EPUB made from a book is kept.
+func convertedEPUBPath(bookID string) string {
+	return filepath.Join(bookStorageDir(bookID), "converted.epub")
+}
+
+// conversionSource picks the format an EPUB of a book is made from.
+func conversionSource(bookID string) (bookFormat, error) {
+	formats, err := loadBookFormats(bookID)
+	if err != nil {
+		return bookFormat{}, err
+	}
+	for _, fileType := range convertibleFormats {
+		for _, format := range formats {
+			if format.FileType == fileType {
+				return format, nil
+			}
+		}
+	}
+	return bookFormat{}, errNotConvertible
+}
+
+// conversionRecord is a conversion with what it was made from, to tell
+// whether it is still current.
+type conversionRecord struct {
+	models.BookConversion
+	sourcePath     string
+	sourceModified time.Time
+	filePath       string
+}
+
+func loadConversion(bookID string) (*conversionRecord, error) {
+	var record conversionRecord
+	err := db.DB.QueryRow(
+		`SELECT book_id, format, source_type, source_path, source_modified, file_path, status, error, created_at, updated_at
+		FROM book_conversions WHERE book_id = ? AND format = 'epub'`,
+		bookID,
+	).Scan(&record.BookID, &record.Format, &record.Source, &record.sourcePath, &record.sourceModified, &record.filePath,
+		&record.Status, &record.Error, &record.CreatedAt, &record.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func setConversionStatus(bookID, status, message string) {
+	_, err := db.DB.Exec(
+		"UPDATE book_conversions SET status = ?, error = ?, updated_at = ? WHERE book_id = ? AND format = 'epub'",
+		status, message, time.Now(), bookID,
+	)
+	if err != nil {
+		log.Printf("Warning: Failed to update the conversion of book %s: %v", bookID, err)
+	}
+}
+
+// sourceModified is when a file was last changed, as recorded with the
+// conversions made from it.
+func sourceModified(filePath string) (time.Time, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime().UTC().Truncate(time.Second), nil
+}
+
+// hasCurrentConversion reports whether an EPUB made from a book's current
+// file is ready.
+func hasCurrentConversion(bookID string) bool {
+	record, err := loadConversion(bookID)
+	if err != nil || record.Status != models.ImportDone || !fileExists(record.filePath) {
+		return false
+	}
+	source, err := conversionSource(bookID)
+	if err != nil || source.FilePath != record.sourcePath {
+		return false
+	}
+	modified, err := sourceModified(source.FilePath)
+	return err == nil && record.sourceModified.Equal(modified)
+}
+
+// startConversion queues a book to be converted to EPUB, unless an EPUB made
+// from its current file is already there or on its way. A conversion that
+// failed is only tried again when retry is set.
+func startConversion(bookID string, retry bool) (models.BookConversion, error) {
+	conversionsMu.Lock()
+	defer conversionsMu.Unlock()
+
+	source, err := conversionSource(bookID)
+	if err != nil {
+		return models.BookConversion{}, err
+	}
+	modified, err := sourceModified(source.FilePath)
+	if err != nil {
+		return models.BookConversion{}, err
+	}
+
+	existing, err := loadConversion(bookID)
+	if err != nil && err != sql.ErrNoRows {
+		return models.BookConversion{}, err
+	}
+	if existing != nil && existing.sourcePath == source.FilePath && existing.sourceModified.Equal(modified) {
+		switch existing.Status {
+		case models.ImportPending, models.ImportRunning:
+			return existing.BookConversion, nil
+		case models.ImportDone:
+			if fileExists(existing.filePath) {
+				return existing.BookConversion, nil
+			}
+		case models.ImportFailed:
+			if !retry {
+				return existing.BookConversion, nil
+			}
+		}
+	}
+
+	now := time.Now()
+	job := models.BookConversion{
+		BookID:    bookID,
+		Format:    "epub",
+		Source:    source.FileType,
+		Status:    models.ImportPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	_, err = db.DB.Exec(
+		`INSERT INTO book_conversions (book_id, format, source_type, source_path, source_modified, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (book_id, format) DO UPDATE SET source_type = excluded.source_type, source_path = excluded.source_path,
+			source_modified = excluded.source_modified, file_path = '', status = excluded.status, error = '',
+			created_at = excluded.created_at, updated_at = excluded.updated_at`,
+		job.BookID, job.Format, job.Source, source.FilePath, modified, job.Status, job.CreatedAt, job.UpdatedAt,
+	)
+	if err != nil {
+		return models.BookConversion{}, err
+	}
+
+	go runConversion(bookID, source)
+	return job, nil
+}
+
+func runConversion(bookID string, source bookFormat) {
+	conversionSlots <- struct{}{}
+	defer func() { <-conversionSlots }()
+	setConversionStatus(bookID, models.ImportRunning, "")
+
+	var converted *convertedBook
+	var err error
+	switch source.FileType {
+	case "fb2":
+		converted, err = convertFB2(source.FilePath)
+	default:
+		converted, err = convertMOBI(source.FilePath)
+	}
+
+	// The library's metadata stands in for what the file lacks
+	var title, author, description string
+	if err == nil {
+		err = db.DB.QueryRow("SELECT title, author, description FROM books WHERE id = ?", bookID).Scan(&title, &author, &description)
+	}
+	if err == nil {
+		converted.Title = firstOf(converted.Title, title)
+		converted.Author = firstOf(converted.Author, author)
+		converted.Description = firstOf(converted.Description, description)
+		err = os.MkdirAll(bookStorageDir(bookID), 0755)
+	}
+	filePath := convertedEPUBPath(bookID)
+	if err == nil {
+		err = writeEPUB(filePath, bookID, converted)
+	}
+	if err != nil {
+		log.Printf("Converting book %s from %s failed: %v", bookID, source.FileType, err)
+		setConversionStatus(bookID, models.ImportFailed, "Failed to convert the "+formatNames[source.FileType]+" file: "+err.Error())
+		return
+	}
+
+	_, err = db.DB.Exec(
+		"UPDATE book_conversions SET status = ?, error = '', file_path = ?, updated_at = ? WHERE book_id = ? AND format = 'epub'",
+		models.ImportDone, filePath, time.Now(), bookID,
+	)
+	if err != nil {
+		log.Printf("Warning: Failed to update the conversion of book %s: %v", bookID, err)
+	}
+	// The book may have been deleted while it was being converted
+	var exists string
+	if db.DB.QueryRow("SELECT id FROM books WHERE id = ?", bookID).Scan(&exists) == sql.ErrNoRows {
+		os.Remove(filePath)
+	}
+}
+
+// ForgetInterruptedConversions drops conversions cut off by a restart, so
+// that they start over the next time the EPUB is asked for.
+func ForgetInterruptedConversions() {
+	_, err := db.DB.Exec("DELETE FROM book_conversions WHERE status IN (?, ?)", models.ImportPending, models.ImportRunning)
+	if err != nil {
+		log.Printf("Warning: Failed to clear interrupted conversions: %v", err)
+	}
+}
+
+// loadConvertibleBook checks the user can see a book and that an EPUB can be
+// made of it, writing an error response if not.
+func loadConvertibleBook(w http.ResponseWriter, r *http.Request, bookID string) bool {
+	var exists string
+	if err := db.DB.QueryRow("SELECT b.id FROM books b"+bookAccess+" WHERE b.id = ?", currentUserID(r), bookID).Scan(&exists); err != nil {
+		http.Error(w, "Book not found", http.StatusNotFound)
+		return false
+	}
+	formats, err := loadBookFormats(bookID)
+	if err != nil {
+		http.Error(w, "Failed to fetch book", http.StatusInternalServerError)
+		return false
+	}
+	if slices.ContainsFunc(formats, func(f bookFormat) bool { return f.FileType == "epub" }) {
+		http.Error(w, "The book is already available as EPUB", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// writeConversion reports a conversion: 200 once the EPUB is ready, 202 while
+// it is being made.
+func writeConversion(w http.ResponseWriter, job models.BookConversion) {
+	w.Header().Set("Content-Type", "application/json")
+	if job.Status == models.ImportPending || job.Status == models.ImportRunning {
+		w.Header().Set("Location", "/api/books/"+job.BookID+"/convert")
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(job)
+}
+
+// ConvertBook makes an EPUB of an FB2, MOBI or AZW3 book in the background,
+// or tries again after a failed conversion. Poll GetBookConversion for
+// progress; the EPUB is served by ServeBookFile with ?format=epub.
+func ConvertBook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bookID := vars["id"]
+	if !loadConvertibleBook(w, r, bookID) {
+		return
+	}
+
+	job, err := startConversion(bookID, true)
+	if errors.Is(err, errNotConvertible) {
+		http.Error(w, "Only FB2, MOBI and AZW3 books can be converted to EPUB", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to start converting book %s: %v", bookID, err)
+		http.Error(w, "Failed to start conversion", http.StatusInternalServerError)
+		return
+	}
+	writeConversion(w, job)
+}
+
+// GetBookConversion reports how a book's conversion to EPUB is going.
+func GetBookConversion(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bookID := vars["id"]
+	var exists string
+	if err := db.DB.QueryRow("SELECT b.id FROM books b"+bookAccess+" WHERE b.id = ?", currentUserID(r), bookID).Scan(&exists); err != nil {
+		http.Error(w, "Book not found", http.StatusNotFound)
+		return
+	}
+
+	record, err := loadConversion(bookID)
+	if err != nil {
+		http.Error(w, "The book has not been converted", http.StatusNotFound)
+		return
+	}
+	writeConversion(w, record.BookConversion)
+}
+
+// serveConvertedEPUB serves the EPUB made from a book that has none of its
+// own, starting the conversion if there is no current one.
+func serveConvertedEPUB(w http.ResponseWriter, r *http.Request, bookID string) {
+	job, err := startConversion(bookID, false)
+	if errors.Is(err, errNotConvertible) {
+		http.Error(w, "The book is not available as epub", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to start converting book %s: %v", bookID, err)
+		http.Error(w, "Failed to start conversion", http.StatusInternalServerError)
+		return
+	}
+
+	switch job.Status {
+	case models.ImportDone:
+		w.Header().Set("Content-Type", "application/epub+zip")
+		http.ServeFile(w, r, convertedEPUBPath(bookID))
+	case models.ImportFailed:
+		http.Error(w, job.Error, http.StatusUnprocessableEntity)
+	default:
+		writeConversion(w, job)
+	}
+}
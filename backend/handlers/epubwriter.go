@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"archive/zip"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// convertedBook is a book read from another format, ready to be written out
+// as an EPUB. Chapter bodies are XHTML; images are referenced from them as
+// images/<name>.
+type convertedBook struct {
+	Title       string
+	Author      string
+	Language    string
+	Description string
+	Publisher   string
+	Chapters    []convertedChapter
+	Images      []convertedImage
+	// Cover is the name of the image used as the cover, if any
+	Cover string
+}
+
+type convertedChapter struct {
+	Title string
+	Body  string
+}
+
+type convertedImage struct {
+	Name      string
+	MediaType string
+	Data      []byte
+}
+
+// chapterFile is the name of a converted book's nth chapter.
+func chapterFile(n int) string {
+	return fmt.Sprintf("chapter%03d.xhtml", n+1)
+}
+
+// imageMediaExtensions are the extensions given to images by media type.
+var imageMediaExtensions = map[string]string{
+	"image/jpeg":    ".jpg",
+	"image/png":     ".png",
+	"image/gif":     ".gif",
+	"image/svg+xml": ".svg",
+	"image/webp":    ".webp",
+}
+
+const convertedStylesheet = `body { margin: 0 4%; line-height: 1.5; }
+h1, h2, h3, h4, h5, h6 { text-align: center; margin: 1.5em 0 1em; }
+p { margin: 0; text-indent: 1.5em; }
+p.subtitle, p.text-author, p.date { text-align: center; text-indent: 0; font-weight: bold; margin: 0.5em 0; }
+p.text-author { text-align: right; font-style: italic; font-weight: normal; }
+p.verse { text-indent: 0; margin-left: 2em; }
+p.empty-line { text-indent: 0; }
+blockquote { margin: 1em 2em; }
+blockquote.epigraph { margin-left: 40%; font-style: italic; }
+div.stanza { margin: 1em 0; }
+div.image, div.cover { text-align: center; text-indent: 0; margin: 1em 0; }
+img { max-width: 100%; }
+div.cover img { max-height: 95vh; }
+`
+
+// xmlText escapes text for XHTML, leaving out the control characters XML
+// does not allow.
+func xmlText(s string) string {
+	return html.EscapeString(strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+			return -1
+		}
+		return r
+	}, s))
+}
+
+// xhtmlPage wraps a body in an XHTML document.
+func xhtmlPage(title, language, body string) string {
+	return `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="` + html.EscapeString(language) + `" xml:lang="` + html.EscapeString(language) + `">
+<head>
+<meta charset="utf-8"/>
+<title>` + html.EscapeString(title) + `</title>
+<link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+` + body + `
+</body>
+</html>
+`
+}
+
+// writeEPUB writes a converted book to path as an EPUB 3 with an EPUB 2 table
+// of contents for older readers. The file is written beside path first and
+// renamed into place.
+func writeEPUB(path, bookID string, book *convertedBook) error {
+	if len(book.Chapters) == 0 {
+		return fmt.Errorf("the book has no text")
+	}
+	language := book.Language
+	if language == "" {
+		language = "und"
+	}
+	title := book.Title
+	if title == "" {
+		title = "Untitled"
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), ".convert-*.epub")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	archive := zip.NewWriter(temp)
+
+	// The mimetype comes first and uncompressed, so that the file can be
+	// recognised by its first bytes
+	now := time.Now()
+	mimetype, err := archive.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store, Modified: now})
+	if err != nil {
+		temp.Close()
+		return err
+	}
+	mimetype.Write([]byte("application/epub+zip"))
+
+	files := map[string][]byte{
+		"META-INF/container.xml": []byte(`<?xml version="1.0" encoding="utf-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+<rootfiles>
+<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+</rootfiles>
+</container>
+`),
+		"OEBPS/style.css": []byte(convertedStylesheet),
+	}
+	order := []string{"META-INF/container.xml", "OEBPS/content.opf", "OEBPS/nav.xhtml", "OEBPS/toc.ncx", "OEBPS/style.css"}
+	add := func(name string, data []byte) {
+		files[name] = data
+		order = append(order, name)
+	}
+
+	var manifest, spine, navItems, ncxPoints strings.Builder
+	manifest.WriteString(`<item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+<item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+<item id="style" href="style.css" media-type="text/css"/>
+`)
+	if book.Cover != "" {
+		add("OEBPS/cover.xhtml", []byte(xhtmlPage(title, language,
+			`<div class="cover"><img src="images/`+html.EscapeString(book.Cover)+`" alt="`+html.EscapeString(title)+`"/></div>`)))
+		manifest.WriteString(`<item id="cover" href="cover.xhtml" media-type="application/xhtml+xml"/>` + "\n")
+		spine.WriteString(`<itemref idref="cover"/>` + "\n")
+	}
+
+	point := 0
+	for i, chapter := range book.Chapters {
+		file := chapterFile(i)
+		id := strings.TrimSuffix(file, ".xhtml")
+		add("OEBPS/"+file, []byte(xhtmlPage(firstOf(chapter.Title, title), language, chapter.Body)))
+		fmt.Fprintf(&manifest, `<item id="%s" href="%s" media-type="application/xhtml+xml"/>`+"\n", id, file)
+		fmt.Fprintf(&spine, `<itemref idref="%s"/>`+"\n", id)
+
+		label := chapter.Title
+		if label == "" {
+			if i > 0 || len(book.Chapters) > 1 {
+				continue
+			}
+			label = title
+		}
+		point++
+		fmt.Fprintf(&navItems, `<li><a href="%s">%s</a></li>`+"\n", file, html.EscapeString(label))
+		fmt.Fprintf(&ncxPoints, `<navPoint id="point%d" playOrder="%d"><navLabel><text>%s</text></navLabel><content src="%s"/></navPoint>`+"\n",
+			point, point, html.EscapeString(label), file)
+	}
+	if point == 0 {
+		// A table of contents needs at least one entry
+		navItems.WriteString(`<li><a href="` + chapterFile(0) + `">` + html.EscapeString(title) + `</a></li>` + "\n")
+		ncxPoints.WriteString(`<navPoint id="point1" playOrder="1"><navLabel><text>` + html.EscapeString(title) +
+			`</text></navLabel><content src="` + chapterFile(0) + `"/></navPoint>` + "\n")
+	}
+
+	for i, image := range book.Images {
+		properties := ""
+		if image.Name == book.Cover {
+			properties = ` properties="cover-image"`
+		}
+		fmt.Fprintf(&manifest, `<item id="image%d" href="images/%s" media-type="%s"%s/>`+"\n",
+			i+1, html.EscapeString(image.Name), image.MediaType, properties)
+		add("OEBPS/images/"+image.Name, image.Data)
+	}
+
+	var metadata strings.Builder
+	fmt.Fprintf(&metadata, "<dc:identifier id=\"uid\">urn:uuid:%s</dc:identifier>\n", html.EscapeString(bookID))
+	fmt.Fprintf(&metadata, "<dc:title>%s</dc:title>\n", html.EscapeString(title))
+	fmt.Fprintf(&metadata, "<dc:language>%s</dc:language>\n", html.EscapeString(language))
+	if book.Author != "" {
+		fmt.Fprintf(&metadata, "<dc:creator>%s</dc:creator>\n", html.EscapeString(book.Author))
+	}
+	if book.Publisher != "" {
+		fmt.Fprintf(&metadata, "<dc:publisher>%s</dc:publisher>\n", html.EscapeString(book.Publisher))
+	}
+	if book.Description != "" {
+		fmt.Fprintf(&metadata, "<dc:description>%s</dc:description>\n", html.EscapeString(book.Description))
+	}
+	fmt.Fprintf(&metadata, "<meta property=\"dcterms:modified\">%s</meta>\n", now.UTC().Format("2006-01-02T15:04:05Z"))
+	for i, image := range book.Images {
+		if image.Name == book.Cover {
+			fmt.Fprintf(&metadata, "<meta name=\"cover\" content=\"image%d\"/>\n", i+1)
+		}
+	}
+
+	files["OEBPS/content.opf"] = []byte(`<?xml version="1.0" encoding="utf-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+` + metadata.String() + `</metadata>
+<manifest>
+` + manifest.String() + `</manifest>
+<spine toc="ncx">
+` + spine.String() + `</spine>
+</package>
+`)
+	files["OEBPS/nav.xhtml"] = []byte(xhtmlPage(title, language,
+		`<nav epub:type="toc" id="toc">
+<h1>`+html.EscapeString(title)+`</h1>
+<ol>
+`+navItems.String()+`</ol>
+</nav>`))
+	files["OEBPS/toc.ncx"] = []byte(`<?xml version="1.0" encoding="utf-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+<head><meta name="dtb:uid" content="urn:uuid:` + html.EscapeString(bookID) + `"/></head>
+<docTitle><text>` + html.EscapeString(title) + `</text></docTitle>
+<navMap>
+` + ncxPoints.String() + `</navMap>
+</ncx>
+`)
+
+	for _, name := range order {
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+		if err == nil {
+			_, err = file.Write(files[name])
+		}
+		if err != nil {
+			temp.Close()
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"bookland/models"
+	"bytes"
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"strings"
+)
+
+// fakeProvider answers from a fixed list of candidates and draws covers
+// itself, so lookups can be tried and tested without network access.
+type fakeProvider struct {
+	candidates []models.MetadataCandidate
+}
+
+func (p *fakeProvider) Name() string { return "fake" }
+
+// newFakeProvider serves the candidates in path, a JSON list, or a few
+// built-in ones when path is empty.
+func newFakeProvider(path string) (*fakeProvider, error) {
+	provider := &fakeProvider{candidates: fakeCandidates()}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		provider.candidates = nil
+		if err := json.Unmarshal(data, &provider.candidates); err != nil {
+			return nil, err
+		}
+	}
+	for i := range provider.candidates {
+		candidate := &provider.candidates[i]
+		candidate.Provider = provider.Name()
+		if candidate.CoverURL == "" {
+			candidate.CoverURL = "fake://covers/" + candidate.ID
+		}
+	}
+	return provider, nil
+}
+
+func fakeCandidates() []models.MetadataCandidate {
+	first := 1.0
+	return []models.MetadataCandidate{
+		{
+			ID:            "pride-and-prejudice",
+			Title:         "Pride and Prejudice",
+			Author:        "Jane Austen",
+			Description:   "Elizabeth Bennet and Mr Darcy misjudge each other at length.",
+			Publisher:     "T. Egerton",
+			PublishedDate: "1813",
+			Tags:          []string{"Fiction", "Classics", "Romance"},
+			Identifiers:   map[string]string{"isbn": "9780141439518"},
+		},
+		{
+			ID:            "frankenstein",
+			Title:         "Frankenstein; or, The Modern Prometheus",
+			Author:        "Mary Shelley",
+			Description:   "A young scientist creates a living being and abandons it.",
+			Publisher:     "Lackington, Hughes, Harding, Mavor & Jones",
+			PublishedDate: "1818",
+			Tags:          []string{"Fiction", "Classics", "Horror"},
+			Identifiers:   map[string]string{"isbn": "9780141439471"},
+		},
+		{
+			ID:            "the-fellowship-of-the-ring",
+			Title:         "The Fellowship of the Ring",
+			Author:        "J. R. R. Tolkien",
+			Series:        "The Lord of the Rings",
+			SeriesIndex:   &first,
+			Description:   "Frodo sets out from the Shire with the One Ring.",
+			Publisher:     "George Allen & Unwin",
+			PublishedDate: "1954",
+			Tags:          []string{"Fiction", "Fantasy"},
+			Identifiers:   map[string]string{"isbn": "9780261102354"},
+		},
+	}
+}
+
+func (p *fakeProvider) Search(ctx context.Context, query models.MetadataQuery) ([]models.MetadataCandidate, error) {
+	isbn := normalizeISBN(query.ISBN)
+	title := strings.ToLower(query.Title)
+	author := strings.ToLower(query.Author)
+
+	var candidates []models.MetadataCandidate
+	for _, candidate := range p.candidates {
+		var matches bool
+		if isbn != "" {
+			matches = normalizeISBN(candidate.Identifiers["isbn"]) == isbn
+		} else {
+			matches = (title == "" || strings.Contains(strings.ToLower(candidate.Title), title)) &&
+				(author == "" || strings.Contains(strings.ToLower(candidate.Author), author))
+		}
+		if matches {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates, nil
+}
+
+func (p *fakeProvider) Details(ctx context.Context, id string) (*models.MetadataCandidate, error) {
+	for _, candidate := range p.candidates {
+		if candidate.ID == id {
+			return &candidate, nil
+		}
+	}
+	return nil, errCandidateNotFound
+}
+
+// Cover draws a plain cover in a colour derived from the candidate's ID, or
+// fetches the candidate's cover URL if it has a real one.
+func (p *fakeProvider) Cover(ctx context.Context, candidate *models.MetadataCandidate) ([]byte, error) {
+	if !strings.HasPrefix(candidate.CoverURL, "fake://") {
+		return fetchCover(ctx, candidate.CoverURL)
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(candidate.ID))
+	sum := hash.Sum32()
+	fill := color.RGBA{R: uint8(sum), G: uint8(sum >> 8), B: uint8(sum >> 16), A: 255}
+
+	cover := image.NewRGBA(image.Rect(0, 0, 200, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 200; x++ {
+			cover.Set(x, y, fill)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, cover); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
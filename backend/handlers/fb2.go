@@ -0,0 +1,445 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// fb2SplitDepth is how deep sections are nested before they stop being
+// chapters of their own and are kept inside the chapter they belong to.
+const fb2SplitDepth = 2
+
+// maxFB2Depth is how deeply elements may be nested. Real books stay well
+// within it; the tree is walked recursively, so a deeper one could exhaust
+// the stack.
+const maxFB2Depth = 256
+
+var errFB2TooDeep = fmt.Errorf("the FB2 document nests elements more than %d deep", maxFB2Depth)
+
+// fb2Node is an element of an FB2 document, or a run of text when Name is
+// empty. Attributes are keyed by local name, so l:href and xlink:href are
+// both href.
+type fb2Node struct {
+	Name     string
+	Attrs    map[string]string
+	Text     string
+	Children []*fb2Node
+}
+
+func (n *fb2Node) child(name string) *fb2Node {
+	if n == nil {
+		return nil
+	}
+	for _, child := range n.Children {
+		if child.Name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+func (n *fb2Node) children(name string) []*fb2Node {
+	if n == nil {
+		return nil
+	}
+	var found []*fb2Node
+	for _, child := range n.Children {
+		if child.Name == name {
+			found = append(found, child)
+		}
+	}
+	return found
+}
+
+// text is the text inside a node with runs of whitespace collapsed.
+func (n *fb2Node) text() string {
+	if n == nil {
+		return ""
+	}
+	var text strings.Builder
+	var walk func(*fb2Node)
+	walk = func(node *fb2Node) {
+		if node.Name == "" {
+			text.WriteString(node.Text)
+			return
+		}
+		for _, child := range node.Children {
+			walk(child)
+			if child.Name == "p" || child.Name == "v" {
+				text.WriteString(" ")
+			}
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(text.String()), " ")
+}
+
+// parseFB2 reads an FB2 document into a tree, returning its FictionBook
+// element. Documents nested more than maxFB2Depth deep are rejected.
+func parseFB2(r io.Reader) (*fb2Node, error) {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	decoder.CharsetReader = xmlCharsetReader
+
+	document := &fb2Node{Name: "#document"}
+	stack := []*fb2Node{document}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Keep what was read of a truncated or broken book
+			if len(document.Children) > 0 {
+				break
+			}
+			return nil, err
+		}
+		parent := stack[len(stack)-1]
+		switch t := token.(type) {
+		case xml.StartElement:
+			if len(stack) > maxFB2Depth {
+				return nil, errFB2TooDeep
+			}
+			node := &fb2Node{Name: t.Name.Local, Attrs: map[string]string{}}
+			for _, attr := range t.Attr {
+				node.Attrs[attr.Name.Local] = attr.Value
+			}
+			parent.Children = append(parent.Children, node)
+			stack = append(stack, node)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			parent.Children = append(parent.Children, &fb2Node{Text: string(t)})
+		}
+	}
+
+	root := document.child("FictionBook")
+	if root == nil {
+		return nil, fmt.Errorf("not an FB2 document")
+	}
+	return root, nil
+}
+
+var unsafeResourceName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// fb2Chunk is the part of a body that becomes one chapter.
+type fb2Chunk struct {
+	title string
+	depth int
+	// section is the section the chunk is made from, if any
+	section *fb2Node
+	nodes   []*fb2Node
+}
+
+// fb2Renderer turns FB2 elements into XHTML.
+type fb2Renderer struct {
+	// images maps binary ids to the names of the images made from them
+	images map[string]string
+	// files maps element ids to the chapter they end up in
+	files map[string]string
+}
+
+// convertFB2 reads an FB2 book.
+func convertFB2(path string) (*convertedBook, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	root, err := parseFB2(file)
+	if err != nil {
+		return nil, err
+	}
+
+	description := root.child("description")
+	info := description.child("title-info")
+	book := &convertedBook{
+		Title:     info.child("book-title").text(),
+		Language:  info.child("lang").text(),
+		Publisher: description.child("publish-info").child("publisher").text(),
+	}
+	var authors []string
+	for _, author := range info.children("author") {
+		name := strings.Join(strings.Fields(strings.Join([]string{
+			author.child("first-name").text(), author.child("middle-name").text(), author.child("last-name").text(),
+		}, " ")), " ")
+		if name = firstOf(name, author.child("nickname").text()); name != "" {
+			authors = append(authors, name)
+		}
+	}
+	book.Author = strings.Join(authors, " & ")
+	if annotation := info.child("annotation"); annotation != nil {
+		var paragraphs []string
+		for _, child := range annotation.Children {
+			if text := child.text(); text != "" {
+				paragraphs = append(paragraphs, text)
+			}
+		}
+		book.Description = strings.Join(paragraphs, "\n\n")
+	}
+
+	renderer := &fb2Renderer{images: map[string]string{}, files: map[string]string{}}
+	used := map[string]bool{}
+	for _, binary := range root.children("binary") {
+		id := binary.Attrs["id"]
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(binary.text()), ""))
+		if id == "" || err != nil || len(data) == 0 {
+			continue
+		}
+		mediaType := strings.ToLower(binary.Attrs["content-type"])
+		if mediaType == "image/jpg" {
+			mediaType = "image/jpeg"
+		}
+		if imageMediaExtensions[mediaType] == "" {
+			mediaType = http.DetectContentType(data)
+		}
+		extension := imageMediaExtensions[mediaType]
+		if extension == "" {
+			continue
+		}
+
+		name := strings.Trim(unsafeResourceName.ReplaceAllString(id, "_"), "._")
+		if strings.ToLower(filepath.Ext(name)) != extension && !(extension == ".jpg" && strings.EqualFold(filepath.Ext(name), ".jpeg")) {
+			name += extension
+		}
+		for base, n := name, 2; used[strings.ToLower(name)] || name == extension; n++ {
+			name = fmt.Sprintf("%d_%s", n, base)
+		}
+		used[strings.ToLower(name)] = true
+		renderer.images[id] = name
+		book.Images = append(book.Images, convertedImage{Name: name, MediaType: mediaType, Data: data})
+	}
+	if cover := info.child("coverpage").child("image"); cover != nil {
+		book.Cover = renderer.images[strings.TrimPrefix(cover.Attrs["href"], "#")]
+	}
+
+	// The first body is the book; the others hold notes and comments
+	var chunks []fb2Chunk
+	for i, body := range root.children("body") {
+		if i == 0 {
+			planFB2Chunks(body, 0, &chunks)
+			continue
+		}
+		title := body.child("title").text()
+		if title == "" {
+			title = "Notes"
+			if name := body.Attrs["name"]; name != "" && name != "notes" {
+				title = strings.ToUpper(name[:1]) + name[1:]
+			}
+		}
+		chunks = append(chunks, fb2Chunk{title: title, depth: 1, nodes: body.Children})
+	}
+
+	for i, chunk := range chunks {
+		if chunk.section != nil {
+			renderer.collectIDs(chunk.section, chapterFile(i), false)
+		}
+		for _, node := range chunk.nodes {
+			renderer.collectIDs(node, chapterFile(i), true)
+		}
+	}
+	for _, chunk := range chunks {
+		var body strings.Builder
+		body.WriteString(`<div class="section"`)
+		if chunk.section != nil && chunk.section.Attrs["id"] != "" {
+			body.WriteString(` id="` + html.EscapeString(chunk.section.Attrs["id"]) + `"`)
+		}
+		body.WriteString(">")
+		for _, node := range chunk.nodes {
+			renderer.render(&body, node, chunk.depth)
+		}
+		body.WriteString("</div>")
+		book.Chapters = append(book.Chapters, convertedChapter{Title: chunk.title, Body: body.String()})
+	}
+	return book, nil
+}
+
+// planFB2Chunks splits a body or section into chapters: one for its own
+// content and one for each section in it, down to fb2SplitDepth.
+func planFB2Chunks(section *fb2Node, depth int, chunks *[]fb2Chunk) {
+	current := fb2Chunk{depth: depth, section: section}
+	if section.Name == "section" {
+		current.title = section.child("title").text()
+	}
+	hasContent := func(chunk fb2Chunk) bool {
+		for _, node := range chunk.nodes {
+			if node.Name != "" || strings.TrimSpace(node.Text) != "" {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, child := range section.Children {
+		if child.Name == "section" && depth < fb2SplitDepth {
+			if hasContent(current) {
+				*chunks = append(*chunks, current)
+			}
+			planFB2Chunks(child, depth+1, chunks)
+			current = fb2Chunk{depth: depth}
+			continue
+		}
+		current.nodes = append(current.nodes, child)
+	}
+	if hasContent(current) {
+		*chunks = append(*chunks, current)
+	}
+}
+
+// collectIDs records the chapter file each element with an id ends up in,
+// not descending into sections that become chapters of their own.
+func (fr *fb2Renderer) collectIDs(node *fb2Node, file string, descend bool) {
+	if id := node.Attrs["id"]; id != "" {
+		if _, seen := fr.files[id]; !seen {
+			fr.files[id] = file
+		}
+	}
+	if !descend {
+		return
+	}
+	for _, child := range node.Children {
+		fr.collectIDs(child, file, true)
+	}
+}
+
+// fb2BlockTags maps FB2 block elements to an XHTML element and class.
+var fb2BlockTags = map[string][2]string{
+	"section":     {"div", "section"},
+	"epigraph":    {"blockquote", "epigraph"},
+	"cite":        {"blockquote", "cite"},
+	"poem":        {"div", "poem"},
+	"stanza":      {"div", "stanza"},
+	"annotation":  {"div", "annotation"},
+	"p":           {"p", ""},
+	"v":           {"p", "verse"},
+	"subtitle":    {"p", "subtitle"},
+	"text-author": {"p", "text-author"},
+	"date":        {"p", "date"},
+	"table":       {"table", ""},
+	"tr":          {"tr", ""},
+	"th":          {"th", ""},
+	"td":          {"td", ""},
+}
+
+var fb2InlineTags = map[string]string{
+	"emphasis":      "em",
+	"strong":        "strong",
+	"strikethrough": "del",
+	"sub":           "sub",
+	"sup":           "sup",
+	"code":          "code",
+	"style":         "span",
+}
+
+func (fr *fb2Renderer) open(b *strings.Builder, tag, class string, node *fb2Node) {
+	b.WriteString("<" + tag)
+	if class != "" {
+		b.WriteString(` class="` + class + `"`)
+	}
+	if id := node.Attrs["id"]; id != "" {
+		b.WriteString(` id="` + html.EscapeString(id) + `"`)
+	}
+	for _, name := range []string{"colspan", "rowspan", "align"} {
+		if value := node.Attrs[name]; value != "" && (tag == "td" || tag == "th") {
+			b.WriteString(" " + name + `="` + html.EscapeString(value) + `"`)
+		}
+	}
+	b.WriteString(">")
+}
+
+func (fr *fb2Renderer) renderChildren(b *strings.Builder, node *fb2Node, depth int) {
+	for _, child := range node.Children {
+		fr.render(b, child, depth)
+	}
+}
+
+// render writes a node as XHTML. depth is how deep in sections it is, which
+// sets the level of its headings.
+func (fr *fb2Renderer) render(b *strings.Builder, node *fb2Node, depth int) {
+	if node.Name == "" {
+		b.WriteString(xmlText(node.Text))
+		return
+	}
+
+	switch node.Name {
+	case "title":
+		level := min(depth+1, 6)
+		fmt.Fprintf(b, `<h%d class="title">`, level)
+		first := true
+		for _, child := range node.Children {
+			if child.Name != "p" {
+				continue
+			}
+			if !first {
+				b.WriteString("<br/>")
+			}
+			first = false
+			fr.renderChildren(b, child, depth)
+		}
+		fmt.Fprintf(b, "</h%d>", level)
+	case "empty-line":
+		b.WriteString(`<p class="empty-line">` + " " + `</p>`)
+	case "image":
+		name := fr.images[strings.TrimPrefix(node.Attrs["href"], "#")]
+		if name == "" {
+			return
+		}
+		img := `<img src="images/` + html.EscapeString(name) + `" alt="` + html.EscapeString(node.Attrs["alt"]) + `"/>`
+		if node.Attrs["type"] == "inline" {
+			b.WriteString(img)
+			return
+		}
+		b.WriteString(`<div class="image">` + img + `</div>`)
+	case "a":
+		href := node.Attrs["href"]
+		target := ""
+		if id, internal := strings.CutPrefix(href, "#"); internal {
+			if file := fr.files[id]; file != "" {
+				target = file + "#" + id
+			}
+		} else if strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://") || strings.HasPrefix(href, "mailto:") {
+			target = href
+		}
+		if target == "" {
+			fr.renderChildren(b, node, depth)
+			return
+		}
+		b.WriteString(`<a href="` + html.EscapeString(target) + `"`)
+		if node.Attrs["type"] == "note" {
+			b.WriteString(` class="note" epub:type="noteref"`)
+		}
+		b.WriteString(">")
+		fr.renderChildren(b, node, depth)
+		b.WriteString("</a>")
+	case "section":
+		fr.open(b, "div", "section", node)
+		fr.renderChildren(b, node, depth+1)
+		b.WriteString("</div>")
+	default:
+		if block, ok := fb2BlockTags[node.Name]; ok {
+			fr.open(b, block[0], block[1], node)
+			fr.renderChildren(b, node, depth)
+			b.WriteString("</" + block[0] + ">")
+			return
+		}
+		if tag, ok := fb2InlineTags[node.Name]; ok {
+			b.WriteString("<" + tag + ">")
+			fr.renderChildren(b, node, depth)
+			b.WriteString("</" + tag + ">")
+			return
+		}
+		fr.renderChildren(b, node, depth)
+	}
+}
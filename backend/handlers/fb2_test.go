@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// nestedFB2 is an FB2 book whose deepest element, the paragraph in the
+// innermost section's title, is nested depth elements deep, counting
+// FictionBook.
+func nestedFB2(depth int) string {
+	sections := depth - 4 // FictionBook, body, title and its paragraph
+	return `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+<description><title-info><book-title>Nested</book-title><lang>en</lang></title-info></description>
+<body>` + strings.Repeat(`<section><title><p>Part</p></title>`, sections) + `<p>Deep.</p>` +
+		strings.Repeat(`</section>`, sections) + `</body>
+</FictionBook>`
+}
+
+func TestParseFB2Depth(t *testing.T) {
+	if _, err := parseFB2(strings.NewReader(nestedFB2(maxFB2Depth))); err != nil {
+		t.Errorf("nesting %d deep: %v", maxFB2Depth, err)
+	}
+	if _, err := parseFB2(strings.NewReader(nestedFB2(maxFB2Depth + 1))); !errors.Is(err, errFB2TooDeep) {
+		t.Errorf("nesting %d deep: error %v, want %v", maxFB2Depth+1, err, errFB2TooDeep)
+	}
+
+	// Left unchecked, this would overflow the stack when converted
+	hostile := `<FictionBook><body>` + strings.Repeat(`<section>`, 1_000_000)
+	if _, err := parseFB2(strings.NewReader(hostile)); !errors.Is(err, errFB2TooDeep) {
+		t.Errorf("nesting a million deep: error %v, want %v", err, errFB2TooDeep)
+	}
+}
+
+func TestConvertDeepFB2(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested.fb2")
+	if err := os.WriteFile(path, []byte(nestedFB2(maxFB2Depth)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	book, err := convertFB2(path)
+	if err != nil {
+		t.Fatalf("convertFB2: %v", err)
+	}
+	if book.Title != "Nested" || len(book.Chapters) == 0 {
+		t.Fatalf("converted %q with %d chapters", book.Title, len(book.Chapters))
+	}
+	last := book.Chapters[len(book.Chapters)-1]
+	if !strings.Contains(last.Body, "Deep.") {
+		t.Errorf("the deepest paragraph is missing from the last chapter")
+	}
+}
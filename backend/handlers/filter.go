@@ -0,0 +1,418 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// BookFacts is the view of a book that shelf filter expressions are evaluated against.
+type BookFacts struct {
+	Title       string
+	Author      string
+	ISBN        string
+	FileType    string
+	FileSize    int64
+	AddedAt     time.Time
+	Progress    float64 // percent, 0-100
+	Status      string
+	Rating      int
+	Favorite    bool
+	Annotations int
+	Notes       int
+}
+
+// Filter is a compiled shelf query such as:
+//
+//	type = pdf and progress < 100 and added >= this_year
+//	highlights > 10 or (author ~ "tolkien" and not progress = 0)
+//
+// Fields: title, author, isbn, type, status, size, added, progress, rating,
+// favorite, highlights (alias annotations), notes. Operators: = != < <= > >=
+// and ~ (case-insensitive contains, strings only). Dates are YYYY-MM-DD or one
+// of today, this_week, this_month, this_year, each standing for the whole day
+// or period: added = today matches any time today, added > 2024-05-01 starts
+// the next day. Booleans are true or false.
+type Filter struct {
+	root filterNode
+}
+
+// ParseFilter compiles a filter expression, reporting the first syntax or type error.
+func ParseFilter(expr string) (*Filter, error) {
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty query")
+	}
+
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return &Filter{root: root}, nil
+}
+
+// Match reports whether the book satisfies the filter.
+func (f *Filter) Match(b *BookFacts) bool {
+	return f.root.eval(b, time.Now())
+}
+
+type filterNode interface {
+	eval(b *BookFacts, now time.Time) bool
+}
+
+type andNode struct{ left, right filterNode }
+type orNode struct{ left, right filterNode }
+type notNode struct{ inner filterNode }
+
+func (n andNode) eval(b *BookFacts, now time.Time) bool {
+	return n.left.eval(b, now) && n.right.eval(b, now)
+}
+
+func (n orNode) eval(b *BookFacts, now time.Time) bool {
+	return n.left.eval(b, now) || n.right.eval(b, now)
+}
+
+func (n notNode) eval(b *BookFacts, now time.Time) bool {
+	return !n.inner.eval(b, now)
+}
+
+type fieldKind int
+
+const (
+	kindString fieldKind = iota
+	kindNumber
+	kindTime
+	kindBool
+)
+
+type filterField struct {
+	kind   fieldKind
+	str    func(b *BookFacts) string
+	number func(b *BookFacts) float64
+	time   func(b *BookFacts) time.Time
+	bool   func(b *BookFacts) bool
+}
+
+var filterFields = map[string]filterField{
+	"title":       {kind: kindString, str: func(b *BookFacts) string { return b.Title }},
+	"author":      {kind: kindString, str: func(b *BookFacts) string { return b.Author }},
+	"isbn":        {kind: kindString, str: func(b *BookFacts) string { return b.ISBN }},
+	"type":        {kind: kindString, str: func(b *BookFacts) string { return b.FileType }},
+	"status":      {kind: kindString, str: func(b *BookFacts) string { return b.Status }},
+	"size":        {kind: kindNumber, number: func(b *BookFacts) float64 { return float64(b.FileSize) }},
+	"progress":    {kind: kindNumber, number: func(b *BookFacts) float64 { return b.Progress }},
+	"rating":      {kind: kindNumber, number: func(b *BookFacts) float64 { return float64(b.Rating) }},
+	"favorite":    {kind: kindBool, bool: func(b *BookFacts) bool { return b.Favorite }},
+	"highlights":  {kind: kindNumber, number: func(b *BookFacts) float64 { return float64(b.Annotations) }},
+	"annotations": {kind: kindNumber, number: func(b *BookFacts) float64 { return float64(b.Annotations) }},
+	"notes":       {kind: kindNumber, number: func(b *BookFacts) float64 { return float64(b.Notes) }},
+	"added":       {kind: kindTime, time: func(b *BookFacts) time.Time { return b.AddedAt }},
+}
+
+type compareNode struct {
+	field  filterField
+	op     string
+	str    string
+	number float64
+	truth  bool
+	// when resolves the right-hand side of a time comparison to the period
+	// from start up to end; relative keywords are resolved at evaluation
+	// time so "this_year" stays current.
+	when func(now time.Time) (start, end time.Time)
+}
+
+func (n compareNode) eval(b *BookFacts, now time.Time) bool {
+	switch n.field.kind {
+	case kindString:
+		left := strings.ToLower(n.field.str(b))
+		switch n.op {
+		case "=":
+			return left == n.str
+		case "!=":
+			return left != n.str
+		case "~":
+			return strings.Contains(left, n.str)
+		}
+	case kindNumber:
+		return compareOrdered(n.field.number(b), n.number, n.op)
+	case kindTime:
+		left := n.field.time(b)
+		start, end := n.when(now)
+		switch n.op {
+		case "=":
+			return !left.Before(start) && left.Before(end)
+		case "!=":
+			return left.Before(start) || !left.Before(end)
+		case "<":
+			return left.Before(start)
+		case "<=":
+			return left.Before(end)
+		case ">":
+			return !left.Before(end)
+		case ">=":
+			return !left.Before(start)
+		}
+	case kindBool:
+		if n.op == "!=" {
+			return n.field.bool(b) != n.truth
+		}
+		return n.field.bool(b) == n.truth
+	}
+	return false
+}
+
+func compareOrdered(left, right float64, op string) bool {
+	switch op {
+	case "=":
+		return left == right
+	case "!=":
+		return left != right
+	case "<":
+		return left < right
+	case "<=":
+		return left <= right
+	case ">":
+		return left > right
+	case ">=":
+		return left >= right
+	}
+	return false
+}
+
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizeFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')' || c == '~':
+			tokens = append(tokens, filterToken{text: string(c)})
+			i++
+		case c == '=' || c == '<' || c == '>' || c == '!':
+			op := string(c)
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				op += "="
+			}
+			if op == "!" {
+				return nil, fmt.Errorf("unexpected '!' at position %d", i)
+			}
+			tokens = append(tokens, filterToken{text: op})
+			i += len(op)
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != c {
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			tokens = append(tokens, filterToken{text: string(runes[i+1 : end]), quoted: true})
+			i = end + 1
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune("()=<>!~\"'", runes[end]) {
+				end++
+			}
+			tokens = append(tokens, filterToken{text: string(runes[i:end])})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peekKeyword(keyword string) bool {
+	if p.pos >= len(p.tokens) {
+		return false
+	}
+	t := p.tokens[p.pos]
+	return !t.quoted && strings.EqualFold(t.text, keyword)
+}
+
+func (p *filterParser) next() (filterToken, error) {
+	if p.pos >= len(p.tokens) {
+		return filterToken{}, fmt.Errorf("unexpected end of query")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("and") {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.peekKeyword("not") {
+		p.pos++
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{inner}, nil
+	}
+	if p.peekKeyword("(") {
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peekKeyword(")") {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return inner, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+	fieldTok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(fieldTok.text)
+	field, ok := filterFields[name]
+	if !ok || fieldTok.quoted {
+		return nil, fmt.Errorf("unknown field %q", fieldTok.text)
+	}
+
+	opTok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	op := opTok.text
+	switch op {
+	case "=", "!=", "<", "<=", ">", ">=", "~":
+	default:
+		return nil, fmt.Errorf("expected operator after %q, got %q", name, op)
+	}
+
+	valueTok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if !valueTok.quoted && strings.ContainsAny(valueTok.text, "()=<>!~") {
+		return nil, fmt.Errorf("expected a value after %s %s, got %q", name, op, valueTok.text)
+	}
+
+	node := compareNode{field: field, op: op}
+	switch field.kind {
+	case kindString:
+		if op != "=" && op != "!=" && op != "~" {
+			return nil, fmt.Errorf("operator %s not supported for %s", op, name)
+		}
+		node.str = strings.ToLower(valueTok.text)
+	case kindNumber:
+		if op == "~" {
+			return nil, fmt.Errorf("operator ~ not supported for %s", name)
+		}
+		n, err := strconv.ParseFloat(valueTok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s expects a number, got %q", name, valueTok.text)
+		}
+		node.number = n
+	case kindTime:
+		if op == "~" {
+			return nil, fmt.Errorf("operator ~ not supported for %s", name)
+		}
+		when, err := parseFilterTime(valueTok.text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		node.when = when
+	case kindBool:
+		if op != "=" && op != "!=" {
+			return nil, fmt.Errorf("operator %s not supported for %s", op, name)
+		}
+		truth, err := strconv.ParseBool(valueTok.text)
+		if err != nil {
+			return nil, fmt.Errorf("%s expects true or false, got %q", name, valueTok.text)
+		}
+		node.truth = truth
+	}
+	return node, nil
+}
+
+func parseFilterTime(value string) (func(now time.Time) (start, end time.Time), error) {
+	switch strings.ToLower(value) {
+	case "today":
+		return func(now time.Time) (time.Time, time.Time) {
+			y, m, d := now.Date()
+			start := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+			return start, start.AddDate(0, 0, 1)
+		}, nil
+	case "this_week":
+		return func(now time.Time) (time.Time, time.Time) {
+			y, m, d := now.Date()
+			offset := (int(now.Weekday()) + 6) % 7 // weeks start on Monday
+			start := time.Date(y, m, d-offset, 0, 0, 0, 0, now.Location())
+			return start, start.AddDate(0, 0, 7)
+		}, nil
+	case "this_month":
+		return func(now time.Time) (time.Time, time.Time) {
+			start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+			return start, start.AddDate(0, 1, 0)
+		}, nil
+	case "this_year":
+		return func(now time.Time) (time.Time, time.Time) {
+			start := time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, now.Location())
+			return start, start.AddDate(1, 0, 0)
+		}, nil
+	}
+
+	start, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("expected YYYY-MM-DD or today/this_week/this_month/this_year, got %q", value)
+	}
+	end := start.AddDate(0, 0, 1)
+	return func(time.Time) (time.Time, time.Time) { return start, end }, nil
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// evalFilter parses expr and evaluates it against b as of now.
+func evalFilter(t *testing.T, expr string, b *BookFacts, now time.Time) bool {
+	t.Helper()
+	f, err := ParseFilter(expr)
+	if err != nil {
+		t.Fatalf("ParseFilter(%q): %v", expr, err)
+	}
+	return f.root.eval(b, now)
+}
+
+func TestFilterPrecedence(t *testing.T) {
+	book := &BookFacts{Title: "The Hobbit", Author: "J. R. R. Tolkien", FileType: "epub", Progress: 40, Rating: 5}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		// and binds tighter than or
+		{"type = pdf and progress = 40 or rating = 5", true},
+		{"rating = 5 or type = pdf and progress = 0", true},
+		{"(rating = 5 or type = pdf) and progress = 0", false},
+		{"type = pdf and (progress = 40 or rating = 5)", false},
+		// not binds tighter than and
+		{"not type = pdf and rating = 5", true},
+		{"not (type = epub and rating = 5)", false},
+		{"not not type = epub", true},
+		{"not type = epub or rating = 5", true},
+		// keywords are case-insensitive
+		{"TYPE = EPUB AND Not rating < 5", true},
+		{"((type = epub))", true},
+	}
+	for _, tt := range tests {
+		if got := evalFilter(t, tt.expr, book, time.Now()); got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestFilterValues(t *testing.T) {
+	book := &BookFacts{
+		Title:    "The Fellowship of the Ring",
+		Author:   "J. R. R. Tolkien",
+		ISBN:     "9780261102354",
+		FileType: "pdf",
+		FileSize: 2048,
+		Progress: 100,
+		Status:   "finished",
+		Favorite: true,
+		Notes:    3,
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`title = "The Fellowship of the Ring"`, true},
+		{`title = 'the fellowship of the ring'`, true},
+		{`title ~ "fellowship of"`, true},
+		{`title ~ ring`, true},
+		{`title ~ "or (the"`, false},
+		{`author != "tolkien"`, true},
+		{`author ~ "(tolkien)"`, false},
+		{`isbn = 9780261102354`, true},
+		{`status = finished and progress >= 100`, true},
+		{`size > 1024 and size <= 2048`, true},
+		{`favorite = true and favorite != false`, true},
+		{`notes = 3 and highlights = 0 and annotations < 1`, true},
+		// Quoted words are values, not keywords
+		{`status = "and" or status = "not"`, false},
+		{`title ~ "fellowship"and type = pdf`, true},
+	}
+	for _, tt := range tests {
+		if got := evalFilter(t, tt.expr, book, time.Now()); got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestFilterDates(t *testing.T) {
+	// A Wednesday afternoon
+	now := time.Date(2024, time.May, 15, 15, 30, 0, 0, time.Local)
+	at := func(month time.Month, day, hour int) *BookFacts {
+		return &BookFacts{AddedAt: time.Date(2024, month, day, hour, 0, 0, 0, time.Local)}
+	}
+
+	tests := []struct {
+		expr string
+		book *BookFacts
+		want bool
+	}{
+		{"added = today", at(time.May, 15, 0), true},
+		{"added = today", at(time.May, 15, 23), true},
+		{"added = today", at(time.May, 14, 23), false},
+		{"added != today", at(time.May, 14, 23), true},
+		{"added != today", at(time.May, 15, 9), false},
+		{"added = 2024-05-01", at(time.May, 1, 18), true},
+		{"added = 2024-05-01", at(time.May, 2, 0), false},
+		{"added != 2024-05-01", at(time.May, 1, 0), false},
+		{"added < 2024-05-01", at(time.April, 30, 23), true},
+		{"added < 2024-05-01", at(time.May, 1, 0), false},
+		{"added <= 2024-05-01", at(time.May, 1, 23), true},
+		{"added <= 2024-05-01", at(time.May, 2, 0), false},
+		{"added > 2024-05-01", at(time.May, 1, 23), false},
+		{"added > 2024-05-01", at(time.May, 2, 0), true},
+		{"added >= 2024-05-01", at(time.May, 1, 0), true},
+		{"added >= 2024-05-01", at(time.April, 30, 23), false},
+		{"added = this_week", at(time.May, 13, 0), true},
+		{"added = this_week", at(time.May, 19, 23), true},
+		{"added = this_week", at(time.May, 12, 23), false},
+		{"added < this_week", at(time.May, 12, 23), true},
+		{"added = this_month", at(time.May, 31, 23), true},
+		{"added > this_month", at(time.June, 1, 0), true},
+		{"added >= this_year", at(time.January, 1, 0), true},
+		{"added = this_year", at(time.December, 31, 23), true},
+	}
+	for _, tt := range tests {
+		if got := evalFilter(t, tt.expr, tt.book, now); got != tt.want {
+			t.Errorf("%q with added %s = %v, want %v", tt.expr, tt.book.AddedAt.Format(time.DateTime), got, tt.want)
+		}
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"", "empty query"},
+		{"   ", "empty query"},
+		{"colour = red", `unknown field "colour"`},
+		{`"title" = x`, `unknown field "title"`},
+		{"title", "unexpected end of query"},
+		{"title =", "unexpected end of query"},
+		{"title x", `expected operator after "title", got "x"`},
+		{"title ! x", "unexpected '!'"},
+		{`title = "open`, "unterminated string"},
+		{"title < x", "operator < not supported for title"},
+		{"progress ~ 5", "operator ~ not supported for progress"},
+		{"added ~ today", "operator ~ not supported for added"},
+		{"favorite > true", "operator > not supported for favorite"},
+		{"progress > half", `progress expects a number, got "half"`},
+		{"favorite = yes please", `favorite expects true or false, got "yes"`},
+		{"added > yesterday", "expected YYYY-MM-DD"},
+		{"added = 2024-13-01", "expected YYYY-MM-DD"},
+		{"(type = pdf", "missing closing parenthesis"},
+		{"type = pdf)", `unexpected ")"`},
+		{"type = pdf rating = 5", `unexpected "rating"`},
+		{"type = pdf and", "unexpected end of query"},
+		{"not", "unexpected end of query"},
+		{"title = (x)", `expected a value after title =, got "("`},
+		{"(title = )", `expected a value after title =, got ")"`},
+		{"title = = x", `expected a value after title =, got "="`},
+		{"title ~ ~", `expected a value after title ~, got "~"`},
+	}
+	for _, tt := range tests {
+		_, err := ParseFilter(tt.expr)
+		if err == nil {
+			t.Errorf("ParseFilter(%q) succeeded, want error %q", tt.expr, tt.err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ParseFilter(%q) = %q, want %q", tt.expr, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on the archives inside uploads (EPUB, CBZ and zips of books), so a
+// small file cannot expand into something that fills the disk or memory.
+const (
+	maxArchiveEntries = 10000
+	// maxArchiveRatio is the largest compression ratio allowed for entries
+	// over a megabyte; real books and images compress far less.
+	maxArchiveRatio = 100
+	// maxArchiveExpansion bounds the total uncompressed size of an archive,
+	// as a multiple of MaxUploadSize.
+	maxArchiveExpansion = 10
+)
+
+// maxFilenameLength is the longest stored filename, in bytes.
+const maxFilenameLength = 200
+
+var formatNames = map[string]string{
+	"epub": "EPUB",
+	"pdf":  "PDF",
+	"mobi": "MOBI",
+	"azw3": "AZW3",
+	"fb2":  "FB2",
+	"cbz":  "CBZ",
+}
+
+// invalidBookError explains why an uploaded file was refused.
+type invalidBookError string
+
+func (e invalidBookError) Error() string { return string(e) }
+
+// validateBookFile checks that a file really is the kind of book its
+// extension says, and that archives are well formed and within limits.
+func validateBookFile(filePath, fileType string) error {
+	actual := sniffFileType(filePath, fileType)
+	if actual == "" {
+		return invalidBookError(fmt.Sprintf("The file is not a valid %s", formatNames[fileType]))
+	}
+	if actual != fileType {
+		return invalidBookError(fmt.Sprintf("The file is in %s format, not %s", formatNames[actual], formatNames[fileType]))
+	}
+
+	if fileType == "epub" || fileType == "cbz" {
+		if err := validateArchive(filePath); err != nil {
+			return err
+		}
+	}
+
+	if fileType == "epub" {
+		archive, err := zip.OpenReader(filePath)
+		if err != nil {
+			return invalidBookError("The file is not a valid EPUB")
+		}
+		defer archive.Close()
+		if _, err := archive.Open("META-INF/container.xml"); err != nil {
+			return invalidBookError("The file is not a valid EPUB: META-INF/container.xml is missing")
+		}
+	}
+	return nil
+}
+
+// validateArchive refuses zips with too many entries, entries that expand
+// suspiciously far, or paths that would escape the directory they are
+// extracted to.
+func validateArchive(filePath string) error {
+	archive, err := zip.OpenReader(filePath)
+	if errors.Is(err, zip.ErrInsecurePath) {
+		return invalidBookError("The archive contains unsafe paths")
+	}
+	if err != nil {
+		return invalidBookError("The file is not a valid zip archive")
+	}
+	defer archive.Close()
+
+	if len(archive.File) > maxArchiveEntries {
+		return invalidBookError(fmt.Sprintf("The archive holds more than %d files", maxArchiveEntries))
+	}
+
+	var total uint64
+	for _, f := range archive.File {
+		name := strings.ReplaceAll(f.Name, "\\", "/")
+		if path.IsAbs(name) || strings.Contains(name, ":") || slices.Contains(strings.Split(name, "/"), "..") {
+			return invalidBookError("The archive contains unsafe paths")
+		}
+		if f.UncompressedSize64 > 1<<20 && f.UncompressedSize64 > f.CompressedSize64*maxArchiveRatio {
+			return invalidBookError("The archive contains an entry that expands suspiciously far")
+		}
+		total += f.UncompressedSize64
+		if total > uint64(MaxUploadSize)*maxArchiveExpansion {
+			return invalidBookError(fmt.Sprintf("The archive expands to more than %d MB", MaxUploadSize*maxArchiveExpansion>>20))
+		}
+	}
+	return nil
+}
+
+// sanitizeFilename makes an uploaded file's name safe to store: no
+// directories, control or reserved characters, or leading dots, and not
+// overly long. The extension is kept.
+func sanitizeFilename(name string) string {
+	name = strings.ToValidUTF8(name, "")
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r), strings.ContainsRune(`<>:"/\|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+
+	ext := path.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	if limit := maxFilenameLength - len(ext); len(base) > limit {
+		base = base[:limit]
+		for !utf8.ValidString(base) {
+			base = base[:len(base)-1]
+		}
+	}
+	if strings.Trim(base, " ._") == "" {
+		base = "book"
+	}
+	return base + ext
+}
+
+// contentTypes maps the media types servers send for books to file types.
+var contentTypes = map[string]string{
+	"application/epub+zip":           "epub",
+	"application/pdf":                "pdf",
+	"application/x-mobipocket-ebook": "mobi",
+	"application/vnd.amazon.ebook":   "azw3",
+	"application/x-fictionbook+xml":  "fb2",
+	"application/vnd.comicbook+zip":  "cbz",
+	"application/x-cbz":              "cbz",
+}
+
+// sniffFileType works out a book's file type from its contents, returning ""
+// for anything that is not a supported book. MOBI and AZW3 share a container,
+// so hint, the type suggested by the name or server, picks between them.
+func sniffFileType(filePath, hint string) string {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	head := make([]byte, 1024)
+	n, _ := io.ReadFull(file, head)
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte("%PDF-")):
+		return "pdf"
+	case len(head) >= 68 && (string(head[60:68]) == "BOOKMOBI"):
+		if hint == "azw3" {
+			return "azw3"
+		}
+		return "mobi"
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return sniffZip(filePath)
+	case isFictionBook(head):
+		return "fb2"
+	}
+	return ""
+}
+
+// isFictionBook reports whether an XML document's root element is FictionBook.
+func isFictionBook(head []byte) bool {
+	decoder := xml.NewDecoder(bytes.NewReader(head))
+	// Many FB2 books are in Windows-1251; the root element's name reads the
+	// same in any character set that extends ASCII
+	decoder.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) { return input, nil }
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local == "FictionBook"
+		}
+	}
+}
+
+// sniffZip tells an EPUB, which starts with a mimetype entry naming its media
+// type, from a comic, which is a zip of images. An EPUB missing its mimetype
+// is still recognised by its container file; the validation report flags it.
+func sniffZip(filePath string) string {
+	archive, err := zip.OpenReader(filePath)
+	if err != nil {
+		return ""
+	}
+	defer archive.Close()
+
+	if _, err := archive.Open("META-INF/container.xml"); err == nil {
+		if _, err := archive.Open("mimetype"); err != nil {
+			return "epub"
+		}
+	}
+	for _, f := range archive.File {
+		if f.Name != "mimetype" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return ""
+		}
+		mimetype, _ := io.ReadAll(io.LimitReader(rc, 64))
+		rc.Close()
+		if strings.TrimSpace(string(mimetype)) == "application/epub+zip" {
+			return "epub"
+		}
+		return ""
+	}
+
+	for _, f := range archive.File {
+		if imageExtensions[strings.ToLower(path.Ext(f.Name))] {
+			return "cbz"
+		}
+	}
+	return ""
+}
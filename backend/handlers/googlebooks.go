@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"bookland/models"
+	"context"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// googleBooksProvider looks books up with the Google Books API.
+type googleBooksProvider struct {
+	baseURL string
+	apiKey  string
+}
+
+func (p *googleBooksProvider) Name() string { return "googlebooks" }
+
+type googleVolume struct {
+	ID         string `json:"id"`
+	VolumeInfo struct {
+		Title               string   `json:"title"`
+		Subtitle            string   `json:"subtitle"`
+		Authors             []string `json:"authors"`
+		Publisher           string   `json:"publisher"`
+		PublishedDate       string   `json:"publishedDate"`
+		Description         string   `json:"description"`
+		Categories          []string `json:"categories"`
+		IndustryIdentifiers []struct {
+			Type       string `json:"type"`
+			Identifier string `json:"identifier"`
+		} `json:"industryIdentifiers"`
+		ImageLinks map[string]string `json:"imageLinks"`
+	} `json:"volumeInfo"`
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// plainText turns the HTML Google Books uses in descriptions into text.
+func plainText(s string) string {
+	s = strings.NewReplacer("<br>", "\n", "<br/>", "\n", "<br />", "\n", "</p>", "\n\n").Replace(s)
+	return strings.TrimSpace(html.UnescapeString(htmlTag.ReplaceAllString(s, "")))
+}
+
+func (p *googleBooksProvider) url(path string, params url.Values) string {
+	if p.apiKey != "" {
+		params.Set("key", p.apiKey)
+	}
+	if len(params) == 0 {
+		return p.baseURL + path
+	}
+	return p.baseURL + path + "?" + params.Encode()
+}
+
+func (p *googleBooksProvider) fromVolume(volume *googleVolume) models.MetadataCandidate {
+	info := volume.VolumeInfo
+	candidate := models.MetadataCandidate{
+		Provider:      p.Name(),
+		ID:            volume.ID,
+		Title:         info.Title,
+		Author:        strings.Join(info.Authors, " & "),
+		Description:   plainText(info.Description),
+		Publisher:     info.Publisher,
+		PublishedDate: info.PublishedDate,
+		Tags:          info.Categories,
+		Identifiers:   map[string]string{"google": volume.ID},
+	}
+	if info.Subtitle != "" {
+		candidate.Title += ": " + info.Subtitle
+	}
+
+	isbns := map[string]string{}
+	for _, identifier := range info.IndustryIdentifiers {
+		isbns[identifier.Type] = identifier.Identifier
+	}
+	if isbn := firstOf(isbns["ISBN_13"], isbns["ISBN_10"]); isbn != "" {
+		candidate.Identifiers["isbn"] = isbn
+	}
+
+	// The largest image offered; search results only have thumbnails.
+	links := info.ImageLinks
+	if cover := firstOf(links["extraLarge"], links["large"], links["medium"], links["small"], links["thumbnail"]); cover != "" {
+		cover = strings.Replace(cover, "http://", "https://", 1)
+		candidate.CoverURL = strings.Replace(cover, "&edge=curl", "", 1)
+	}
+	return candidate
+}
+
+func (p *googleBooksProvider) Search(ctx context.Context, query models.MetadataQuery) ([]models.MetadataCandidate, error) {
+	var terms []string
+	if query.ISBN != "" {
+		terms = append(terms, "isbn:"+query.ISBN)
+	} else {
+		if query.Title != "" {
+			terms = append(terms, `intitle:"`+strings.ReplaceAll(query.Title, `"`, "")+`"`)
+		}
+		if query.Author != "" {
+			terms = append(terms, `inauthor:"`+strings.ReplaceAll(query.Author, `"`, "")+`"`)
+		}
+	}
+
+	params := url.Values{}
+	params.Set("q", strings.Join(terms, " "))
+	params.Set("printType", "books")
+	params.Set("maxResults", strconv.Itoa(maxMetadataResults))
+
+	var response struct {
+		Items []googleVolume `json:"items"`
+	}
+	if err := metadataJSON(ctx, p.url("/volumes", params), &response); err != nil {
+		return nil, err
+	}
+
+	candidates := make([]models.MetadataCandidate, 0, len(response.Items))
+	for i := range response.Items {
+		candidates = append(candidates, p.fromVolume(&response.Items[i]))
+	}
+	return candidates, nil
+}
+
+func (p *googleBooksProvider) Details(ctx context.Context, id string) (*models.MetadataCandidate, error) {
+	var volume googleVolume
+	if err := metadataJSON(ctx, p.url("/volumes/"+url.PathEscape(id), url.Values{}), &volume); err != nil {
+		return nil, err
+	}
+	candidate := p.fromVolume(&volume)
+	return &candidate, nil
+}
+
+func (p *googleBooksProvider) Cover(ctx context.Context, candidate *models.MetadataCandidate) ([]byte, error) {
+	return fetchCover(ctx, candidate.CoverURL)
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// setupTestDB opens a fresh database in a temporary data directory and adds
+// an administrator.
+func setupTestDB(t *testing.T) *models.User {
+	t.Helper()
+	DataPath = t.TempDir()
+	if err := db.InitDB(DataPath); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	t.Cleanup(func() { db.DB.Close() })
+
+	user := &models.User{ID: "admin-id", Username: "admin", Role: RoleAdmin}
+	_, err := db.DB.Exec("INSERT INTO users (id, username, password_hash, role) VALUES (?, ?, '', ?)", user.ID, user.Username, user.Role)
+	if err != nil {
+		t.Fatalf("inserting user: %v", err)
+	}
+	return user
+}
+
+// addTestBook adds a book with a single file of fileType.
+func addTestBook(t *testing.T, id, title, fileType string) {
+	t.Helper()
+	book := models.Book{
+		ID:        id,
+		LibraryID: DefaultLibraryID,
+		Title:     title,
+		FilePath:  "/books/" + id + "." + fileType,
+		FileType:  fileType,
+		AddedAt:   time.Now(),
+	}
+	if err := insertBook(book, id); err != nil {
+		t.Fatalf("inserting book: %v", err)
+	}
+}
+
+// serveAs sends a request through router as user.
+func serveAs(router *mux.Router, user *models.User, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+}
@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// ImportAllowedNetworks lists private networks that imports may fetch from
+// anyway, for instance a NAS on the LAN. Everything else that is not
+// globally routable is refused.
+var ImportAllowedNetworks []netip.Prefix
+
+const (
+	importTimeout      = 30 * time.Minute
+	maxImportRedirects = 5
+	maxActiveImports   = 2
+)
+
+// importSlots limits how many downloads run at once; the rest wait.
+var importSlots = make(chan struct{}, maxActiveImports)
+
+// blockedNetworks are ranges that are not private by net.IP's definition but
+// must not be reached from the server either.
+var blockedNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+var errForbiddenAddress = errors.New("address not allowed")
+
+// importAddressAllowed reports whether an import may connect to addr.
+func importAddressAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range ImportAllowedNetworks {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsMulticast() || addr.IsUnspecified() || addr.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, prefix := range blockedNetworks {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// importClient checks every address it connects to, after DNS resolution and
+// on every redirect, so a hostname cannot be pointed at an internal service.
+var importClient = &http.Client{
+	Timeout: importTimeout,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				addrPort, err := netip.ParseAddrPort(address)
+				if err != nil || !importAddressAllowed(addrPort.Addr()) {
+					return errForbiddenAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxImportRedirects {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return errors.New("redirect to an unsupported scheme")
+		}
+		return nil
+	},
+}
+
+// ImportFromURL queues a book to be downloaded from a URL and added to a
+// library. The download runs in the background; poll GetImport for the result.
+func ImportFromURL(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL     string `json:"url"`
+		Library string `json:"library"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	source, err := url.Parse(strings.TrimSpace(input.URL))
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+		http.Error(w, "url must be an http or https URL", http.StatusBadRequest)
+		return
+	}
+	if source.User != nil {
+		http.Error(w, "url must not contain credentials", http.StatusBadRequest)
+		return
+	}
+
+	libraryID := input.Library
+	if libraryID == "" {
+		libraryID = DefaultLibraryID
+	}
+	if !canAccessLibrary(r, libraryID) {
+		http.Error(w, "Library not found", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	job := models.ImportJob{
+		ID:        uuid.New().String(),
+		URL:       source.String(),
+		LibraryID: libraryID,
+		Status:    models.ImportPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	_, err = db.DB.Exec(
+		"INSERT INTO url_imports (id, user_id, library_id, url, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		job.ID, currentUserID(r), job.LibraryID, job.URL, job.Status, job.CreatedAt, job.UpdatedAt,
+	)
+	if err != nil {
+		http.Error(w, "Failed to queue import", http.StatusInternalServerError)
+		return
+	}
+
+	// The import outlives this request but is still made on behalf of its user.
+	background := r.WithContext(context.WithoutCancel(r.Context()))
+	go runImport(background, job)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/books/import-url/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// GetImport reports the progress of one of the user's imports.
+func GetImport(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var job models.ImportJob
+	err := db.DB.QueryRow(
+		"SELECT id, url, library_id, status, error, book_id, created_at, updated_at FROM url_imports WHERE id = ? AND user_id = ?",
+		vars["id"], currentUserID(r),
+	).Scan(&job.ID, &job.URL, &job.LibraryID, &job.Status, &job.Error, &job.BookID, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		http.Error(w, "Import not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// FailInterruptedImports marks imports cut off by a restart as failed.
+func FailInterruptedImports() {
+	for _, table := range []string{"url_imports", "calibre_imports"} {
+		_, err := db.DB.Exec(
+			"UPDATE "+table+" SET status = ?, error = ?, updated_at = ? WHERE status IN (?, ?, ?)",
+			models.ImportFailed, "Interrupted by a server restart", time.Now(), models.ImportPending, models.ImportDownloading, models.ImportRunning,
+		)
+		if err != nil {
+			log.Printf("Warning: Failed to update interrupted imports: %v", err)
+		}
+	}
+}
+
+func setImportStatus(jobID, status, message, bookID string) {
+	_, err := db.DB.Exec(
+		"UPDATE url_imports SET status = ?, error = ?, book_id = ?, updated_at = ? WHERE id = ?",
+		status, message, bookID, time.Now(), jobID,
+	)
+	if err != nil {
+		log.Printf("Warning: Failed to update import %s: %v", jobID, err)
+	}
+}
+
+func runImport(r *http.Request, job models.ImportJob) {
+	importSlots <- struct{}{}
+	defer func() { <-importSlots }()
+
+	setImportStatus(job.ID, models.ImportDownloading, "", "")
+	bookID, duplicate, err := importBook(r, job)
+	switch {
+	case err != nil:
+		message := "Failed to add the book"
+		var reason importError
+		if errors.As(err, &reason) {
+			message = string(reason)
+		} else {
+			log.Printf("Import of %s failed: %v", job.URL, err)
+		}
+		setImportStatus(job.ID, models.ImportFailed, message, "")
+	case duplicate:
+		setImportStatus(job.ID, models.ImportDuplicate, "", bookID)
+	default:
+		setImportStatus(job.ID, models.ImportDone, "", bookID)
+	}
+}
+
+// importError is a failure worth showing to the person importing.
+type importError string
+
+func (e importError) Error() string { return string(e) }
+
+// importBook downloads job.URL to the staging directory, checks that it is a
+// book, and adds it like an upload.
+func importBook(r *http.Request, job models.ImportJob) (bookID string, duplicate bool, err error) {
+	request, err := http.NewRequestWithContext(r.Context(), http.MethodGet, job.URL, nil)
+	if err != nil {
+		return "", false, importError("Invalid URL")
+	}
+	request.Header.Set("User-Agent", "Bookland")
+
+	response, err := importClient.Do(request)
+	if errors.Is(err, errForbiddenAddress) {
+		return "", false, importError("The URL points to a private or local address")
+	}
+	if err != nil {
+		log.Printf("Import of %s: %v", job.URL, err)
+		return "", false, importError("Failed to download the file")
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", false, importError(fmt.Sprintf("The server answered %s", response.Status))
+	}
+	if response.ContentLength > MaxUploadSize {
+		return "", false, importError(fmt.Sprintf("File too large: the limit is %d MB", MaxUploadSize>>20))
+	}
+
+	filename, hint := importFilename(response)
+	staged := stageFile(filename, response.Body)
+	defer staged.remove()
+	if errors.Is(staged.Err, errUploadTooLarge) {
+		return "", false, importError(fmt.Sprintf("File too large: the limit is %d MB", MaxUploadSize>>20))
+	}
+	if staged.Err != nil {
+		return "", false, importError("Failed to download the file")
+	}
+
+	fileType := sniffFileType(staged.Path, hint)
+	if fileType == "" {
+		return "", false, importError("The file is not a supported book format")
+	}
+	// Name the file after what it turned out to be.
+	if strings.ToLower(path.Ext(staged.Filename)) != "."+fileType {
+		staged.Filename = strings.TrimSuffix(staged.Filename, path.Ext(staged.Filename)) + "." + fileType
+	}
+
+	book, duplicateOf, err := storeBook(r, job.LibraryID, &staged, true)
+	var invalid invalidBookError
+	if errors.As(err, &invalid) {
+		return "", false, importError(invalid.Error())
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if duplicateOf != "" {
+		return duplicateOf, true, nil
+	}
+	return book.ID, false, nil
+}
+
+// importFilename picks a name for a download from Content-Disposition or the
+// final URL, and the file type the server or name suggests.
+func importFilename(response *http.Response) (filename, hint string) {
+	if _, params, err := mime.ParseMediaType(response.Header.Get("Content-Disposition")); err == nil {
+		filename = path.Base(strings.ReplaceAll(params["filename"], "\\", "/"))
+	}
+	if filename == "" || filename == "." || filename == "/" {
+		filename = path.Base(response.Request.URL.Path)
+	}
+	if filename == "" || filename == "." || filename == "/" {
+		filename = "download"
+	}
+
+	hint = supportedTypes[strings.ToLower(path.Ext(filename))]
+	if mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type")); err == nil && contentTypes[mediaType] != "" {
+		hint = contentTypes[mediaType]
+	}
+	return filename, hint
+}
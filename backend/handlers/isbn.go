@@ -0,0 +1,422 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bookland/db"
+	"bookland/models"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// isbnPDFPages is how many pages of a PDF are searched for an ISBN; the
+	// copyright page is almost always among them.
+	isbnPDFPages = 10
+	// EPUBs put the copyright page at the front or the back, so the first and
+	// last few documents of the spine are searched.
+	isbnEPUBFirstDocuments = 8
+	isbnEPUBLastDocuments  = 4
+	maxISBNTextSize        = 1 << 20
+	// maxPDFScan bounds how much of a PDF is read when pdftotext is missing.
+	maxPDFScan = 8 << 20
+)
+
+// isbnPattern finds ISBN-13s, which start with 978 or 979, and ISBN-10s
+// after an "ISBN" label, written with or without hyphens or spaces.
+var isbnPattern = regexp.MustCompile(
+	`(?i)(ISBN(?:[ -]?1[03])?\s*[:#]?\s*)?(97[89](?:[\s\x{2010}-\x{2015}-]?[0-9]){10}|[0-9](?:[\s\x{2010}-\x{2015}-]?[0-9]){8}[\s\x{2010}-\x{2015}-]?[0-9X])`,
+)
+
+// normalizeISBN strips the hyphens and spaces an ISBN is often written with.
+func normalizeISBN(isbn string) string {
+	return strings.ToUpper(strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, isbn))
+}
+
+func validISBN10(isbn string) bool {
+	if len(isbn) != 10 {
+		return false
+	}
+	sum := 0
+	for i, r := range isbn {
+		digit := int(r - '0')
+		if r == 'X' && i == 9 {
+			digit = 10
+		} else if r < '0' || r > '9' {
+			return false
+		}
+		sum += (10 - i) * digit
+	}
+	return sum%11 == 0
+}
+
+func validISBN13(isbn string) bool {
+	if len(isbn) != 13 || !(strings.HasPrefix(isbn, "978") || strings.HasPrefix(isbn, "979")) {
+		return false
+	}
+	sum := 0
+	for i, r := range isbn {
+		if r < '0' || r > '9' {
+			return false
+		}
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += weight * int(r-'0')
+	}
+	return sum%10 == 0
+}
+
+// isbn13 returns a valid ISBN-10 or ISBN-13 as an ISBN-13, or "".
+func isbn13(isbn string) string {
+	isbn = normalizeISBN(isbn)
+	switch {
+	case validISBN13(isbn):
+		return isbn
+	case validISBN10(isbn):
+		prefixed := "978" + isbn[:9]
+		sum := 0
+		for i, r := range prefixed {
+			weight := 1
+			if i%2 == 1 {
+				weight = 3
+			}
+			sum += weight * int(r-'0')
+		}
+		return prefixed + strconv.Itoa((10-sum%10)%10)
+	}
+	return ""
+}
+
+// isbn10 returns an ISBN-13 in the 978 range as an ISBN-10, or "".
+func isbn10(isbn string) string {
+	if !validISBN13(isbn) || !strings.HasPrefix(isbn, "978") {
+		return ""
+	}
+	sum := 0
+	for i, r := range isbn[3:12] {
+		sum += (10 - i) * int(r-'0')
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return isbn[3:12] + "X"
+	}
+	return isbn[3:12] + strconv.Itoa(check)
+}
+
+// findISBNs returns the valid ISBNs in text as ISBN-13s, in the order they
+// appear. Bare numbers only count as ISBN-13s; an ISBN-10 needs its label.
+func findISBNs(text string) []string {
+	var found []string
+	for offset := 0; offset < len(text); {
+		match := isbnPattern.FindStringSubmatchIndex(text[offset:])
+		if match == nil {
+			break
+		}
+		for i := range match {
+			if match[i] >= 0 {
+				match[i] += offset
+			}
+		}
+		offset = match[1]
+		// Not part of a longer number. The search goes on from the next
+		// character, so that a number just before an ISBN does not hide it.
+		if match[0] > 0 && isDigit(text[match[0]-1]) || match[1] < len(text) && isDigit(text[match[1]]) {
+			offset = match[0] + 1
+			continue
+		}
+		labelled := match[2] >= 0
+		digits := normalizeISBN(strings.Map(func(r rune) rune {
+			if r >= 0x2010 && r <= 0x2015 || unicode.IsSpace(r) {
+				return -1
+			}
+			return r
+		}, text[match[4]:match[5]]))
+		if len(digits) == 10 && !labelled {
+			continue
+		}
+		if isbn := isbn13(digits); isbn != "" && !slices.Contains(found, isbn) {
+			found = append(found, isbn)
+		}
+	}
+	return found
+}
+
+func isDigit(b byte) bool { return b >= '0' && b <= '9' }
+
+// bookText returns the text of the first pages of an EPUB or PDF.
+func bookText(filePath, fileType string) (string, error) {
+	switch fileType {
+	case "epub":
+		return epubText(filePath)
+	case "pdf":
+		return pdfText(filePath)
+	}
+	return "", nil
+}
+
+// epubText returns the text of the documents at either end of an EPUB's spine.
+func epubText(filePath string) (string, error) {
+	archive, err := zip.OpenReader(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer archive.Close()
+
+	files := map[string]*zip.File{}
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+	read := func(name string) ([]byte, error) {
+		f, ok := files[name]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(io.LimitReader(rc, maxISBNTextSize))
+	}
+
+	data, err := read("META-INF/container.xml")
+	if err != nil {
+		return "", err
+	}
+	var container epubContainer
+	if err := xml.Unmarshal(data, &container); err != nil || len(container.Rootfiles) == 0 {
+		return "", err
+	}
+	opfPath := container.Rootfiles[0].FullPath
+	if data, err = read(opfPath); err != nil {
+		return "", err
+	}
+	var pkg epubPackage
+	if err := xml.Unmarshal(data, &pkg); err != nil {
+		return "", err
+	}
+
+	hrefs := map[string]string{}
+	for _, item := range pkg.Manifest {
+		hrefs[item.ID] = item.Href
+	}
+	spine := pkg.Spine.Itemrefs
+	var picked []int
+	for i := range spine {
+		if i < isbnEPUBFirstDocuments || i >= len(spine)-isbnEPUBLastDocuments {
+			picked = append(picked, i)
+		}
+	}
+
+	var text strings.Builder
+	for _, i := range picked {
+		name, ok := resolve(opfPath, hrefs[spine[i].IDRef])
+		if !ok || name == "" {
+			continue
+		}
+		if document, err := read(path.Clean(name)); err == nil {
+			text.WriteString(html.UnescapeString(htmlTag.ReplaceAllString(string(document), " ")))
+			text.WriteString("\n")
+		}
+	}
+	return text.String(), nil
+}
+
+// pdfText returns the text of the first pages of a PDF, using pdftotext when
+// it is installed.
+func pdfText(filePath string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "pdftotext", "-q", "-f", "1", "-l", strconv.Itoa(isbnPDFPages), "-enc", "UTF-8", filePath, "-")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err == nil {
+		return out.String(), nil
+	}
+	return pdfStreamText(filePath)
+}
+
+var (
+	pdfStream       = regexp.MustCompile(`(?s)<<((?:[^<>]|<<[^<>]*>>|<[^<>]*>)*)>>\s*stream\r?\n`)
+	pdfTextBlock    = regexp.MustCompile(`(?s)BT(.*?)ET`)
+	pdfLiteral      = regexp.MustCompile(`\(((?:\\.|[^\\)])*)\)`)
+	pdfOctalEscape  = regexp.MustCompile(`\\([0-7]{1,3})`)
+	pdfOtherEscapes = strings.NewReplacer(`\(`, "(", `\)`, ")", `\\`, `\`, `\n`, "\n", `\r`, "", `\t`, " ")
+)
+
+// pdfStreamText pulls the literal strings shown by the text operators of the
+// content streams near the start of a PDF. It is a fallback for when
+// pdftotext is missing and only finds text in simply encoded fonts.
+func pdfStreamText(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	content, err := io.ReadAll(io.LimitReader(file, maxPDFScan))
+	if err != nil {
+		return "", err
+	}
+
+	// A page may be drawn by several content streams
+	var text strings.Builder
+	streams := 0
+	for _, match := range pdfStream.FindAllSubmatchIndex(content, -1) {
+		if streams == isbnPDFPages*2 || text.Len() > maxISBNTextSize {
+			break
+		}
+		dictionary := content[match[2]:match[3]]
+		if bytes.Contains(dictionary, []byte("/Subtype/Image")) || bytes.Contains(dictionary, []byte("/Subtype /Image")) {
+			continue
+		}
+		end := bytes.Index(content[match[1]:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		data := content[match[1] : match[1]+end]
+		if bytes.Contains(dictionary, []byte("/FlateDecode")) {
+			reader, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				continue
+			}
+			data, _ = io.ReadAll(io.LimitReader(reader, maxISBNTextSize))
+			reader.Close()
+		} else if bytes.Contains(dictionary, []byte("/Filter")) {
+			continue
+		}
+
+		blocks := pdfTextBlock.FindAllSubmatch(data, -1)
+		if len(blocks) == 0 {
+			continue
+		}
+		streams++
+		for _, block := range blocks {
+			for _, literal := range pdfLiteral.FindAllSubmatch(block[1], -1) {
+				s := pdfOctalEscape.ReplaceAllStringFunc(string(literal[1]), func(escape string) string {
+					n, _ := strconv.ParseUint(escape[1:], 8, 8)
+					return string(rune(n))
+				})
+				text.WriteString(pdfOtherEscapes.Replace(s))
+			}
+			text.WriteString("\n")
+		}
+	}
+	return text.String(), nil
+}
+
+// detectISBN searches a book's text for ISBNs and, if the book has none yet,
+// stores the first one found as its "isbn" identifier. It returns every ISBN
+// found.
+func detectISBN(bookID, filePath, fileType string) ([]string, error) {
+	text, err := bookText(filePath, fileType)
+	if err != nil {
+		return nil, err
+	}
+	found := findISBNs(text)
+	if len(found) > 0 {
+		_, err = db.DB.Exec("INSERT OR IGNORE INTO book_identifiers (book_id, type, value) VALUES (?, 'isbn', ?)", bookID, found[0])
+		if err != nil {
+			return found, err
+		}
+	}
+	_, err = db.DB.Exec("UPDATE books SET isbn_checked_at = ? WHERE id = ?", time.Now(), bookID)
+	return found, err
+}
+
+// detectNewBookISBN looks for the ISBN of a book as it is added, unless it
+// came with one, logging rather than failing if that goes wrong.
+func detectNewBookISBN(bookID, filePath, fileType string) {
+	if fileType != "epub" && fileType != "pdf" {
+		return
+	}
+	var existing string
+	if db.DB.QueryRow("SELECT value FROM book_identifiers WHERE book_id = ? AND type = 'isbn'", bookID).Scan(&existing) == nil {
+		db.DB.Exec("UPDATE books SET isbn_checked_at = ? WHERE id = ?", time.Now(), bookID)
+		return
+	}
+	if _, err := detectISBN(bookID, filePath, fileType); err != nil {
+		log.Printf("Warning: Failed to detect the ISBN of book %s: %v", bookID, err)
+	}
+}
+
+// DetectMissingISBNs looks for the ISBNs of books that have never been
+// searched for one, such as those added before ISBNs were detected.
+func DetectMissingISBNs() {
+	rows, err := db.DB.Query(`
+		SELECT id, file_path, file_type FROM books
+		WHERE isbn_checked_at IS NULL AND deleted_at IS NULL AND file_type IN ('epub', 'pdf')
+		ORDER BY added_at`)
+	if err != nil {
+		log.Printf("Warning: Failed to list books for ISBN detection: %v", err)
+		return
+	}
+	var books []bookFormat
+	for rows.Next() {
+		var book bookFormat
+		if rows.Scan(&book.BookID, &book.FilePath, &book.FileType) == nil {
+			books = append(books, book)
+		}
+	}
+	rows.Close()
+
+	for _, book := range books {
+		detectNewBookISBN(book.BookID, book.FilePath, book.FileType)
+	}
+	if len(books) > 0 {
+		log.Printf("ISBN detection: checked %d books", len(books))
+	}
+}
+
+// DetectBookISBN searches a book's main file for ISBNs, storing the first one
+// found if the book has no ISBN yet, and lists all of them.
+func DetectBookISBN(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	book, err := scanBook(db.DB.QueryRow("SELECT "+bookColumns+bookFrom+" WHERE b.id = ?", currentUserID(r), vars["id"]))
+	if err != nil {
+		http.Error(w, "Book not found", http.StatusNotFound)
+		return
+	}
+	if book.FileType != "epub" && book.FileType != "pdf" {
+		http.Error(w, "ISBNs can only be detected in EPUB and PDF books", http.StatusBadRequest)
+		return
+	}
+
+	found, err := detectISBN(book.ID, book.FilePath, book.FileType)
+	if err != nil {
+		log.Printf("Failed to detect the ISBN of book %s: %v", book.ID, err)
+		http.Error(w, "Failed to read the book", http.StatusInternalServerError)
+		return
+	}
+	if found == nil {
+		found = []string{}
+	}
+	loadBookMetadata(&book)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.ISBNDetection{ISBN: book.Identifiers["isbn"], Found: found})
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestValidISBN10(t *testing.T) {
+	tests := []struct {
+		isbn string
+		want bool
+	}{
+		{"0141439513", true},
+		{"080442957X", true},
+		{"0141439512", false},
+		{"0804429570", false},
+		{"X141439513", false},
+		{"01414395X3", false},
+		{"080442957x", false},
+		{"014143951", false},
+		{"01414395130", false},
+		{"0-14-143951-3", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validISBN10(tt.isbn); got != tt.want {
+			t.Errorf("validISBN10(%q) = %v, want %v", tt.isbn, got, tt.want)
+		}
+	}
+}
+
+func TestValidISBN13(t *testing.T) {
+	tests := []struct {
+		isbn string
+		want bool
+	}{
+		{"9780141439518", true},
+		{"9791032305690", true},
+		{"9780141439517", false},
+		{"9771234567003", false},
+		{"978014143951X", false},
+		{"978014143951", false},
+		{"97801414395180", false},
+		{"978-0-14-143951-8", false},
+		{"0141439513", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validISBN13(tt.isbn); got != tt.want {
+			t.Errorf("validISBN13(%q) = %v, want %v", tt.isbn, got, tt.want)
+		}
+	}
+}
+
+func TestISBN13(t *testing.T) {
+	tests := []struct {
+		isbn string
+		want string
+	}{
+		{"9780141439518", "9780141439518"},
+		{"978-0-14-143951-8", "9780141439518"},
+		{"0141439513", "9780141439518"},
+		{"0-8044-2957-x", "9780804429573"},
+		{"979-10-323-0569-0", "9791032305690"},
+		{"0141439512", ""},
+		{"not an isbn", ""},
+	}
+	for _, tt := range tests {
+		if got := isbn13(tt.isbn); got != tt.want {
+			t.Errorf("isbn13(%q) = %q, want %q", tt.isbn, got, tt.want)
+		}
+	}
+}
+
+func TestISBN10(t *testing.T) {
+	tests := []struct {
+		isbn string
+		want string
+	}{
+		{"9780141439518", "0141439513"},
+		{"9780804429573", "080442957X"},
+		{"9780000000002", "0000000000"},
+		// 979 numbers were never given ISBN-10s
+		{"9791032305690", ""},
+		{"9780141439517", ""},
+		{"0141439513", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := isbn10(tt.isbn); got != tt.want {
+			t.Errorf("isbn10(%q) = %q, want %q", tt.isbn, got, tt.want)
+		}
+	}
+}
+
+func TestFindISBNs(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"bare", "Printed in 2003. 9780141439518 All rights reserved.", []string{"9780141439518"}},
+		{"hyphenated", "ISBN 978-0-14-143951-8", []string{"9780141439518"}},
+		{"spaced", "ISBN 978 0 14 143951 8", []string{"9780141439518"}},
+		{"unicode hyphens", "978‐0‐14‐143951‐8", []string{"9780141439518"}},
+		{"line break", "ISBN 978-0-14\n143951-8", []string{"9780141439518"}},
+		{"form feed", "ISBN 978-0-14\f143951-8", []string{"9780141439518"}},
+		{"labelled ISBN-10", "ISBN: 0-14-143951-3", []string{"9780141439518"}},
+		{"ISBN-10 label", "ISBN-10 0141439513", []string{"9780141439518"}},
+		{"lower case label", "isbn 0141439513", []string{"9780141439518"}},
+		{"X check digit", "ISBN 0-8044-2957-X", []string{"9780804429573"}},
+		{"bare ISBN-10", "Call 0141439513 to order", nil},
+		{"979", "ISBN 979-10-323-0569-0", []string{"9791032305690"}},
+		{"bad check digit", "ISBN 978-0-14-143951-7", nil},
+		{"inside a longer number", "Order 197801414395182 today", nil},
+		{"after a longer number", "12345678901234567890", nil},
+		{"labelled inside a longer number", "ISBN 97801414395180", nil},
+		{"number just before", "page 12 9780141439518", []string{"9780141439518"}},
+		{
+			"several, in order, once each",
+			"ISBN 978-0-14-143947-1 (paperback)\nISBN 978-0-14-143951-8 (ebook)\n9780141439471",
+			[]string{"9780141439471", "9780141439518"},
+		},
+		{"none", "No numbers here.", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findISBNs(tt.text); !slices.Equal(got, tt.want) {
+				t.Errorf("findISBNs(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
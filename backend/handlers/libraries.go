@@ -0,0 +1,545 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// DefaultLibraryID is the library BOOKS_PATH is scanned into, uploads go to
+// when none is named, and new accounts are granted.
+const DefaultLibraryID = "default"
+
+// canAccessLibrary reports whether the request's user may see libraryID.
+func canAccessLibrary(r *http.Request, libraryID string) bool {
+	user := CurrentUser(r)
+	if user == nil {
+		return false
+	}
+	var exists string
+	err := db.DB.QueryRow(
+		`SELECT l.id FROM libraries l WHERE l.id = ? AND (? = ? OR l.id IN (SELECT library_id FROM library_grants WHERE user_id = ?))`,
+		libraryID, user.Role, RoleAdmin, user.ID,
+	).Scan(&exists)
+	return err == nil
+}
+
+// grantLibraries replaces the set of libraries userID may see.
+func grantLibraries(userID string, libraryIDs []string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM library_grants WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, libraryID := range libraryIDs {
+		_, err := tx.Exec(
+			"INSERT OR IGNORE INTO library_grants (library_id, user_id) SELECT id, ? FROM libraries WHERE id = ?",
+			userID, libraryID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// userLibraries returns the IDs of the libraries granted to userID.
+func userLibraries(userID string) ([]string, error) {
+	rows, err := db.DB.Query("SELECT library_id FROM library_grants WHERE user_id = ? ORDER BY library_id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	libraries := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			libraries = append(libraries, id)
+		}
+	}
+	return libraries, rows.Err()
+}
+
+func libraryRoots(libraryID string) ([]string, error) {
+	rows, err := db.DB.Query("SELECT path FROM library_roots WHERE library_id = ? ORDER BY path", libraryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roots := make([]string, 0)
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err == nil {
+			roots = append(roots, path)
+		}
+	}
+	return roots, rows.Err()
+}
+
+// otherLibraryRoots returns the scan roots of every library but libraryID.
+func otherLibraryRoots(libraryID string) (map[string]bool, error) {
+	rows, err := db.DB.Query("SELECT path FROM library_roots WHERE library_id != ?", libraryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roots := map[string]bool{}
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err == nil {
+			roots[filepath.Clean(path)] = true
+		}
+	}
+	return roots, rows.Err()
+}
+
+// pathWithin reports whether path is dir or inside it.
+func pathWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// AddDefaultLibraryRoot makes sure booksPath is scanned into the default library.
+func AddDefaultLibraryRoot(booksPath string) error {
+	_, err := db.DB.Exec("INSERT OR IGNORE INTO library_roots (library_id, path) VALUES (?, ?)", DefaultLibraryID, booksPath)
+	return err
+}
+
+// ScanLibraries scans every root of every library, returning how many books were added.
+func ScanLibraries() int {
+	rows, err := db.DB.Query("SELECT library_id, path FROM library_roots ORDER BY library_id, path")
+	if err != nil {
+		log.Printf("Warning: Failed to list library roots: %v", err)
+		return 0
+	}
+	type root struct{ libraryID, path string }
+	var roots []root
+	for rows.Next() {
+		var rt root
+		if err := rows.Scan(&rt.libraryID, &rt.path); err == nil {
+			roots = append(roots, rt)
+		}
+	}
+	rows.Close()
+
+	added := 0
+	for _, rt := range roots {
+		log.Printf("Scanning books directory: %s", rt.path)
+		books, err := ScanDirectory(rt.path, rt.libraryID)
+		if err != nil {
+			log.Printf("Warning: Failed to scan books directory %s: %v", rt.path, err)
+			continue
+		}
+		added += len(books)
+	}
+	return added
+}
+
+// cleanRoots validates scan roots, which must be absolute paths to existing directories.
+func cleanRoots(roots []string) ([]string, string) {
+	cleaned := make([]string, 0, len(roots))
+	for _, root := range roots {
+		root = strings.TrimSpace(root)
+		if root == "" {
+			continue
+		}
+		if !filepath.IsAbs(root) {
+			return nil, "Scan roots must be absolute paths"
+		}
+		root = filepath.Clean(root)
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			return nil, "Scan root " + root + " is not a directory"
+		}
+		cleaned = append(cleaned, root)
+	}
+	return cleaned, ""
+}
+
+// GetLibraries lists the libraries the user can see. Administrators also get
+// each library's scan roots.
+func GetLibraries(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT l.id, l.name, l.created_at, (SELECT COUNT(*) FROM books b WHERE b.library_id = l.id AND b.deleted_at IS NULL)
+		FROM libraries l
+		WHERE ? = ? OR l.id IN (SELECT library_id FROM library_grants WHERE user_id = ?)
+		ORDER BY l.name COLLATE NOCASE`,
+		user.Role, RoleAdmin, user.ID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch libraries", http.StatusInternalServerError)
+		return
+	}
+	libraries := make([]models.Library, 0)
+	for rows.Next() {
+		var l models.Library
+		if err := rows.Scan(&l.ID, &l.Name, &l.CreatedAt, &l.BookCount); err != nil {
+			continue
+		}
+		libraries = append(libraries, l)
+	}
+	rows.Close()
+
+	if can(r, PermManageLibraries) {
+		for i := range libraries {
+			libraries[i].Roots, _ = libraryRoots(libraries[i].ID)
+			libraries[i].PathTemplates = libraryPathTemplateSources(libraries[i].ID)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(libraries)
+}
+
+// CreateLibrary adds a library and scans its roots in the background.
+func CreateLibrary(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name          string   `json:"name"`
+		Roots         []string `json:"roots"`
+		PathTemplates []string `json:"pathTemplates"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" {
+		http.Error(w, "Library name is required", http.StatusBadRequest)
+		return
+	}
+	roots, message := cleanRoots(input.Roots)
+	if message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+	templates, message := cleanPathTemplates(input.PathTemplates)
+	if message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	library := models.Library{
+		ID:            uuid.New().String(),
+		Name:          input.Name,
+		Roots:         roots,
+		PathTemplates: templates,
+		CreatedAt:     time.Now(),
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to create library", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"INSERT INTO libraries (id, name, path_templates, created_at) VALUES (?, ?, ?, ?)",
+		library.ID, library.Name, strings.Join(templates, "\n"), library.CreatedAt,
+	)
+	if err != nil {
+		http.Error(w, "Failed to create library", http.StatusInternalServerError)
+		return
+	}
+	if status, message := insertRoots(tx, library.ID, roots); status != 0 {
+		http.Error(w, message, status)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create library", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, AuditLibraryCreate, "library", library.ID, nil, library)
+	go scanRoots(library.ID, roots)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(library)
+}
+
+// UpdateLibrary renames a library and, when roots or path templates are
+// given, replaces them. Books already scanned from removed roots stay in the
+// library; new templates are applied to the books already there.
+func UpdateLibrary(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	libraryID := vars["id"]
+
+	var input struct {
+		Name          *string  `json:"name"`
+		Roots         []string `json:"roots"`
+		PathTemplates []string `json:"pathTemplates"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var library models.Library
+	err := db.DB.QueryRow("SELECT id, name, created_at FROM libraries WHERE id = ?", libraryID).
+		Scan(&library.ID, &library.Name, &library.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Library not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update library", http.StatusInternalServerError)
+		return
+	}
+	before := library
+	before.Roots, _ = libraryRoots(library.ID)
+	before.PathTemplates = libraryPathTemplateSources(library.ID)
+
+	var roots []string
+	if input.Roots != nil {
+		var message string
+		if roots, message = cleanRoots(input.Roots); message != "" {
+			http.Error(w, message, http.StatusBadRequest)
+			return
+		}
+	}
+	var templates []string
+	if input.PathTemplates != nil {
+		var message string
+		if templates, message = cleanPathTemplates(input.PathTemplates); message != "" {
+			http.Error(w, message, http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to update library", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if input.Name != nil {
+		library.Name = strings.TrimSpace(*input.Name)
+		if library.Name == "" {
+			http.Error(w, "Library name is required", http.StatusBadRequest)
+			return
+		}
+		if _, err := tx.Exec("UPDATE libraries SET name = ? WHERE id = ?", library.Name, library.ID); err != nil {
+			http.Error(w, "Failed to update library", http.StatusInternalServerError)
+			return
+		}
+	}
+	if input.Roots != nil {
+		if _, err := tx.Exec("DELETE FROM library_roots WHERE library_id = ?", library.ID); err != nil {
+			http.Error(w, "Failed to update library", http.StatusInternalServerError)
+			return
+		}
+		if status, message := insertRoots(tx, library.ID, roots); status != 0 {
+			http.Error(w, message, status)
+			return
+		}
+	}
+	if input.PathTemplates != nil {
+		if _, err := tx.Exec("UPDATE libraries SET path_templates = ? WHERE id = ?", strings.Join(templates, "\n"), library.ID); err != nil {
+			http.Error(w, "Failed to update library", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update library", http.StatusInternalServerError)
+		return
+	}
+
+	library.Roots, _ = libraryRoots(library.ID)
+	library.PathTemplates = libraryPathTemplateSources(library.ID)
+	recordAudit(r, AuditLibraryUpdate, "library", library.ID, before, library)
+	if input.Roots != nil || input.PathTemplates != nil {
+		go func() {
+			if input.Roots != nil {
+				scanRoots(library.ID, roots)
+			}
+			if input.PathTemplates != nil {
+				applyPathTemplates(library.ID)
+			}
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(library)
+}
+
+// DeleteLibrary removes a library and its books from the catalog. Files in
+// its scan roots are left alone. The default library cannot be deleted.
+func DeleteLibrary(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	libraryID := vars["id"]
+
+	if libraryID == DefaultLibraryID {
+		http.Error(w, "The default library cannot be deleted", http.StatusConflict)
+		return
+	}
+
+	var library models.Library
+	err := db.DB.QueryRow(
+		"SELECT l.id, l.name, l.created_at, (SELECT COUNT(*) FROM books b WHERE b.library_id = l.id AND b.deleted_at IS NULL) FROM libraries l WHERE l.id = ?",
+		libraryID,
+	).Scan(&library.ID, &library.Name, &library.CreatedAt, &library.BookCount)
+	if err != nil {
+		http.Error(w, "Library not found", http.StatusNotFound)
+		return
+	}
+	library.Roots, _ = libraryRoots(library.ID)
+
+	var bookIDs []string
+	rows, err := db.DB.Query("SELECT id FROM books WHERE library_id = ?", libraryID)
+	if err == nil {
+		for rows.Next() {
+			var bookID string
+			if rows.Scan(&bookID) == nil {
+				bookIDs = append(bookIDs, bookID)
+			}
+		}
+		rows.Close()
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to delete library", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, statement := range []string{
+		"DELETE FROM shelf_books WHERE book_id IN (SELECT id FROM books WHERE library_id = ?)",
+		"DELETE FROM annotations WHERE book_id IN (SELECT id FROM books WHERE library_id = ?)",
+		"DELETE FROM reading_sessions WHERE book_id IN (SELECT id FROM books WHERE library_id = ?)",
+		"DELETE FROM device_progress WHERE book_id IN (SELECT id FROM books WHERE library_id = ?)",
+		"DELETE FROM user_books WHERE book_id IN (SELECT id FROM books WHERE library_id = ?)",
+		"DELETE FROM book_validations WHERE book_id IN (SELECT id FROM books WHERE library_id = ?)",
+		"DELETE FROM book_tags WHERE book_id IN (SELECT id FROM books WHERE library_id = ?)",
+		"DELETE FROM book_identifiers WHERE book_id IN (SELECT id FROM books WHERE library_id = ?)",
+		"DELETE FROM book_formats WHERE book_id IN (SELECT id FROM books WHERE library_id = ?)",
+		"DELETE FROM book_conversions WHERE book_id IN (SELECT id FROM books WHERE library_id = ?)",
+		"DELETE FROM books WHERE library_id = ?",
+		"DELETE FROM library_roots WHERE library_id = ?",
+		"DELETE FROM library_grants WHERE library_id = ?",
+		"DELETE FROM libraries WHERE id = ?",
+	} {
+		if _, err := tx.Exec(statement, libraryID); err != nil {
+			http.Error(w, "Failed to delete library", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to delete library", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, AuditLibraryDelete, "library", library.ID, library, nil)
+
+	for _, bookID := range bookIDs {
+		removeBookStorage(bookID)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+// SetUserLibraries replaces the libraries a user has been granted.
+func SetUserLibraries(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["id"]
+
+	var input struct {
+		Libraries []string `json:"libraries"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil || input.Libraries == nil {
+		http.Error(w, "libraries is required", http.StatusBadRequest)
+		return
+	}
+
+	var exists string
+	if err := db.DB.QueryRow("SELECT id FROM users WHERE id = ?", userID).Scan(&exists); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	for _, libraryID := range input.Libraries {
+		if err := db.DB.QueryRow("SELECT id FROM libraries WHERE id = ?", libraryID).Scan(&exists); err != nil {
+			http.Error(w, "Library not found: "+libraryID, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := grantLibraries(userID, input.Libraries); err != nil {
+		http.Error(w, "Failed to update libraries", http.StatusInternalServerError)
+		return
+	}
+	libraries, _ := userLibraries(userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"libraries": libraries})
+}
+
+// insertRoots adds scan roots to a library, returning a status and message
+// when a root already belongs to another library.
+func insertRoots(tx *sql.Tx, libraryID string, roots []string) (int, string) {
+	rows, err := tx.Query("SELECT path FROM library_roots WHERE library_id != ?", libraryID)
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to save scan roots"
+	}
+	var taken []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err == nil {
+			taken = append(taken, path)
+		}
+	}
+	rows.Close()
+
+	// A folder can only be scanned into one library, so roots of different
+	// libraries may not overlap
+	for _, root := range roots {
+		for _, other := range taken {
+			switch {
+			case root == other:
+				return http.StatusConflict, "Scan root " + root + " already belongs to another library"
+			case pathWithin(root, other):
+				return http.StatusConflict, "Scan root " + root + " is inside " + other + ", which belongs to another library"
+			case pathWithin(other, root):
+				return http.StatusConflict, "Scan root " + root + " contains " + other + ", which belongs to another library"
+			}
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO library_roots (library_id, path) VALUES (?, ?)", libraryID, root); err != nil {
+			return http.StatusInternalServerError, "Failed to save scan roots"
+		}
+	}
+	return 0, ""
+}
+
+func scanRoots(libraryID string, roots []string) {
+	for _, root := range roots {
+		books, err := ScanDirectory(root, libraryID)
+		if err != nil {
+			log.Printf("Warning: Failed to scan books directory %s: %v", root, err)
+			continue
+		}
+		log.Printf("Scan complete: Added %d books from %s", len(books), root)
+	}
+}
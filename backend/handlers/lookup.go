@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// lookupFields are the parts of a book a candidate can change, in the order
+// they are reviewed.
+var lookupFields = []string{"title", "author", "series", "description", "tags", "identifiers", "cover"}
+
+func loadLookupBook(r *http.Request, bookID string) (*models.Book, error) {
+	book, err := scanBook(db.DB.QueryRow("SELECT "+bookColumns+bookFrom+" WHERE b.id = ?", currentUserID(r), bookID))
+	if err != nil {
+		return nil, err
+	}
+	if err := loadBookMetadata(&book); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+// SearchBookMetadata looks a book up with every metadata provider, or the one
+// named by ?provider=. It searches by the book's ISBN when it has one, then
+// by title and author; ?isbn=, ?title= and ?author= search for something
+// else.
+func SearchBookMetadata(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	book, err := loadLookupBook(r, vars["id"])
+	if err != nil {
+		http.Error(w, "Book not found", http.StatusNotFound)
+		return
+	}
+
+	params := r.URL.Query()
+	providers := MetadataProviders
+	if name := params.Get("provider"); name != "" {
+		provider := metadataProvider(name)
+		if provider == nil {
+			http.Error(w, "Unknown metadata provider: "+name, http.StatusBadRequest)
+			return
+		}
+		providers = []MetadataProvider{provider}
+	}
+	if len(providers) == 0 {
+		http.Error(w, "No metadata providers are configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := models.MetadataQuery{
+		ISBN:   normalizeISBN(params.Get("isbn")),
+		Title:  strings.TrimSpace(params.Get("title")),
+		Author: strings.TrimSpace(params.Get("author")),
+	}
+	if query == (models.MetadataQuery{}) {
+		query = models.MetadataQuery{ISBN: normalizeISBN(book.Identifiers["isbn"]), Title: book.Title, Author: book.Author}
+	}
+
+	search := models.MetadataSearch{Query: query, Results: []models.MetadataCandidate{}}
+	results := make([][]models.MetadataCandidate, len(providers))
+	errs := make([]error, len(providers))
+	var wg sync.WaitGroup
+	for i, provider := range providers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), metadataTimeout)
+			defer cancel()
+			results[i], errs[i] = searchProvider(ctx, provider, query)
+			// Not every edition is catalogued by ISBN
+			if errs[i] == nil && len(results[i]) == 0 && query.ISBN != "" && query.Title != "" {
+				results[i], errs[i] = searchProvider(ctx, provider, models.MetadataQuery{Title: query.Title, Author: query.Author})
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, provider := range providers {
+		if errs[i] != nil {
+			log.Printf("Metadata search with %s failed: %v", provider.Name(), errs[i])
+			search.Errors = append(search.Errors, models.ProviderError{Provider: provider.Name(), Error: errs[i].Error()})
+			continue
+		}
+		search.Results = append(search.Results, results[i]...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(search)
+}
+
+// lookupCandidate fetches a candidate's details, writing an error response if
+// that fails.
+func lookupCandidate(w http.ResponseWriter, r *http.Request, providerName, id string) (MetadataProvider, *models.MetadataCandidate, bool) {
+	provider := metadataProvider(providerName)
+	if provider == nil {
+		http.Error(w, "Unknown metadata provider: "+providerName, http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if id == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), metadataTimeout)
+	defer cancel()
+	candidate, err := providerDetails(ctx, provider, id)
+	if errors.Is(err, errCandidateNotFound) {
+		http.Error(w, "Not found at "+providerName+": "+id, http.StatusNotFound)
+		return nil, nil, false
+	}
+	if err != nil {
+		log.Printf("Metadata details from %s failed: %v", providerName, err)
+		http.Error(w, "Failed to reach "+providerName, http.StatusBadGateway)
+		return nil, nil, false
+	}
+	return provider, candidate, true
+}
+
+// metadataChanges lists what applying a candidate would change. Tags and
+// identifiers are added to the book's, not replacing them.
+func metadataChanges(book *models.Book, candidate *models.MetadataCandidate) []models.MetadataChange {
+	changes := []models.MetadataChange{}
+	add := func(field string, current, proposed any) {
+		changes = append(changes, models.MetadataChange{Field: field, Current: current, Proposed: proposed})
+	}
+
+	if title := strings.TrimSpace(candidate.Title); title != "" && title != book.Title {
+		add("title", book.Title, title)
+	}
+	if author := strings.TrimSpace(candidate.Author); author != "" && author != book.Author {
+		add("author", book.Author, author)
+	}
+	if series := strings.TrimSpace(candidate.Series); series != "" &&
+		(series != book.Series || !equalIndex(candidate.SeriesIndex, book.SeriesIndex)) {
+		add("series",
+			map[string]any{"series": book.Series, "seriesIndex": book.SeriesIndex},
+			map[string]any{"series": series, "seriesIndex": candidate.SeriesIndex})
+	}
+	if description := strings.TrimSpace(candidate.Description); description != "" && description != book.Description {
+		add("description", book.Description, description)
+	}
+
+	var tags []string
+	for _, tag := range candidate.Tags {
+		if tag = strings.TrimSpace(tag); tag != "" && !slices.Contains(book.Tags, tag) && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > 0 {
+		add("tags", book.Tags, tags)
+	}
+
+	identifiers := map[string]string{}
+	for kind, value := range candidate.Identifiers {
+		if value = strings.TrimSpace(value); value != "" && book.Identifiers[kind] != value {
+			identifiers[kind] = value
+		}
+	}
+	if len(identifiers) > 0 {
+		add("identifiers", book.Identifiers, identifiers)
+	}
+
+	if candidate.CoverURL != "" {
+		current := ""
+		if book.CoverPath != "" {
+			current = "/api/books/" + book.ID + "/cover"
+		}
+		add("cover", current, candidate.CoverURL)
+	}
+	return changes
+}
+
+func equalIndex(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// ReviewBookMetadata shows what applying a provider's record to a book would
+// change: ?provider=openlibrary&id=OL7353617M.
+func ReviewBookMetadata(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	book, err := loadLookupBook(r, vars["id"])
+	if err != nil {
+		http.Error(w, "Book not found", http.StatusNotFound)
+		return
+	}
+	params := r.URL.Query()
+	_, candidate, ok := lookupCandidate(w, r, params.Get("provider"), params.Get("id"))
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.MetadataReview{Candidate: *candidate, Changes: metadataChanges(book, candidate)})
+}
+
+// ApplyBookMetadata applies a provider's record to a book. fields picks which
+// of the reviewed changes to make; all of them when it is left out:
+// {"provider": "openlibrary", "id": "OL7353617M", "fields": ["description", "cover"]}.
+func ApplyBookMetadata(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bookID := vars["id"]
+
+	var input struct {
+		Provider string   `json:"provider"`
+		ID       string   `json:"id"`
+		Fields   []string `json:"fields"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	for _, field := range input.Fields {
+		if !slices.Contains(lookupFields, field) {
+			http.Error(w, "Unknown field: "+field, http.StatusBadRequest)
+			return
+		}
+	}
+
+	book, err := loadLookupBook(r, bookID)
+	if err != nil {
+		http.Error(w, "Book not found", http.StatusNotFound)
+		return
+	}
+	provider, candidate, ok := lookupCandidate(w, r, input.Provider, input.ID)
+	if !ok {
+		return
+	}
+
+	var changes []models.MetadataChange
+	for _, change := range metadataChanges(book, candidate) {
+		if input.Fields == nil || slices.Contains(input.Fields, change.Field) {
+			changes = append(changes, change)
+		}
+	}
+
+	// The cover is downloaded first, so a failure changes nothing
+	var cover []byte
+	updated := *book
+	var tags []string
+	var identifiers map[string]string
+	for _, change := range changes {
+		switch change.Field {
+		case "title":
+			updated.Title = strings.TrimSpace(candidate.Title)
+		case "author":
+			updated.Author = strings.TrimSpace(candidate.Author)
+		case "series":
+			updated.Series = strings.TrimSpace(candidate.Series)
+			updated.SeriesIndex = candidate.SeriesIndex
+		case "description":
+			updated.Description = strings.TrimSpace(candidate.Description)
+		case "tags":
+			tags = change.Proposed.([]string)
+		case "identifiers":
+			identifiers = change.Proposed.(map[string]string)
+		case "cover":
+			ctx, cancel := context.WithTimeout(r.Context(), metadataTimeout)
+			cover, err = provider.Cover(ctx, candidate)
+			cancel()
+			if err != nil {
+				log.Printf("Fetching the cover from %s failed: %v", provider.Name(), err)
+				http.Error(w, "Failed to fetch the cover from "+provider.Name(), http.StatusBadGateway)
+				return
+			}
+		}
+	}
+
+	coverPath := book.CoverPath
+	if cover != nil {
+		if coverPath, err = saveCover(bookID, cover); err != nil {
+			http.Error(w, "Failed to save cover", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to update book", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE books SET title = ?, author = ?, series = ?, series_index = ?, description = ?, cover_path = ? WHERE id = ?",
+		updated.Title, updated.Author, updated.Series, updated.SeriesIndex, updated.Description, coverPath, bookID,
+	)
+	if err == nil {
+		err = insertTagsAndIdentifiers(tx, bookID, tags, identifiers)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Applying metadata to %s failed: %v", bookID, err)
+		http.Error(w, "Failed to update book", http.StatusInternalServerError)
+		return
+	}
+
+	if len(changes) > 0 {
+		before := map[string]any{}
+		after := map[string]any{"source": provider.Name() + ":" + candidate.ID}
+		for _, change := range changes {
+			before[change.Field] = change.Current
+			after[change.Field] = change.Proposed
+		}
+		recordAudit(r, AuditBookUpdate, "book", bookID, before, after)
+	}
+
+	result, err := loadLookupBook(r, bookID)
+	if err != nil {
+		http.Error(w, "Failed to fetch book", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
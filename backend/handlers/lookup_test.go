@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// countingProvider is the fake provider, counting the requests that reach it.
+type countingProvider struct {
+	*fakeProvider
+	searches, details int
+}
+
+func (p *countingProvider) Search(ctx context.Context, query models.MetadataQuery) ([]models.MetadataCandidate, error) {
+	p.searches++
+	return p.fakeProvider.Search(ctx, query)
+}
+
+func (p *countingProvider) Details(ctx context.Context, id string) (*models.MetadataCandidate, error) {
+	p.details++
+	return p.fakeProvider.Details(ctx, id)
+}
+
+// setupLookup opens a fresh database with an administrator and one book,
+// and makes the fake provider the only metadata provider.
+func setupLookup(t *testing.T) (*models.User, *countingProvider) {
+	t.Helper()
+	user := setupTestDB(t)
+
+	fake, err := newFakeProvider("")
+	if err != nil {
+		t.Fatalf("newFakeProvider: %v", err)
+	}
+	provider := &countingProvider{fakeProvider: fake}
+	previous := MetadataProviders
+	MetadataProviders = []MetadataProvider{provider}
+	t.Cleanup(func() { MetadataProviders = previous })
+
+	book := models.Book{
+		ID:          "book-id",
+		LibraryID:   "default",
+		Title:       "Pride and Prejudice",
+		Author:      "Austen",
+		FilePath:    "/books/pride.epub",
+		FileType:    "epub",
+		AddedAt:     time.Now(),
+		Tags:        []string{"Classics"},
+		Identifiers: map[string]string{"isbn": "9780141439518"},
+	}
+	if err := insertBook(book, "hash"); err != nil {
+		t.Fatalf("inserting book: %v", err)
+	}
+	return user, provider
+}
+
+// serveLookup sends a request through the lookup routes as user.
+func serveLookup(t *testing.T, user *models.User, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	router := mux.NewRouter()
+	router.HandleFunc("/api/books/{id}/metadata/search", SearchBookMetadata).Methods("GET")
+	router.HandleFunc("/api/books/{id}/metadata/review", ReviewBookMetadata).Methods("GET")
+	router.HandleFunc("/api/books/{id}/metadata/apply", ApplyBookMetadata).Methods("POST")
+	return serveAs(router, user, method, target, body)
+}
+
+func candidateIDs(candidates []models.MetadataCandidate) []string {
+	var ids []string
+	for _, candidate := range candidates {
+		ids = append(ids, candidate.ID)
+	}
+	return ids
+}
+
+func TestSearchBookMetadata(t *testing.T) {
+	user, _ := setupLookup(t)
+
+	tests := []struct {
+		name   string
+		target string
+		want   []string
+	}{
+		{"book's ISBN", "/api/books/book-id/metadata/search", []string{"pride-and-prejudice"}},
+		{"other ISBN", "/api/books/book-id/metadata/search?isbn=978-0-14-143947-1", []string{"frankenstein"}},
+		{"title", "/api/books/book-id/metadata/search?title=fellowship", []string{"the-fellowship-of-the-ring"}},
+		{"unknown ISBN", "/api/books/book-id/metadata/search?isbn=9780000000002", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var search models.MetadataSearch
+			decodeResponse(t, serveLookup(t, user, "GET", tt.target, ""), &search)
+			if got := candidateIDs(search.Results); !slices.Equal(got, tt.want) {
+				t.Errorf("results = %v, want %v", got, tt.want)
+			}
+			if len(search.Errors) > 0 {
+				t.Errorf("errors = %v", search.Errors)
+			}
+		})
+	}
+
+	if w := serveLookup(t, user, "GET", "/api/books/book-id/metadata/search?provider=nope", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown provider: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := serveLookup(t, user, "GET", "/api/books/missing/metadata/search", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown book: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestSearchBookMetadataCache(t *testing.T) {
+	user, provider := setupLookup(t)
+
+	for i := 0; i < 2; i++ {
+		var search models.MetadataSearch
+		decodeResponse(t, serveLookup(t, user, "GET", "/api/books/book-id/metadata/search?title=Frankenstein", ""), &search)
+		if got := candidateIDs(search.Results); !slices.Equal(got, []string{"frankenstein"}) {
+			t.Fatalf("search %d: results = %v", i+1, got)
+		}
+	}
+	if provider.searches != 1 {
+		t.Errorf("provider searched %d times, want 1", provider.searches)
+	}
+
+	for i := 0; i < 2; i++ {
+		w := serveLookup(t, user, "GET", "/api/books/book-id/metadata/review?provider=fake&id=frankenstein", "")
+		var review models.MetadataReview
+		decodeResponse(t, w, &review)
+	}
+	if provider.details != 1 {
+		t.Errorf("provider asked for details %d times, want 1", provider.details)
+	}
+
+	var rows int
+	db.DB.QueryRow("SELECT COUNT(*) FROM metadata_cache WHERE provider = 'fake'").Scan(&rows)
+	if rows != 2 {
+		t.Errorf("%d cached responses, want 2", rows)
+	}
+
+	// Stale entries are fetched again and purged
+	db.DB.Exec("UPDATE metadata_cache SET fetched_at = ?", time.Now().Add(-2*metadataCacheTTL))
+	serveLookup(t, user, "GET", "/api/books/book-id/metadata/search?title=Frankenstein", "")
+	if provider.searches != 2 {
+		t.Errorf("provider searched %d times after the cache expired, want 2", provider.searches)
+	}
+	if n := PurgeMetadataCache(); n != 1 {
+		t.Errorf("purged %d entries, want 1", n)
+	}
+}
+
+func TestReviewBookMetadata(t *testing.T) {
+	user, _ := setupLookup(t)
+
+	var review models.MetadataReview
+	decodeResponse(t, serveLookup(t, user, "GET", "/api/books/book-id/metadata/review?provider=fake&id=pride-and-prejudice", ""), &review)
+	if review.Candidate.ID != "pride-and-prejudice" {
+		t.Errorf("candidate = %q", review.Candidate.ID)
+	}
+	var fields []string
+	for _, change := range review.Changes {
+		fields = append(fields, change.Field)
+	}
+	// The book already has the candidate's title and ISBN
+	if slices.Contains(fields, "title") || slices.Contains(fields, "identifiers") {
+		t.Errorf("changes %v include fields the book already matches", fields)
+	}
+	for _, field := range []string{"author", "cover"} {
+		if !slices.Contains(fields, field) {
+			t.Errorf("changes %v leave out %s", fields, field)
+		}
+	}
+
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/api/books/book-id/metadata/review?provider=fake&id=missing", http.StatusNotFound},
+		{"/api/books/book-id/metadata/review?provider=fake", http.StatusBadRequest},
+		{"/api/books/book-id/metadata/review?provider=nope&id=frankenstein", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := serveLookup(t, user, "GET", tt.target, ""); w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.target, w.Code, tt.status)
+		}
+	}
+}
+
+func TestApplyBookMetadata(t *testing.T) {
+	user, _ := setupLookup(t)
+
+	var book models.Book
+	w := serveLookup(t, user, "POST", "/api/books/book-id/metadata/apply",
+		`{"provider": "fake", "id": "pride-and-prejudice", "fields": ["author", "tags", "cover"]}`)
+	decodeResponse(t, w, &book)
+
+	fake, _ := newFakeProvider("")
+	candidate, _ := fake.Details(context.Background(), "pride-and-prejudice")
+	if book.Author != candidate.Author {
+		t.Errorf("author = %q, want %q", book.Author, candidate.Author)
+	}
+	if book.Title != "Pride and Prejudice" || book.Description != "" {
+		t.Errorf("fields that were not picked changed: title %q, description %q", book.Title, book.Description)
+	}
+	if !slices.Contains(book.Tags, "Classics") {
+		t.Errorf("tags = %v, lost the book's own", book.Tags)
+	}
+	for _, tag := range candidate.Tags {
+		if !slices.Contains(book.Tags, tag) {
+			t.Errorf("tags = %v, missing %q", book.Tags, tag)
+		}
+	}
+	if book.CoverPath == "" || !fileExists(book.CoverPath) {
+		t.Errorf("cover %q was not saved", book.CoverPath)
+	}
+
+	var entries int
+	db.DB.QueryRow("SELECT COUNT(*) FROM audit_log WHERE target_id = 'book-id' AND actor_id = ?", user.ID).Scan(&entries)
+	if entries != 1 {
+		t.Errorf("%d audit entries, want 1", entries)
+	}
+
+	if w := serveLookup(t, user, "POST", "/api/books/book-id/metadata/apply", `{"provider": "fake", "id": "frankenstein", "fields": ["isbn"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown field: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
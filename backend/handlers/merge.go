@@ -0,0 +1,277 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/gorilla/mux"
+)
+
+// bookFormat is one file of a book.
+type bookFormat struct {
+	BookID   string
+	FileType string
+	FilePath string
+}
+
+func loadBookFormats(bookID string) ([]bookFormat, error) {
+	rows, err := db.DB.Query("SELECT book_id, file_type, file_path FROM book_formats WHERE book_id = ? ORDER BY file_type", bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var formats []bookFormat
+	for rows.Next() {
+		var f bookFormat
+		if err := rows.Scan(&f.BookID, &f.FileType, &f.FilePath); err != nil {
+			return nil, err
+		}
+		formats = append(formats, f)
+	}
+	return formats, rows.Err()
+}
+
+// inStorageDir reports whether a file lives in a book's storage directory,
+// rather than in a scan root.
+func inStorageDir(bookID, filePath string) bool {
+	return filepath.Dir(filePath) == bookStorageDir(bookID)
+}
+
+// MergeBooks folds other books into one, which takes over their formats and
+// everyone's progress, annotations, sessions and shelves. The body lists the
+// books to merge and may name the format to use as the main file:
+// {"books": ["…"], "primary": "epub"}.
+func MergeBooks(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	targetID := vars["id"]
+
+	var input struct {
+		Books   []string `json:"books"`
+		Primary string   `json:"primary"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil || len(input.Books) == 0 {
+		http.Error(w, "books is required", http.StatusBadRequest)
+		return
+	}
+	slices.Sort(input.Books)
+	input.Books = slices.Compact(input.Books)
+	if slices.Contains(input.Books, targetID) {
+		http.Error(w, "A book cannot be merged into itself", http.StatusBadRequest)
+		return
+	}
+
+	userID := currentUserID(r)
+	target, err := scanBook(db.DB.QueryRow("SELECT "+bookColumns+bookFrom+" WHERE b.id = ?", userID, targetID))
+	if err != nil {
+		http.Error(w, "Book not found", http.StatusNotFound)
+		return
+	}
+	formats, err := loadBookFormats(targetID)
+	if err != nil {
+		http.Error(w, "Failed to merge books", http.StatusInternalServerError)
+		return
+	}
+	owner := map[string]string{}
+	for _, f := range formats {
+		owner[f.FileType] = targetID
+	}
+
+	var sources []models.Book
+	var records []*bookRecord
+	var moved []bookFormat
+	for _, sourceID := range input.Books {
+		source, err := scanBook(db.DB.QueryRow("SELECT "+bookColumns+bookFrom+" WHERE b.id = ?", userID, sourceID))
+		if err != nil {
+			http.Error(w, "Book not found: "+sourceID, http.StatusNotFound)
+			return
+		}
+		if source.LibraryID != target.LibraryID {
+			http.Error(w, "Only books in the same library can be merged", http.StatusBadRequest)
+			return
+		}
+		sourceFormats, err := loadBookFormats(sourceID)
+		if err != nil {
+			http.Error(w, "Failed to merge books", http.StatusInternalServerError)
+			return
+		}
+		for _, f := range sourceFormats {
+			if _, taken := owner[f.FileType]; taken {
+				http.Error(w, "More than one of the books has the "+formatNames[f.FileType]+" format; delete one of those files first", http.StatusConflict)
+				return
+			}
+			owner[f.FileType] = sourceID
+			moved = append(moved, f)
+		}
+		sources = append(sources, source)
+		if record, err := loadBookRecord(sourceID); err == nil {
+			records = append(records, record)
+		}
+	}
+	if input.Primary != "" {
+		if _, ok := owner[input.Primary]; !ok {
+			http.Error(w, "None of the books has the "+input.Primary+" format", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Files the sources own are moved into the target's storage directory, so
+	// that they are removed with it.
+	targetDir := bookStorageDir(targetID)
+	var renamed [][2]string
+	undo := func() {
+		for _, rename := range renamed {
+			os.Rename(rename[1], rename[0])
+		}
+	}
+	move := func(sourceID, from string) (string, error) {
+		if !inStorageDir(sourceID, from) {
+			return from, nil
+		}
+		if err := os.MkdirAll(targetDir, 0755); err != nil {
+			return "", err
+		}
+		to := filepath.Join(targetDir, filepath.Base(from))
+		if _, err := os.Stat(to); err == nil {
+			to = filepath.Join(targetDir, sourceID+"-"+filepath.Base(from))
+		}
+		if err := os.Rename(from, to); err != nil {
+			return "", err
+		}
+		renamed = append(renamed, [2]string{from, to})
+		return to, nil
+	}
+	for i, f := range moved {
+		newPath, err := move(f.BookID, f.FilePath)
+		if err != nil {
+			undo()
+			log.Printf("MergeBooks: failed to move %s: %v", f.FilePath, err)
+			http.Error(w, "Failed to merge books", http.StatusInternalServerError)
+			return
+		}
+		moved[i].FilePath = newPath
+	}
+	coverPath := target.CoverPath
+	for _, source := range sources {
+		if coverPath != "" || source.CoverPath == "" {
+			continue
+		}
+		if coverPath, err = move(source.ID, source.CoverPath); err != nil {
+			coverPath = ""
+		}
+	}
+
+	if err := mergeBookRows(targetID, sources, moved, coverPath, input.Primary); err != nil {
+		undo()
+		log.Printf("MergeBooks: failed to merge into %s: %v", targetID, err)
+		http.Error(w, "Failed to merge books", http.StatusInternalServerError)
+		return
+	}
+	for _, source := range sources {
+		removeBookStorage(source.ID)
+	}
+	// The position kept with the book has to be in its main format
+	if err := refreshBookProgress(targetID); err != nil {
+		log.Printf("MergeBooks: failed to resolve progress for %s: %v", targetID, err)
+	}
+
+	after, _ := loadBookRecord(targetID)
+	recordAudit(r, AuditBookMerge, "book", targetID, map[string]any{"merged": input.Books, "books": records}, after)
+	if owner["epub"] != targetID {
+		if epubPath, err := bookFormatPath(targetID, "epub"); err == nil {
+			validateNewBook(targetID, epubPath, "epub")
+		}
+	}
+
+	book, err := scanBook(db.DB.QueryRow("SELECT "+bookColumns+bookFrom+" WHERE b.id = ?", userID, targetID))
+	if err != nil {
+		http.Error(w, "Failed to fetch book", http.StatusInternalServerError)
+		return
+	}
+	loadBookMetadata(&book)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(book)
+}
+
+// mergeBookRows moves the sources' formats and everyone's reading data to the
+// target and deletes the sources, in one transaction. Device positions keep
+// the format they were recorded in; where a device has a position in the
+// same format for both, the more recent one wins.
+func mergeBookRows(targetID string, sources []models.Book, moved []bookFormat, coverPath, primary string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, f := range moved {
+		_, err := tx.Exec(
+			"UPDATE book_formats SET book_id = ?, file_path = ? WHERE book_id = ? AND file_type = ?",
+			targetID, f.FilePath, f.BookID, f.FileType,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, source := range sources {
+		for _, statement := range []string{
+			`DELETE FROM user_books WHERE book_id = ?1 AND user_id IN (
+				SELECT s.user_id FROM user_books s WHERE s.book_id = ?2 AND COALESCE(s.progress_updated_at, '') >
+					COALESCE((SELECT t.progress_updated_at FROM user_books t WHERE t.book_id = ?1 AND t.user_id = s.user_id), ''))`,
+			`DELETE FROM device_progress WHERE book_id = ?1 AND EXISTS (
+				SELECT 1 FROM device_progress s WHERE s.book_id = ?2 AND s.user_id = device_progress.user_id
+					AND s.device = device_progress.device AND s.format = device_progress.format
+					AND s.updated_at > device_progress.updated_at)`,
+			"UPDATE OR IGNORE user_books SET book_id = ?1 WHERE book_id = ?2",
+			"UPDATE OR IGNORE device_progress SET book_id = ?1 WHERE book_id = ?2",
+			"UPDATE OR IGNORE shelf_books SET book_id = ?1 WHERE book_id = ?2",
+			"UPDATE OR IGNORE book_tags SET book_id = ?1 WHERE book_id = ?2",
+			"UPDATE OR IGNORE book_identifiers SET book_id = ?1 WHERE book_id = ?2",
+			"UPDATE annotations SET book_id = ?1 WHERE book_id = ?2",
+			"UPDATE reading_sessions SET book_id = ?1 WHERE book_id = ?2",
+		} {
+			if _, err := tx.Exec(statement, targetID, source.ID); err != nil {
+				return err
+			}
+		}
+		for _, statement := range []string{
+			"DELETE FROM user_books WHERE book_id = ?",
+			"DELETE FROM device_progress WHERE book_id = ?",
+			"DELETE FROM shelf_books WHERE book_id = ?",
+			"DELETE FROM book_tags WHERE book_id = ?",
+			"DELETE FROM book_identifiers WHERE book_id = ?",
+			"DELETE FROM book_validations WHERE book_id = ?",
+			"DELETE FROM book_formats WHERE book_id = ?",
+			"DELETE FROM book_conversions WHERE book_id = ?",
+			"DELETE FROM books WHERE id = ?",
+		} {
+			if _, err := tx.Exec(statement, source.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE books SET cover_path = ? WHERE id = ?", coverPath, targetID); err != nil {
+		return err
+	}
+	if primary != "" {
+		_, err := tx.Exec(
+			`UPDATE books SET (file_path, file_size, file_type, file_hash) =
+				(SELECT file_path, file_size, file_type, file_hash FROM book_formats WHERE book_id = ?1 AND file_type = ?2)
+			WHERE id = ?1`,
+			targetID, primary,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -380,12 +380,26 @@ func ExtractCBZCover(cbzPath, coverDir string) string {
 	return coverPath
 }
 
+// copyFile copies src to dst, creating dst's directory.
 func copyFile(src, dst string) error {
-	data, err := os.ReadFile(src)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(dst, data, 0644)
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
 }
 
 // IsImageFile checks if data represents a valid image file by checking magic bytes.
@@ -0,0 +1,629 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	errEncryptedMOBI   = errors.New("the book is DRM-protected")
+	errUnsupportedMOBI = errors.New("the book uses HUFF/CDIC compression, which is not supported")
+)
+
+// mobiHeader is what a MOBI book's first record says about it. Offsets are
+// from the start of that record.
+type mobiHeader struct {
+	compression  uint16
+	textLength   uint32
+	textRecords  int
+	encryption   uint16
+	encoding     uint32
+	version      uint32
+	firstImage   int
+	fullName     string
+	extraFlags   uint16
+	fdst         int
+	exth         map[uint32][][]byte
+	hasMOBI      bool
+	headerLength uint32
+}
+
+// readPalmDB splits a Palm database, the container MOBI and AZW3 books are
+// stored in, into its records, returning them with the database's type and
+// creator.
+func readPalmDB(data []byte) ([][]byte, string, error) {
+	if len(data) < 78 {
+		return nil, "", fmt.Errorf("the file is too short to be a MOBI book")
+	}
+	kind := string(data[60:68])
+	count := int(binary.BigEndian.Uint16(data[76:78]))
+	if len(data) < 78+count*8 {
+		return nil, "", fmt.Errorf("the record list is truncated")
+	}
+
+	offsets := make([]int, count+1)
+	for i := range count {
+		offsets[i] = int(binary.BigEndian.Uint32(data[78+i*8:]))
+	}
+	offsets[count] = len(data)
+	records := make([][]byte, count)
+	for i := range count {
+		start, end := offsets[i], offsets[i+1]
+		if start > end || end > len(data) {
+			return nil, "", fmt.Errorf("record %d is out of bounds", i)
+		}
+		records[i] = data[start:end]
+	}
+	return records, kind, nil
+}
+
+func parseMOBIHeader(record []byte) (*mobiHeader, error) {
+	if len(record) < 16 {
+		return nil, fmt.Errorf("the first record is too short")
+	}
+	header := &mobiHeader{
+		compression: binary.BigEndian.Uint16(record[0:]),
+		textLength:  binary.BigEndian.Uint32(record[4:]),
+		textRecords: int(binary.BigEndian.Uint16(record[8:])),
+		encryption:  binary.BigEndian.Uint16(record[12:]),
+		encoding:    1252,
+		exth:        map[uint32][][]byte{},
+	}
+	if len(record) < 0x84 || string(record[16:20]) != "MOBI" {
+		return header, nil
+	}
+
+	u32 := func(offset int) uint32 {
+		if offset+4 > len(record) {
+			return 0
+		}
+		return binary.BigEndian.Uint32(record[offset:])
+	}
+	header.hasMOBI = true
+	header.headerLength = u32(0x14)
+	header.encoding = u32(0x1C)
+	header.version = u32(0x24)
+	header.firstImage = int(u32(0x6C))
+	if offset, length := int(u32(0x54)), int(u32(0x58)); offset+length <= len(record) {
+		header.fullName = string(record[offset : offset+length])
+	}
+	if header.headerLength >= 0xE4 && header.version >= 5 && len(record) >= 0xF4 {
+		header.extraFlags = binary.BigEndian.Uint16(record[0xF2:])
+	}
+	if header.version >= 8 {
+		header.fdst = int(u32(0xC0))
+	}
+
+	// EXTH holds the rest of the metadata
+	exth := 16 + int(header.headerLength)
+	if u32(0x80)&0x40 != 0 && exth+12 <= len(record) && string(record[exth:exth+4]) == "EXTH" {
+		count := int(binary.BigEndian.Uint32(record[exth+8:]))
+		offset := exth + 12
+		for range count {
+			if offset+8 > len(record) {
+				break
+			}
+			kind := binary.BigEndian.Uint32(record[offset:])
+			length := int(binary.BigEndian.Uint32(record[offset+4:]))
+			if length < 8 || offset+length > len(record) {
+				break
+			}
+			header.exth[kind] = append(header.exth[kind], record[offset+8:offset+length])
+			offset += length
+		}
+	}
+	return header, nil
+}
+
+// exthText is an EXTH text field, with values joined by " & ".
+func (h *mobiHeader) exthText(kind uint32) string {
+	var values []string
+	for _, value := range h.exth[kind] {
+		text, err := decodeCharset(h.charset(), value)
+		if err == nil && strings.TrimSpace(string(text)) != "" {
+			values = append(values, strings.TrimSpace(string(text)))
+		}
+	}
+	return strings.Join(values, " & ")
+}
+
+func (h *mobiHeader) charset() string {
+	if h.encoding == 65001 {
+		return "utf-8"
+	}
+	return "windows-1252"
+}
+
+// trailingEntriesSize is how many bytes at the end of a text record are not
+// text, going by the header's extra data flags.
+func trailingEntriesSize(record []byte, flags uint16) int {
+	size := 0
+	for bits := flags >> 1; bits != 0; bits >>= 1 {
+		if bits&1 == 0 {
+			continue
+		}
+		// Each entry ends with its size, written backwards seven bits at a time
+		end := len(record) - size
+		value, shift := 0, 0
+		for i := end - 1; i >= 0 && shift < 28; i-- {
+			b := record[i]
+			value |= int(b&0x7F) << shift
+			shift += 7
+			if b&0x80 != 0 {
+				break
+			}
+		}
+		size += value
+	}
+	if flags&1 != 0 && len(record) > size {
+		size += int(record[len(record)-size-1]&0x3) + 1
+	}
+	return min(size, len(record))
+}
+
+// palmDOCDecompress expands a text record compressed with PalmDOC's LZ77.
+func palmDOCDecompress(data []byte) []byte {
+	out := make([]byte, 0, 4096)
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c >= 1 && c <= 8:
+			// A run of literal bytes
+			end := min(i+1+int(c), len(data))
+			out = append(out, data[i+1:end]...)
+			i = end - 1
+		case c < 0x80:
+			out = append(out, c)
+		case c >= 0xC0:
+			// A space followed by a character
+			out = append(out, ' ', c^0x80)
+		default:
+			// A back reference
+			if i+1 >= len(data) {
+				return out
+			}
+			pair := int(c)<<8 | int(data[i+1])
+			i++
+			distance, length := (pair>>3)&0x7FF, (pair&7)+3
+			if distance == 0 || distance > len(out) {
+				continue
+			}
+			for range length {
+				out = append(out, out[len(out)-distance])
+			}
+		}
+	}
+	return out
+}
+
+// mobiImage reads the image in a record, naming it after the record.
+func mobiImage(records [][]byte, index int) (convertedImage, bool) {
+	if index <= 0 || index >= len(records) {
+		return convertedImage{}, false
+	}
+	data := records[index]
+	mediaType := http.DetectContentType(data)
+	extension := imageMediaExtensions[mediaType]
+	if extension == "" {
+		return convertedImage{}, false
+	}
+	return convertedImage{Name: fmt.Sprintf("image%05d%s", index, extension), MediaType: mediaType, Data: data}, true
+}
+
+var (
+	mobiFilepos     = regexp.MustCompile(`(?i)filepos\s*=\s*["']?0*(\d+)`)
+	mobiPageBreak   = regexp.MustCompile(`(?i)<mbp:pagebreak[^>]*>`)
+	fileposAnchorID = regexp.MustCompile(`id="filepos(\d+)"`)
+	fileposHref     = regexp.MustCompile(`href="#filepos(\d+)"`)
+	xmlDeclaration  = regexp.MustCompile(`<\?xml[^>]*\?>`)
+	kf8File         = regexp.MustCompile(`(?i)<html[\s>]`)
+)
+
+// convertMOBI reads an unencrypted MOBI or AZW3 book. Files holding both an
+// old-style MOBI book and a KF8 one, as KindleGen makes them, are read from
+// the MOBI part; KF8-only files have their text reassembled one file at a time
+// without their stylesheets or internal links.
+func convertMOBI(path string) (*convertedBook, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	records, kind, err := readPalmDB(data)
+	if err != nil {
+		return nil, err
+	}
+	if kind != "BOOKMOBI" && kind != "TEXtREAd" {
+		return nil, fmt.Errorf("not a MOBI book")
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("the book has no text")
+	}
+	header, err := parseMOBIHeader(records[0])
+	if err != nil {
+		return nil, err
+	}
+	if header.encryption != 0 {
+		return nil, errEncryptedMOBI
+	}
+
+	var text []byte
+	for i := 1; i <= header.textRecords && i < len(records); i++ {
+		record := records[i]
+		record = record[:len(record)-trailingEntriesSize(record, header.extraFlags)]
+		switch header.compression {
+		case 1:
+			text = append(text, record...)
+		case 2:
+			text = append(text, palmDOCDecompress(record)...)
+		case 17480:
+			return nil, errUnsupportedMOBI
+		default:
+			return nil, fmt.Errorf("unknown compression %d", header.compression)
+		}
+	}
+	if int(header.textLength) < len(text) {
+		text = text[:header.textLength]
+	}
+
+	fullName, err := decodeCharset(header.charset(), []byte(header.fullName))
+	if err != nil {
+		return nil, err
+	}
+	book := &convertedBook{
+		Title:       firstOf(header.exthText(503), strings.TrimSpace(string(fullName))),
+		Author:      header.exthText(100),
+		Publisher:   header.exthText(101),
+		Description: plainText(header.exthText(103)),
+		Language:    header.exthText(524),
+	}
+
+	// Images are numbered from the first image record: from 0 for the cover,
+	// from 1 in the text
+	images := map[int]string{}
+	image := func(index int) string {
+		if name, ok := images[index]; ok {
+			return name
+		}
+		found, ok := mobiImage(records, header.firstImage+index)
+		if !ok {
+			images[index] = ""
+			return ""
+		}
+		images[index] = found.Name
+		book.Images = append(book.Images, found)
+		return found.Name
+	}
+	if covers := header.exth[201]; len(covers) > 0 && len(covers[0]) == 4 {
+		book.Cover = image(int(binary.BigEndian.Uint32(covers[0])))
+	}
+
+	if !header.hasMOBI {
+		// A plain PalmDOC text
+		decoded, err := decodeCharset(header.charset(), text)
+		if err != nil {
+			return nil, err
+		}
+		var body strings.Builder
+		for _, paragraph := range strings.Split(strings.ReplaceAll(string(decoded), "\r\n", "\n"), "\n") {
+			if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+				body.WriteString("<p>" + html.EscapeString(paragraph) + "</p>\n")
+			}
+		}
+		book.Chapters = []convertedChapter{{Body: body.String()}}
+		return book, nil
+	}
+
+	var parts []string
+	cleaner := &xhtmlCleaner{}
+	if header.version >= 8 {
+		// Past the first flow are stylesheets and other resources
+		if header.fdst > 0 && header.fdst < len(records) {
+			fdst := records[header.fdst]
+			if len(fdst) >= 20 && string(fdst[:4]) == "FDST" {
+				start, end := int(binary.BigEndian.Uint32(fdst[12:])), int(binary.BigEndian.Uint32(fdst[16:]))
+				if start <= end && end <= len(text) {
+					text = text[start:end]
+				}
+			}
+		}
+		decoded, err := decodeCharset(header.charset(), text)
+		if err != nil {
+			return nil, err
+		}
+		source := xmlDeclaration.ReplaceAllString(string(decoded), "")
+		starts := kf8File.FindAllStringIndex(source, -1)
+		if len(starts) == 0 {
+			parts = []string{source}
+		}
+		for i, start := range starts {
+			end := len(source)
+			if i+1 < len(starts) {
+				end = starts[i+1][0]
+			}
+			parts = append(parts, source[start[0]:end])
+		}
+		cleaner.imageSrc = func(attrs map[string]string) string {
+			// kindle:embed:XXXX?mime=... names an image by its base-32 number
+			reference, ok := strings.CutPrefix(attrs["src"], "kindle:embed:")
+			if !ok {
+				return ""
+			}
+			reference, _, _ = strings.Cut(reference, "?")
+			index, err := strconv.ParseInt(reference, 32, 32)
+			if err != nil {
+				return ""
+			}
+			return image(int(index) - 1)
+		}
+	} else {
+		text = insertFileposAnchors(text)
+		decoded, err := decodeCharset(header.charset(), text)
+		if err != nil {
+			return nil, err
+		}
+		parts = mobiPageBreak.Split(string(decoded), -1)
+		cleaner.imageSrc = func(attrs map[string]string) string {
+			index, err := strconv.Atoi(attrs["recindex"])
+			if err != nil {
+				return ""
+			}
+			return image(index - 1)
+		}
+		cleaner.linkHref = func(attrs map[string]string) string {
+			position, err := strconv.Atoi(strings.Trim(attrs["filepos"], `"' `))
+			if err != nil {
+				return ""
+			}
+			return "#filepos" + strconv.Itoa(position)
+		}
+	}
+
+	for _, part := range parts {
+		body, title := cleaner.clean(part)
+		if !strings.Contains(body, "<img") && strings.TrimSpace(html.UnescapeString(htmlTag.ReplaceAllString(body, ""))) == "" {
+			continue
+		}
+		book.Chapters = append(book.Chapters, convertedChapter{Title: title, Body: body})
+	}
+
+	// Point links at the chapters their targets ended up in
+	files := map[string]string{}
+	for i, chapter := range book.Chapters {
+		for _, match := range fileposAnchorID.FindAllStringSubmatch(chapter.Body, -1) {
+			files[match[1]] = chapterFile(i)
+		}
+	}
+	for i := range book.Chapters {
+		book.Chapters[i].Body = fileposHref.ReplaceAllStringFunc(book.Chapters[i].Body, func(href string) string {
+			position := fileposHref.FindStringSubmatch(href)[1]
+			if file := files[position]; file != "" {
+				return `href="` + file + `#filepos` + position + `"`
+			}
+			return `href="#"`
+		})
+	}
+	return book, nil
+}
+
+// insertFileposAnchors adds an anchor at each position in a MOBI book's text
+// that a filepos link points to, moving it out of any tag it falls in.
+func insertFileposAnchors(text []byte) []byte {
+	var positions []int
+	seen := map[int]bool{}
+	for _, match := range mobiFilepos.FindAllSubmatch(text, -1) {
+		position, err := strconv.Atoi(string(match[1]))
+		if err == nil && position <= len(text) && !seen[position] {
+			seen[position] = true
+			positions = append(positions, position)
+		}
+	}
+	slices.Sort(positions)
+
+	var out bytes.Buffer
+	previous := 0
+	for _, original := range positions {
+		position := original
+		if open := bytes.LastIndexByte(text[:position], '<'); open > bytes.LastIndexByte(text[:position], '>') {
+			if end := bytes.IndexByte(text[position:], '>'); end >= 0 {
+				position += end + 1
+			}
+		}
+		if loc := mobiPageBreak.FindIndex(text[position:]); loc != nil && loc[0] == 0 {
+			position += loc[1]
+		}
+		if position < previous {
+			position = previous
+		}
+		out.Write(text[previous:position])
+		fmt.Fprintf(&out, `<a id="filepos%d"></a>`, original)
+		previous = position
+	}
+	out.Write(text[previous:])
+	return out.Bytes()
+}
+
+// xhtmlCleaner turns the loose HTML in MOBI and KF8 books into XHTML, keeping
+// the structure and dropping presentation it has no stylesheet for.
+type xhtmlCleaner struct {
+	// imageSrc names the image an img element shows, or returns "" to drop it
+	imageSrc func(attrs map[string]string) string
+	// linkHref gives the target of a link that is not to a web page
+	linkHref func(attrs map[string]string) string
+}
+
+// xhtmlRenamed maps elements that XHTML lacks to ones it has.
+var xhtmlRenamed = map[string]string{
+	"font":   "span",
+	"big":    "span",
+	"center": "div",
+	"tt":     "code",
+	"strike": "del",
+}
+
+var xhtmlKept = map[string]bool{
+	"p": true, "div": true, "span": true, "a": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"em": true, "strong": true, "i": true, "b": true, "u": true, "s": true, "sub": true, "sup": true, "small": true,
+	"br": true, "hr": true, "img": true, "blockquote": true, "pre": true, "code": true, "cite": true, "q": true,
+	"del": true, "ins": true, "abbr": true, "ul": true, "ol": true, "li": true, "dl": true, "dt": true, "dd": true,
+	"table": true, "thead": true, "tbody": true, "tfoot": true, "tr": true, "td": true, "th": true, "caption": true,
+	"section": true, "article": true, "aside": true, "header": true, "footer": true, "figure": true, "figcaption": true,
+}
+
+// xhtmlDropped are elements left out along with everything in them.
+var xhtmlDropped = map[string]bool{
+	"head": true, "script": true, "style": true, "title": true, "guide": true, "svg": true,
+	"object": true, "embed": true, "iframe": true, "form": true, "noscript": true, "template": true,
+}
+
+var xhtmlVoid = map[string]bool{"br": true, "hr": true, "img": true}
+
+// clean returns a fragment of HTML as the XHTML for a chapter's body, along
+// with the text of its first heading. Whatever follows HTML too broken to
+// read is kept as plain paragraphs.
+func (c *xhtmlCleaner) clean(source string) (string, string) {
+	decoder := xml.NewDecoder(strings.NewReader(source))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+	decoder.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) { return input, nil }
+
+	var out strings.Builder
+	var title strings.Builder
+	// open holds what each open element was written as, "" if it was not
+	var open []string
+	dropping, heading := 0, 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if err != io.EOF {
+				rest := source[min(int(decoder.InputOffset()), len(source)):]
+				for _, paragraph := range strings.Split(plainText(rest), "\n\n") {
+					if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+						out.WriteString("<p>" + html.EscapeString(paragraph) + "</p>\n")
+					}
+				}
+			}
+			break
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			foreign := t.Name.Space != "" && t.Name.Space != "http://www.w3.org/1999/xhtml"
+			if dropping > 0 || xhtmlDropped[name] || (foreign && t.Name.Space != "mbp") {
+				dropping++
+				continue
+			}
+			attrs := map[string]string{}
+			for _, attr := range t.Attr {
+				attrs[strings.ToLower(attr.Name.Local)] = attr.Value
+			}
+
+			tag := name
+			if renamed, ok := xhtmlRenamed[name]; ok {
+				tag = renamed
+			}
+			if foreign || !xhtmlKept[tag] {
+				open = append(open, "")
+				continue
+			}
+			var written strings.Builder
+			written.WriteString("<" + tag)
+			if id := firstOf(attrs["id"], attrs["name"]); id != "" && tag != "img" {
+				written.WriteString(` id="` + html.EscapeString(id) + `"`)
+			}
+			switch tag {
+			case "img":
+				src := ""
+				if c.imageSrc != nil {
+					src = c.imageSrc(attrs)
+				}
+				if src == "" {
+					open = append(open, "")
+					continue
+				}
+				written.WriteString(` src="images/` + html.EscapeString(src) + `" alt="` + html.EscapeString(attrs["alt"]) + `"`)
+			case "a":
+				href := attrs["href"]
+				if !strings.HasPrefix(href, "http://") && !strings.HasPrefix(href, "https://") && !strings.HasPrefix(href, "mailto:") {
+					href = ""
+					if c.linkHref != nil {
+						href = c.linkHref(attrs)
+					}
+				}
+				if href != "" {
+					written.WriteString(` href="` + html.EscapeString(href) + `"`)
+				}
+			case "td", "th":
+				for _, name := range []string{"colspan", "rowspan"} {
+					if value := attrs[name]; value != "" {
+						written.WriteString(" " + name + `="` + html.EscapeString(value) + `"`)
+					}
+				}
+			}
+			align := strings.ToLower(attrs["align"])
+			if name == "center" {
+				align = "center"
+			}
+			if align == "left" || align == "right" || align == "center" || align == "justify" {
+				written.WriteString(` style="text-align: ` + align + `"`)
+			}
+
+			if xhtmlVoid[tag] {
+				out.WriteString(written.String() + "/>")
+				open = append(open, "")
+				continue
+			}
+			out.WriteString(written.String() + ">")
+			open = append(open, tag)
+			if len(tag) == 2 && tag[0] == 'h' && tag[1] >= '1' && tag[1] <= '6' && title.Len() == 0 {
+				heading++
+			}
+		case xml.EndElement:
+			if dropping > 0 {
+				dropping--
+				continue
+			}
+			if len(open) == 0 {
+				continue
+			}
+			tag := open[len(open)-1]
+			open = open[:len(open)-1]
+			if tag == "" {
+				continue
+			}
+			out.WriteString("</" + tag + ">")
+			if heading > 0 && len(tag) == 2 && tag[0] == 'h' {
+				heading--
+				if heading == 0 && strings.TrimSpace(title.String()) == "" {
+					title.Reset()
+				}
+			}
+		case xml.CharData:
+			if dropping > 0 {
+				continue
+			}
+			out.WriteString(xmlText(string(t)))
+			if heading > 0 {
+				title.Write(t)
+			}
+		}
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		if open[i] != "" {
+			out.WriteString("</" + open[i] + ">")
+		}
+	}
+	return out.String(), strings.Join(strings.Fields(title.String()), " ")
+}
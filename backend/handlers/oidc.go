@@ -0,0 +1,580 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OIDCConfig configures single sign-on through an OpenID Connect provider.
+type OIDCConfig struct {
+	// Name is shown on the sign-in button.
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	// UsernameClaim names the claim used as the Bookland username.
+	UsernameClaim string
+	// RolesClaim names a string or string array claim, usually groups, that
+	// RoleMap translates into a Bookland role.
+	RolesClaim string
+	RoleMap    map[string]string
+	// DefaultRole is given to users none of whose groups are mapped. When
+	// empty, such users are turned away.
+	DefaultRole string
+	// LinkByUsername lets a provider account take over an existing local
+	// account with the same username.
+	LinkByUsername bool
+}
+
+// OIDC is the configured provider, or nil when single sign-on is disabled.
+var OIDC *OIDCConfig
+
+const (
+	oidcCookieName   = "bookland_oidc"
+	oidcLoginTimeout = 10 * time.Minute
+	oidcClockSkew    = 2 * time.Minute
+)
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+var errOIDCNotAllowed = errors.New("no role for provider account")
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcState holds what the provider's discovery document and signing keys
+// said, fetched on first use.
+var oidcState struct {
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+	keysAt    time.Time
+}
+
+// pendingLogin is a login that has been sent to the provider and not come back yet.
+type pendingLogin struct {
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+var pendingLogins = struct {
+	mu     sync.Mutex
+	logins map[string]pendingLogin
+}{logins: make(map[string]pendingLogin)}
+
+func discoverOIDC() (*oidcDiscovery, error) {
+	oidcState.mu.Lock()
+	defer oidcState.mu.Unlock()
+	if oidcState.discovery != nil {
+		return oidcState.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := getJSON(strings.TrimSuffix(OIDC.Issuer, "/")+"/.well-known/openid-configuration", "", &discovery); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if discovery.Issuer != OIDC.Issuer {
+		return nil, fmt.Errorf("discovery: issuer %q does not match configured %q", discovery.Issuer, OIDC.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("discovery: provider is missing required endpoints")
+	}
+	oidcState.discovery = &discovery
+	return &discovery, nil
+}
+
+func getJSON(endpoint, accessToken string, v any) error {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// signingKey returns the provider's RSA key with the given ID, refetching the
+// key set when an unknown key turns up so rotated keys are picked up.
+func signingKey(discovery *oidcDiscovery, kid string) (*rsa.PublicKey, error) {
+	oidcState.mu.Lock()
+	defer oidcState.mu.Unlock()
+
+	if key, ok := oidcState.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(oidcState.keysAt) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(discovery.JWKSURI, "", &set); err != nil {
+		return nil, fmt.Errorf("fetching signing keys: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			continue
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}
+	}
+	oidcState.keys = keys
+	oidcState.keysAt = time.Now()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// verifyIDToken checks an RS256-signed ID token against the provider's keys
+// and the standard claims, returning its claims.
+func verifyIDToken(discovery *oidcDiscovery, token, nonce string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("ID token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+
+	key, err := signingKey(discovery, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("invalid ID token signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("ID token claims: %w", err)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != OIDC.Issuer {
+		return nil, fmt.Errorf("ID token issued by %q", iss)
+	}
+	if !slices.Contains(stringsClaim(claims, "aud"), OIDC.ClientID) {
+		return nil, errors.New("ID token is for another client")
+	}
+	now := time.Now()
+	exp, _ := claims["exp"].(float64)
+	if now.After(time.Unix(int64(exp), 0).Add(oidcClockSkew)) {
+		return nil, errors.New("ID token has expired")
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// stringsClaim reads a claim that may be a single string or a list of strings.
+func stringsClaim(claims map[string]any, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// mappedRole picks the most privileged role any of the user's groups maps to,
+// falling back to the default role.
+func mappedRole(claims map[string]any) string {
+	groups := stringsClaim(claims, OIDC.RolesClaim)
+	for _, role := range []string{RoleAdmin, RoleEditor, RoleReader, RoleGuest} {
+		for _, group := range groups {
+			if OIDC.RoleMap[group] == role {
+				return role
+			}
+		}
+	}
+	return OIDC.DefaultRole
+}
+
+// OIDCLogin starts an authorization-code login with PKCE by sending the
+// browser to the provider.
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if OIDC == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	discovery, err := discoverOIDC()
+	if err != nil {
+		log.Printf("OIDC: %v", err)
+		http.Error(w, "Identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state, err1 := randomToken()
+	nonce, err2 := randomToken()
+	verifier, err3 := randomToken()
+	if err := errors.Join(err1, err2, err3); err != nil {
+		http.Error(w, "Failed to start sign-in", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	pendingLogins.mu.Lock()
+	for key, login := range pendingLogins.logins {
+		if now.After(login.expires) {
+			delete(pendingLogins.logins, key)
+		}
+	}
+	pendingLogins.logins[state] = pendingLogin{nonce: nonce, verifier: verifier, expires: now.Add(oidcLoginTimeout)}
+	pendingLogins.mu.Unlock()
+
+	// Tie the login to this browser so a callback started elsewhere is refused.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    state,
+		Path:     "/api/auth/oidc",
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {OIDC.ClientID},
+		"redirect_uri":          {OIDC.RedirectURL},
+		"scope":                 {strings.Join(OIDC.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	target := discovery.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + query.Encode()
+	} else {
+		target += "?" + query.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// OIDCCallback finishes a login: it redeems the code, verifies the ID token,
+// finds or creates the matching user and starts a session.
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if OIDC == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		log.Printf("OIDC: provider returned %s: %s", errCode, query.Get("error_description"))
+		http.Error(w, "Sign-in was not completed", http.StatusUnauthorized)
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil || state == "" || cookie.Value != state {
+		http.Error(w, "Sign-in state does not match; please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookieName, Value: "", Path: "/api/auth/oidc", MaxAge: -1, HttpOnly: true})
+
+	pendingLogins.mu.Lock()
+	login, ok := pendingLogins.logins[state]
+	delete(pendingLogins.logins, state)
+	pendingLogins.mu.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		http.Error(w, "Sign-in has expired; please try again", http.StatusBadRequest)
+		return
+	}
+
+	discovery, err := discoverOIDC()
+	if err != nil {
+		log.Printf("OIDC: %v", err)
+		http.Error(w, "Identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	claims, err := redeemCode(discovery, query.Get("code"), login)
+	if err != nil {
+		log.Printf("OIDC: %v", err)
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := userForClaims(claims)
+	switch {
+	case err == errOIDCNotAllowed:
+		http.Error(w, "Your account is not allowed to use this library", http.StatusForbidden)
+		return
+	case err == errUsernameTaken:
+		http.Error(w, "Your username is already used by a local account", http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("OIDC: %v", err)
+		http.Error(w, "Sign-in failed", http.StatusInternalServerError)
+		return
+	}
+
+	if err := createSession(w, r, user.ID); err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// redeemCode exchanges an authorization code for tokens and returns the
+// verified ID token claims, topped up from the userinfo endpoint when the
+// username or roles claims are missing.
+func redeemCode(discovery *oidcDiscovery, code string, login pendingLogin) (map[string]any, error) {
+	if code == "" {
+		return nil, errors.New("callback has no code")
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {OIDC.RedirectURL},
+		"client_id":     {OIDC.ClientID},
+		"code_verifier": {login.verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if OIDC.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(OIDC.ClientID), url.QueryEscape(OIDC.ClientSecret))
+	}
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("token request returned %s: %s", resp.Status, body)
+	}
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response has no ID token")
+	}
+
+	claims, err := verifyIDToken(discovery, tokens.IDToken, login.nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	_, hasUsername := claims[OIDC.UsernameClaim]
+	_, hasRoles := claims[OIDC.RolesClaim]
+	if (!hasUsername || (!hasRoles && len(OIDC.RoleMap) > 0)) && discovery.UserinfoEndpoint != "" && tokens.AccessToken != "" {
+		var info map[string]any
+		if err := getJSON(discovery.UserinfoEndpoint, tokens.AccessToken, &info); err != nil {
+			log.Printf("OIDC: userinfo: %v", err)
+		} else if info["sub"] == claims["sub"] {
+			for name, value := range info {
+				if _, ok := claims[name]; !ok {
+					claims[name] = value
+				}
+			}
+		}
+	}
+	return claims, nil
+}
+
+// userForClaims returns the user linked to the provider account, creating
+// one on first sign-in and keeping its role in step with the provider.
+func userForClaims(claims map[string]any) (*models.User, error) {
+	subject, _ := claims["sub"].(string)
+	username, _ := claims[OIDC.UsernameClaim].(string)
+	username = strings.TrimSpace(username)
+	if username == "" {
+		username = subject
+	}
+	if len(username) > maxUsernameLength {
+		username = username[:maxUsernameLength]
+	}
+
+	role := mappedRole(claims)
+	if role == "" {
+		return nil, errOIDCNotAllowed
+	}
+
+	var user models.User
+	err := db.DB.QueryRow(
+		"SELECT id, username, role, created_at FROM users WHERE oidc_issuer = ? AND oidc_subject = ?",
+		OIDC.Issuer, subject,
+	).Scan(&user.ID, &user.Username, &user.Role, &user.CreatedAt)
+	if err == sql.ErrNoRows && OIDC.LinkByUsername {
+		err = db.DB.QueryRow(
+			"SELECT id, username, role, created_at FROM users WHERE username = ? AND oidc_subject IS NULL",
+			username,
+		).Scan(&user.ID, &user.Username, &user.Role, &user.CreatedAt)
+		if err == nil {
+			_, err = db.DB.Exec("UPDATE users SET oidc_issuer = ?, oidc_subject = ? WHERE id = ?", OIDC.Issuer, subject, user.ID)
+		}
+	}
+
+	switch {
+	case err == sql.ErrNoRows:
+		return createOIDCUser(username, subject, role)
+	case err != nil:
+		return nil, err
+	}
+
+	if len(OIDC.RoleMap) > 0 && user.Role != role {
+		if user.Role == RoleAdmin {
+			if last, err := isLastAdmin(user.ID); err != nil || last {
+				log.Printf("OIDC: keeping %s as the last administrator despite provider role %s", user.Username, role)
+				return &user, nil
+			}
+		}
+		if _, err := db.DB.Exec("UPDATE users SET role = ? WHERE id = ?", role, user.ID); err != nil {
+			return nil, err
+		}
+		user.Role = role
+		passwordCache.forget(user.ID)
+	}
+	return &user, nil
+}
+
+// createOIDCUser adds an account that can only sign in through the provider.
+// Like the first local account, the first account overall administers the
+// library and takes over reading data from before accounts existed.
+func createOIDCUser(username, subject, role string) (*models.User, error) {
+	user := models.User{ID: uuid.New().String(), Username: username, Role: RoleAdmin, CreatedAt: time.Now()}
+	insert := func(condition string) (sql.Result, error) {
+		return db.DB.Exec(
+			`INSERT INTO users (id, username, password_hash, role, oidc_issuer, oidc_subject, created_at)
+			SELECT ?, ?, '', ?, ?, ?, ? `+condition,
+			user.ID, user.Username, user.Role, OIDC.Issuer, subject, user.CreatedAt,
+		)
+	}
+
+	// Try it as the first account, then as any other
+	var first bool
+	result, err := insert(noUsersYet)
+	if err == nil {
+		var n int64
+		n, err = result.RowsAffected()
+		first = n > 0
+	}
+	if err == nil && !first {
+		user.Role = role
+		_, err = insert("")
+	}
+	if err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "unique") {
+			return nil, errUsernameTaken
+		}
+		return nil, err
+	}
+	if err := grantLibraries(user.ID, []string{DefaultLibraryID}); err != nil {
+		return nil, err
+	}
+
+	if first {
+		if err := claimLegacyData(user.ID); err != nil {
+			log.Printf("Failed to assign existing reading data to %s: %v", user.Username, err)
+		}
+	}
+	return &user, nil
+}
@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"bookland/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// openLibraryProvider looks books up on openlibrary.org. Candidates are
+// editions, so that they carry the ISBN and cover of one printing; the
+// description and subjects come from the work they belong to.
+type openLibraryProvider struct {
+	baseURL   string
+	coversURL string
+}
+
+func (p *openLibraryProvider) Name() string { return "openlibrary" }
+
+type openLibraryEdition struct {
+	Key         string          `json:"key"`
+	Title       string          `json:"title"`
+	Subtitle    string          `json:"subtitle"`
+	Authors     []olKey         `json:"authors"`
+	Works       []olKey         `json:"works"`
+	ISBN13      []string        `json:"isbn_13"`
+	ISBN10      []string        `json:"isbn_10"`
+	Covers      []int           `json:"covers"`
+	Publishers  []string        `json:"publishers"`
+	PublishDate string          `json:"publish_date"`
+	Series      []string        `json:"series"`
+	Description json.RawMessage `json:"description"`
+	Subjects    []string        `json:"subjects"`
+}
+
+type openLibraryWork struct {
+	Key         string          `json:"key"`
+	Title       string          `json:"title"`
+	Description json.RawMessage `json:"description"`
+	Subjects    []string        `json:"subjects"`
+	Covers      []int           `json:"covers"`
+	Authors     []struct {
+		Author olKey `json:"author"`
+	} `json:"authors"`
+}
+
+type olKey struct {
+	Key string `json:"key"`
+}
+
+// olText reads Open Library's text fields, which are either a string or an
+// object with a value.
+func olText(raw json.RawMessage) string {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return strings.TrimSpace(text)
+	}
+	var typed struct {
+		Value string `json:"value"`
+	}
+	if json.Unmarshal(raw, &typed) == nil {
+		return strings.TrimSpace(typed.Value)
+	}
+	return ""
+}
+
+// olID returns the last part of an Open Library key such as /books/OL1M.
+func olID(key string) string {
+	return key[strings.LastIndex(key, "/")+1:]
+}
+
+func (p *openLibraryProvider) coverURL(id int) string {
+	if id <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s/b/id/%d-L.jpg?default=false", p.coversURL, id)
+}
+
+func (p *openLibraryProvider) Search(ctx context.Context, query models.MetadataQuery) ([]models.MetadataCandidate, error) {
+	if query.ISBN != "" {
+		var edition openLibraryEdition
+		err := metadataJSON(ctx, p.baseURL+"/isbn/"+url.PathEscape(query.ISBN)+".json", &edition)
+		if err == errCandidateNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		candidate := p.fromEdition(&edition)
+		candidate.Author = p.authorNames(ctx, edition.Authors)
+		return []models.MetadataCandidate{*candidate}, nil
+	}
+
+	params := url.Values{}
+	params.Set("title", query.Title)
+	if query.Author != "" {
+		params.Set("author", query.Author)
+	}
+	params.Set("limit", strconv.Itoa(maxMetadataResults))
+	params.Set("fields", "key,title,author_name,first_publish_year,cover_i,edition_key,publisher,subject")
+
+	var response struct {
+		Docs []struct {
+			Key              string   `json:"key"`
+			Title            string   `json:"title"`
+			AuthorName       []string `json:"author_name"`
+			FirstPublishYear int      `json:"first_publish_year"`
+			CoverID          int      `json:"cover_i"`
+			EditionKey       []string `json:"edition_key"`
+			Publisher        []string `json:"publisher"`
+			Subject          []string `json:"subject"`
+		} `json:"docs"`
+	}
+	if err := metadataJSON(ctx, p.baseURL+"/search.json?"+params.Encode(), &response); err != nil {
+		return nil, err
+	}
+
+	candidates := make([]models.MetadataCandidate, 0, len(response.Docs))
+	for _, doc := range response.Docs {
+		// A search hit is a work; its first edition stands in for it.
+		id := olID(doc.Key)
+		if len(doc.EditionKey) > 0 {
+			id = doc.EditionKey[0]
+		}
+		candidate := models.MetadataCandidate{
+			Provider:    p.Name(),
+			ID:          id,
+			Title:       doc.Title,
+			Author:      strings.Join(doc.AuthorName, " & "),
+			CoverURL:    p.coverURL(doc.CoverID),
+			Identifiers: map[string]string{"openlibrary": id},
+		}
+		if len(doc.Publisher) > 0 {
+			candidate.Publisher = doc.Publisher[0]
+		}
+		if doc.FirstPublishYear > 0 {
+			candidate.PublishedDate = strconv.Itoa(doc.FirstPublishYear)
+		}
+		if len(doc.Subject) > 10 {
+			doc.Subject = doc.Subject[:10]
+		}
+		candidate.Tags = doc.Subject
+		candidates = append(candidates, candidate)
+	}
+	return candidates, nil
+}
+
+func (p *openLibraryProvider) fromEdition(edition *openLibraryEdition) *models.MetadataCandidate {
+	id := olID(edition.Key)
+	candidate := &models.MetadataCandidate{
+		Provider:      p.Name(),
+		ID:            id,
+		Title:         edition.Title,
+		Description:   olText(edition.Description),
+		PublishedDate: edition.PublishDate,
+		Tags:          edition.Subjects,
+		Identifiers:   map[string]string{"openlibrary": id},
+	}
+	if edition.Subtitle != "" {
+		candidate.Title += ": " + edition.Subtitle
+	}
+	if len(edition.Publishers) > 0 {
+		candidate.Publisher = edition.Publishers[0]
+	}
+	if len(edition.Series) > 0 {
+		candidate.Series = edition.Series[0]
+	}
+	if isbn := firstOf(append(edition.ISBN13, edition.ISBN10...)...); isbn != "" {
+		candidate.Identifiers["isbn"] = isbn
+	}
+	if len(edition.Covers) > 0 {
+		candidate.CoverURL = p.coverURL(edition.Covers[0])
+	}
+	return candidate
+}
+
+// authorNames looks up the names of up to five authors.
+func (p *openLibraryProvider) authorNames(ctx context.Context, keys []olKey) string {
+	var names []string
+	for i, key := range keys {
+		if i == 5 {
+			break
+		}
+		var author struct {
+			Name string `json:"name"`
+		}
+		if metadataJSON(ctx, p.baseURL+key.Key+".json", &author) == nil && author.Name != "" {
+			names = append(names, author.Name)
+		}
+	}
+	return strings.Join(names, " & ")
+}
+
+func (p *openLibraryProvider) Details(ctx context.Context, id string) (*models.MetadataCandidate, error) {
+	if strings.ContainsAny(id, "/?#") {
+		return nil, errCandidateNotFound
+	}
+
+	var candidate *models.MetadataCandidate
+	var work openLibraryWork
+	switch {
+	case strings.HasSuffix(id, "M"):
+		var edition openLibraryEdition
+		if err := metadataJSON(ctx, p.baseURL+"/books/"+id+".json", &edition); err != nil {
+			return nil, err
+		}
+		candidate = p.fromEdition(&edition)
+		candidate.Author = p.authorNames(ctx, edition.Authors)
+		if len(edition.Works) > 0 {
+			if err := metadataJSON(ctx, p.baseURL+edition.Works[0].Key+".json", &work); err != nil {
+				return nil, err
+			}
+		}
+	case strings.HasSuffix(id, "W"):
+		if err := metadataJSON(ctx, p.baseURL+"/works/"+id+".json", &work); err != nil {
+			return nil, err
+		}
+		candidate = &models.MetadataCandidate{
+			Provider:    p.Name(),
+			ID:          id,
+			Title:       work.Title,
+			Identifiers: map[string]string{"openlibrary": id},
+		}
+		if len(work.Covers) > 0 {
+			candidate.CoverURL = p.coverURL(work.Covers[0])
+		}
+	default:
+		return nil, errCandidateNotFound
+	}
+
+	if candidate.Description == "" {
+		candidate.Description = olText(work.Description)
+	}
+	if len(candidate.Tags) == 0 {
+		candidate.Tags = work.Subjects
+	}
+	if len(candidate.Tags) > 10 {
+		candidate.Tags = candidate.Tags[:10]
+	}
+	if candidate.Author == "" {
+		keys := make([]olKey, 0, len(work.Authors))
+		for _, author := range work.Authors {
+			keys = append(keys, author.Author)
+		}
+		candidate.Author = p.authorNames(ctx, keys)
+	}
+	return candidate, nil
+}
+
+func (p *openLibraryProvider) Cover(ctx context.Context, candidate *models.MetadataCandidate) ([]byte, error) {
+	return fetchCover(ctx, candidate.CoverURL)
+}
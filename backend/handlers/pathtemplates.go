@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pathFields are the placeholders a path template can use. {*} matches a
+// part of the path that carries nothing worth keeping.
+var pathFields = map[string]string{
+	"author": `(.+?)`,
+	"title":  `(.+?)`,
+	"series": `(.+?)`,
+	"index":  `(\d+(?:\.\d+)?)`,
+	"*":      `(.+?)`,
+}
+
+var pathPlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// pathTemplate describes how a scan root is laid out, such as
+// "{author}/{series}/{index} - {title}". Each folder of the template is
+// matched against the same folder of a book's path, counting up from the file
+// name, which is matched without its extension.
+type pathTemplate struct {
+	segments []*regexp.Regexp
+	fields   [][]string
+}
+
+func parsePathTemplate(source string) (*pathTemplate, error) {
+	template := &pathTemplate{}
+	known := false
+	for _, segment := range strings.Split(strings.Trim(source, "/"), "/") {
+		if segment == "" {
+			return nil, fmt.Errorf("empty folder name")
+		}
+		var pattern strings.Builder
+		var fields []string
+		last := 0
+		for _, match := range pathPlaceholder.FindAllStringSubmatchIndex(segment, -1) {
+			literal := segment[last:match[0]]
+			if strings.ContainsAny(literal, "{}") {
+				return nil, fmt.Errorf("unbalanced braces")
+			}
+			if literal == "" && len(fields) > 0 {
+				return nil, fmt.Errorf("{%s} and {%s} need something between them", fields[len(fields)-1], segment[match[2]:match[3]])
+			}
+			name := strings.ToLower(strings.TrimSpace(segment[match[2]:match[3]]))
+			expression, ok := pathFields[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown placeholder {%s}", name)
+			}
+			known = known || name != "*"
+			pattern.WriteString(regexp.QuoteMeta(literal))
+			pattern.WriteString(expression)
+			fields = append(fields, name)
+			last = match[1]
+		}
+		if strings.ContainsAny(segment[last:], "{}") {
+			return nil, fmt.Errorf("unbalanced braces")
+		}
+		pattern.WriteString(regexp.QuoteMeta(segment[last:]))
+		template.segments = append(template.segments, regexp.MustCompile(`(?i)^`+pattern.String()+`$`))
+		template.fields = append(template.fields, fields)
+	}
+	if !known {
+		return nil, fmt.Errorf("no {author}, {title}, {series} or {index}")
+	}
+	return template, nil
+}
+
+// match returns what the template reads from a path relative to its scan
+// root, or nil if the path is not laid out that way.
+func (t *pathTemplate) match(relPath string) *models.Book {
+	parts := strings.Split(filepath.ToSlash(sidecarBase(relPath)), "/")
+	if len(parts) < len(t.segments) {
+		return nil
+	}
+	parts = parts[len(parts)-len(t.segments):]
+
+	values := map[string]string{}
+	for i, segment := range t.segments {
+		match := segment.FindStringSubmatch(parts[i])
+		if match == nil {
+			return nil
+		}
+		for j, name := range t.fields[i] {
+			value := strings.Join(strings.Fields(strings.ReplaceAll(match[j+1], "_", " ")), " ")
+			if value == "" {
+				return nil
+			}
+			values[name] = value
+		}
+	}
+
+	book := &models.Book{Title: values["title"], Author: values["author"], Series: values["series"]}
+	if index, err := strconv.ParseFloat(values["index"], 64); err == nil && book.Series != "" {
+		book.SeriesIndex = &index
+	}
+	return book
+}
+
+// cleanPathTemplates validates path templates, dropping blank ones.
+func cleanPathTemplates(sources []string) ([]string, string) {
+	cleaned := make([]string, 0, len(sources))
+	for _, source := range sources {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		if _, err := parsePathTemplate(source); err != nil {
+			return nil, "Invalid path template " + source + ": " + err.Error()
+		}
+		cleaned = append(cleaned, source)
+	}
+	return cleaned, ""
+}
+
+func libraryPathTemplateSources(libraryID string) []string {
+	var stored string
+	db.DB.QueryRow("SELECT path_templates FROM libraries WHERE id = ?", libraryID).Scan(&stored)
+	if stored == "" {
+		return nil
+	}
+	return strings.Split(stored, "\n")
+}
+
+func libraryPathTemplates(libraryID string) []*pathTemplate {
+	var templates []*pathTemplate
+	for _, source := range libraryPathTemplateSources(libraryID) {
+		template, err := parsePathTemplate(source)
+		if err != nil {
+			log.Printf("Ignoring path template %q: %v", source, err)
+			continue
+		}
+		templates = append(templates, template)
+	}
+	return templates
+}
+
+// inferFromPath fills in what a book's embedded metadata lacks from the first
+// template its path matches: the title when it is only the file name, and
+// the author and series when there are none.
+func inferFromPath(book *models.Book, root string, templates []*pathTemplate) bool {
+	relPath, err := filepath.Rel(root, book.FilePath)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		return false
+	}
+	for _, template := range templates {
+		inferred := template.match(relPath)
+		if inferred == nil {
+			continue
+		}
+		changed := false
+		if inferred.Title != "" && book.Title == sidecarBase(filepath.Base(book.FilePath)) && inferred.Title != book.Title {
+			book.Title = inferred.Title
+			changed = true
+		}
+		if inferred.Author != "" && book.Author == "" {
+			book.Author = inferred.Author
+			changed = true
+		}
+		if inferred.Series != "" && book.Series == "" {
+			book.Series = inferred.Series
+			book.SeriesIndex = inferred.SeriesIndex
+			changed = true
+		}
+		return changed
+	}
+	return false
+}
+
+// applyPathTemplates infers metadata for the books already in a library, for
+// when its templates change.
+func applyPathTemplates(libraryID string) {
+	templates := libraryPathTemplates(libraryID)
+	roots, err := libraryRoots(libraryID)
+	if err != nil || len(templates) == 0 {
+		return
+	}
+
+	rows, err := db.DB.Query(
+		"SELECT id, title, COALESCE(author, ''), COALESCE(series, ''), series_index, file_path FROM books WHERE library_id = ? AND deleted_at IS NULL",
+		libraryID,
+	)
+	if err != nil {
+		log.Printf("Failed to list books for path templates: %v", err)
+		return
+	}
+	var books []models.Book
+	for rows.Next() {
+		var book models.Book
+		if rows.Scan(&book.ID, &book.Title, &book.Author, &book.Series, &book.SeriesIndex, &book.FilePath) == nil {
+			books = append(books, book)
+		}
+	}
+	rows.Close()
+
+	updated := 0
+	for _, book := range books {
+		for _, root := range roots {
+			if !inferFromPath(&book, root, templates) {
+				continue
+			}
+			_, err := db.DB.Exec(
+				"UPDATE books SET title = ?, author = ?, series = ?, series_index = ? WHERE id = ?",
+				book.Title, book.Author, book.Series, book.SeriesIndex, book.ID,
+			)
+			if err != nil {
+				log.Printf("Failed to update %s from its path: %v", book.FilePath, err)
+			} else {
+				updated++
+			}
+			break
+		}
+	}
+	if updated > 0 {
+		log.Printf("Path templates: updated %d books in library %s", updated, libraryID)
+	}
+}
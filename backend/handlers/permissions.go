@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"net/http"
+	"slices"
+)
+
+// Permissions that routes require.
+const (
+	PermRead            = "read"             // browse the catalog and read books
+	PermTrack           = "track"            // record one's own progress, ratings, annotations and shelves
+	PermAccount         = "account"          // change one's own password and API tokens
+	PermUpload          = "upload"           // add books and covers
+	PermDelete          = "delete"           // delete books
+	PermManageUsers     = "manage-users"     // create and remove accounts and assign roles
+	PermManageLibraries = "manage-libraries" // define libraries and their scan roots
+	PermViewAudit       = "view-audit"       // read the audit log
+)
+
+// User roles, from most to least trusted.
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleReader = "reader"
+	RoleGuest  = "guest"
+)
+
+var rolePermissions = map[string][]string{
+	RoleAdmin:  {PermRead, PermTrack, PermAccount, PermUpload, PermDelete, PermManageUsers, PermManageLibraries, PermViewAudit},
+	RoleEditor: {PermRead, PermTrack, PermAccount, PermUpload, PermDelete},
+	RoleReader: {PermRead, PermTrack, PermAccount},
+	RoleGuest:  {PermRead, PermAccount},
+}
+
+var scopePermissions = map[string][]string{
+	ScopeRead:   {PermRead},
+	ScopeUpload: {PermRead, PermTrack, PermUpload},
+	ScopeAdmin:  {PermRead, PermTrack, PermAccount, PermUpload, PermDelete, PermManageUsers, PermManageLibraries, PermViewAudit},
+}
+
+// can reports whether the request's user may do permission: their role has
+// to allow it, and so does the scope of the credentials they used.
+func can(r *http.Request, permission string) bool {
+	user := CurrentUser(r)
+	if user == nil {
+		return false
+	}
+	scope, _ := r.Context().Value(scopeContextKey).(string)
+	return slices.Contains(rolePermissions[user.Role], permission) &&
+		slices.Contains(scopePermissions[scope], permission)
+}
+
+// permissionsFor lists everything the request's user may do.
+func permissionsFor(r *http.Request) []string {
+	permissions := make([]string, 0)
+	for _, permission := range scopePermissions[ScopeAdmin] {
+		if can(r, permission) {
+			permissions = append(permissions, permission)
+		}
+	}
+	return permissions
+}
+
+// Require wraps a handler so it only runs for authenticated requests that
+// have permission.
+func Require(permission string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if CurrentUser(r) == nil {
+				unauthorized(w, r, "Authentication required")
+				return
+			}
+			if !can(r, permission) {
+				http.Error(w, "You do not have permission to do this", http.StatusForbidden)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxChapterLength = 500
+	maxDeviceLength  = 100
+	// maxClockSkew is how far in the future a client timestamp may be before
+	// it is rejected.
+	maxClockSkew = 5 * time.Minute
+)
+
+// decodeProgress reads a ReadingProgress body. Older clients send
+// {"progress": "<json>"} with a "type" field instead of "format", so that form
+// is translated here.
+func decodeProgress(body io.Reader) (models.ReadingProgress, error) {
+	var payload struct {
+		models.ReadingProgress
+		Legacy string `json:"progress"`
+	}
+	if err := json.NewDecoder(body).Decode(&payload); err != nil {
+		return models.ReadingProgress{}, err
+	}
+	if payload.Legacy == "" {
+		return payload.ReadingProgress, nil
+	}
+
+	var legacy struct {
+		Type       string  `json:"type"`
+		CFI        string  `json:"cfi"`
+		Fraction   float64 `json:"fraction"`
+		Page       int     `json:"page"`
+		TotalPages int     `json:"totalPages"`
+	}
+	if err := json.Unmarshal([]byte(payload.Legacy), &legacy); err != nil {
+		return models.ReadingProgress{}, fmt.Errorf("invalid legacy progress: %w", err)
+	}
+	return models.ReadingProgress{
+		Format:     legacy.Type,
+		CFI:        legacy.CFI,
+		Fraction:   legacy.Fraction,
+		Page:       legacy.Page,
+		TotalPages: legacy.TotalPages,
+	}, nil
+}
+
+// progressFormats lists the formats progress can be recorded in for a book:
+// one per file it has, and EPUB when it is read as one converted from another
+// format. Positions in the converted EPUB are kept apart from those in the
+// file it was made from.
+func progressFormats(bookID string) ([]string, error) {
+	formats, err := loadBookFormats(bookID)
+	if err != nil {
+		return nil, err
+	}
+	fileTypes := make([]string, 0, len(formats)+1)
+	for _, format := range formats {
+		fileTypes = append(fileTypes, format.FileType)
+	}
+	if !slices.Contains(fileTypes, "epub") && hasCurrentConversion(bookID) {
+		fileTypes = append(fileTypes, "epub")
+	}
+	return fileTypes, nil
+}
+
+// validateProgress checks p against the book's formats and normalises it:
+// a missing format is the main one, fileType, the PDF fraction is derived from
+// the page, fields that do not apply to the format are cleared and a missing
+// timestamp is set to now.
+func validateProgress(p *models.ReadingProgress, fileType string, formats []string, now time.Time) error {
+	p.Format = strings.ToLower(strings.TrimSpace(p.Format))
+	if p.Format == "" {
+		p.Format = fileType
+	}
+	if !slices.Contains(formats, p.Format) {
+		return fmt.Errorf("format %q is not one of the book's formats (%s)", p.Format, strings.Join(formats, ", "))
+	}
+
+	if p.Format == "pdf" {
+		if p.TotalPages < 1 {
+			return fmt.Errorf("totalPages must be at least 1")
+		}
+		if p.Page < 1 || p.Page > p.TotalPages {
+			return fmt.Errorf("page must be between 1 and %d", p.TotalPages)
+		}
+		p.Fraction = float64(p.Page) / float64(p.TotalPages)
+		p.CFI = ""
+	} else {
+		p.CFI = strings.TrimSpace(p.CFI)
+		if !strings.HasPrefix(p.CFI, "epubcfi(") || !strings.HasSuffix(p.CFI, ")") {
+			return fmt.Errorf("cfi must be an epubcfi(...) expression")
+		}
+		if math.IsNaN(p.Fraction) || p.Fraction < 0 || p.Fraction > 1 {
+			return fmt.Errorf("fraction must be between 0 and 1")
+		}
+		p.Page = 0
+		p.TotalPages = 0
+	}
+
+	p.Chapter = strings.TrimSpace(p.Chapter)
+	if len(p.Chapter) > maxChapterLength {
+		return fmt.Errorf("chapter must be at most %d characters", maxChapterLength)
+	}
+	p.Device = strings.TrimSpace(p.Device)
+	if len(p.Device) > maxDeviceLength {
+		return fmt.Errorf("device must be at most %d characters", maxDeviceLength)
+	}
+
+	if p.Timestamp.IsZero() {
+		p.Timestamp = now
+	} else if p.Timestamp.After(now.Add(maxClockSkew)) {
+		return fmt.Errorf("timestamp is in the future")
+	}
+	return nil
+}
+
+// Strategies for resolving the book's position when devices disagree.
+const (
+	StrategyRecent   = "recent"
+	StrategyFurthest = "furthest"
+)
+
+// ProgressStrategy decides which device's position becomes the book's
+// progress: the most recently reported one or the one furthest into the book.
+var ProgressStrategy = StrategyRecent
+
+// aheadMargin is how much further (as a fraction of the book) another device
+// must be before it is offered as a jump target.
+const aheadMargin = 0.005
+
+type saveProgressResponse struct {
+	Status          string                  `json:"status"`
+	Accepted        bool                    `json:"accepted"`
+	Progress        *models.ReadingProgress `json:"progress"`
+	ProgressPercent float64                 `json:"progressPercent"`
+	Ahead           *models.ReadingProgress `json:"ahead,omitempty"`
+}
+
+type progressState struct {
+	Strategy        string                   `json:"strategy"`
+	Progress        *models.ReadingProgress  `json:"progress,omitempty"`
+	ProgressPercent float64                  `json:"progressPercent"`
+	Devices         []models.ReadingProgress `json:"devices"`
+	Ahead           *models.ReadingProgress  `json:"ahead,omitempty"`
+}
+
+func loadDeviceProgress(userID, bookID string) ([]models.ReadingProgress, error) {
+	rows, err := db.DB.Query(
+		`SELECT device, format, COALESCE(cfi, ''), COALESCE(page, 0), COALESCE(total_pages, 0), fraction, COALESCE(chapter, ''), updated_at
+		FROM device_progress WHERE user_id = ? AND book_id = ? ORDER BY updated_at DESC`,
+		userID, bookID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := make([]models.ReadingProgress, 0)
+	for rows.Next() {
+		var p models.ReadingProgress
+		if err := rows.Scan(&p.Device, &p.Format, &p.CFI, &p.Page, &p.TotalPages, &p.Fraction, &p.Chapter, &p.Timestamp); err != nil {
+			log.Println("Scan error:", err)
+			continue
+		}
+		devices = append(devices, p)
+	}
+	return devices, rows.Err()
+}
+
+// progressIn returns the positions recorded in one format. Positions in
+// different formats point into different files, so they are only compared
+// with each other.
+func progressIn(devices []models.ReadingProgress, format string) []models.ReadingProgress {
+	var matching []models.ReadingProgress
+	for _, p := range devices {
+		if p.Format == format {
+			matching = append(matching, p)
+		}
+	}
+	return matching
+}
+
+// bookProgress resolves the position kept with the book, which the reader
+// resumes the main format from: the one in fileType, or in any format if
+// nothing has been read in the main one.
+func bookProgress(devices []models.ReadingProgress, fileType string) *models.ReadingProgress {
+	if p := resolveProgress(progressIn(devices, fileType), ProgressStrategy); p != nil {
+		return p
+	}
+	return resolveProgress(devices, ProgressStrategy)
+}
+
+// refreshBookProgress resolves again the position kept with a book for
+// every user who has read it, after its main format or devices changed.
+func refreshBookProgress(bookID string) error {
+	var fileType string
+	if err := db.DB.QueryRow("SELECT file_type FROM books WHERE id = ?", bookID).Scan(&fileType); err != nil {
+		return err
+	}
+	rows, err := db.DB.Query("SELECT DISTINCT user_id FROM device_progress WHERE book_id = ?", bookID)
+	if err != nil {
+		return err
+	}
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err == nil {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	rows.Close()
+
+	for _, userID := range userIDs {
+		devices, err := loadDeviceProgress(userID, bookID)
+		if err != nil {
+			return err
+		}
+		p := bookProgress(devices, fileType)
+		if p == nil {
+			continue
+		}
+		_, err = db.DB.Exec(
+			`UPDATE user_books SET progress_format = ?, progress_cfi = ?, progress_page = ?, progress_total_pages = ?,
+				progress_fraction = ?, progress_chapter = ?, progress_device = ?, progress_updated_at = ?
+			WHERE user_id = ? AND book_id = ?`,
+			p.Format, p.CFI, p.Page, p.TotalPages, p.Fraction, p.Chapter, p.Device, p.Timestamp, userID, bookID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveProgress picks the position the book should resume from.
+func resolveProgress(devices []models.ReadingProgress, strategy string) *models.ReadingProgress {
+	var best *models.ReadingProgress
+	for i := range devices {
+		p := &devices[i]
+		if best == nil {
+			best = p
+			continue
+		}
+		newer := p.Timestamp.After(best.Timestamp)
+		switch strategy {
+		case StrategyFurthest:
+			if p.Fraction > best.Fraction || (p.Fraction == best.Fraction && newer) {
+				best = p
+			}
+		default:
+			if newer {
+				best = p
+			}
+		}
+	}
+	return best
+}
+
+// deviceAhead returns the furthest position reported by a device other than
+// device, if it is meaningfully ahead of fraction.
+func deviceAhead(devices []models.ReadingProgress, device string, fraction float64) *models.ReadingProgress {
+	var ahead *models.ReadingProgress
+	for i := range devices {
+		p := &devices[i]
+		if p.Device == device || p.Fraction <= fraction+aheadMargin {
+			continue
+		}
+		if ahead == nil || p.Fraction > ahead.Fraction {
+			ahead = p
+		}
+	}
+	return ahead
+}
+
+// GetProgress returns the book's resolved position in its main format, or
+// the one named by ?format=, and every device's latest position in each
+// format. With ?device=, it also reports another device that is further ahead
+// in the same format than the resolved position, so the client can offer to
+// jump there.
+func GetProgress(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bookID := vars["id"]
+	device := strings.TrimSpace(r.URL.Query().Get("device"))
+
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	book, err := scanBook(db.DB.QueryRow("SELECT "+bookColumns+bookFrom+" WHERE b.id = ?", user.ID, bookID))
+	if err != nil {
+		http.Error(w, "Book not found", http.StatusNotFound)
+		return
+	}
+
+	devices, err := loadDeviceProgress(user.ID, bookID)
+	if err != nil {
+		http.Error(w, "Failed to fetch progress", http.StatusInternalServerError)
+		return
+	}
+
+	format := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("format")))
+	if format == "" {
+		format = book.FileType
+	}
+	inFormat := progressIn(devices, format)
+	resolved := resolveProgress(inFormat, ProgressStrategy)
+
+	state := progressState{
+		Strategy:        ProgressStrategy,
+		Progress:        resolved,
+		ProgressPercent: resolved.Percent(),
+		Devices:         devices,
+	}
+	if device != "" {
+		state.Ahead = deviceAhead(inFormat, device, resolved.Percent()/100)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func progressRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/books/{id}", GetBook).Methods("GET")
+	router.HandleFunc("/api/books/{id}/progress", GetProgress).Methods("GET")
+	router.HandleFunc("/api/books/{id}/progress", SaveProgress).Methods("PUT")
+	router.HandleFunc("/api/books/{id}/merge", MergeBooks).Methods("POST")
+	return router
+}
+
+func epubPosition(device string, fraction float64, at time.Time) string {
+	return fmt.Sprintf(`{"format": "epub", "cfi": "epubcfi(/6/4!/4/2)", "fraction": %g, "device": %q, "timestamp": %q}`,
+		fraction, device, at.Format(time.RFC3339))
+}
+
+func pdfPosition(device string, page int, at time.Time) string {
+	return fmt.Sprintf(`{"format": "pdf", "page": %d, "totalPages": 100, "device": %q, "timestamp": %q}`,
+		page, device, at.Format(time.RFC3339))
+}
+
+func TestMergedBookProgressPerFormat(t *testing.T) {
+	user := setupTestDB(t)
+	router := progressRouter()
+	addTestBook(t, "epub-book", "Middlemarch", "epub")
+	addTestBook(t, "pdf-book", "Middlemarch", "pdf")
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	save := func(bookID, body string) saveProgressResponse {
+		t.Helper()
+		var response saveProgressResponse
+		decodeResponse(t, serveAs(router, user, "PUT", "/api/books/"+bookID+"/progress", body), &response)
+		return response
+	}
+
+	// The PDF was read further and more recently, on a device that has also
+	// read the EPUB
+	save("epub-book", epubPosition("phone", 0.2, start))
+	save("epub-book", epubPosition("tablet", 0.1, start))
+	save("pdf-book", pdfPosition("tablet", 80, start.Add(time.Minute)))
+
+	w := serveAs(router, user, "POST", "/api/books/epub-book/merge", `{"books": ["pdf-book"], "primary": "epub"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("merge: status %d: %s", w.Code, w.Body.String())
+	}
+
+	var book models.Book
+	decodeResponse(t, serveAs(router, user, "GET", "/api/books/epub-book", ""), &book)
+	if book.Progress == nil || book.Progress.Format != "epub" || book.Progress.Device != "phone" {
+		t.Errorf("book progress = %+v, want the phone's EPUB position", book.Progress)
+	}
+
+	var state progressState
+	decodeResponse(t, serveAs(router, user, "GET", "/api/books/epub-book/progress?device=tablet", ""), &state)
+	if state.Progress == nil || state.Progress.Format != "epub" || state.Progress.Fraction != 0.2 {
+		t.Errorf("EPUB progress = %+v, want the phone's", state.Progress)
+	}
+	if len(state.Devices) != 3 {
+		t.Errorf("%d device positions, want 3 (the tablet's in each format and the phone's)", len(state.Devices))
+	}
+	// The tablet's PDF page is further on, but not a place in the EPUB
+	if state.Ahead != nil {
+		t.Errorf("ahead = %+v, want none", state.Ahead)
+	}
+
+	state = progressState{}
+	decodeResponse(t, serveAs(router, user, "GET", "/api/books/epub-book/progress?format=pdf", ""), &state)
+	if state.Progress == nil || state.Progress.Format != "pdf" || state.Progress.Page != 80 {
+		t.Errorf("PDF progress = %+v, want page 80", state.Progress)
+	}
+
+	// Reading the PDF of the merged book is accepted and kept apart
+	response := save("epub-book", pdfPosition("tablet", 90, start.Add(2*time.Minute)))
+	if !response.Accepted || response.Progress.Format != "pdf" || response.Progress.Page != 90 {
+		t.Errorf("saving a PDF position: %+v", response)
+	}
+	response = save("epub-book", epubPosition("tablet", 0.3, start.Add(3*time.Minute)))
+	if !response.Accepted || response.Progress.Format != "epub" || response.Progress.Fraction != 0.3 {
+		t.Errorf("saving an EPUB position: %+v", response)
+	}
+
+	book = models.Book{}
+	decodeResponse(t, serveAs(router, user, "GET", "/api/books/epub-book", ""), &book)
+	if book.Progress == nil || book.Progress.Format != "epub" || book.Progress.Fraction != 0.3 {
+		t.Errorf("book progress = %+v, want the tablet's EPUB position", book.Progress)
+	}
+	state = progressState{}
+	decodeResponse(t, serveAs(router, user, "GET", "/api/books/epub-book/progress?format=pdf", ""), &state)
+	if state.Progress == nil || state.Progress.Page != 90 {
+		t.Errorf("PDF progress = %+v, want page 90", state.Progress)
+	}
+
+	w = serveAs(router, user, "PUT", "/api/books/epub-book/progress",
+		`{"format": "mobi", "cfi": "epubcfi(/6/2)", "fraction": 0.5, "device": "kindle"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("saving a format the book does not have: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestConvertedEPUBProgress(t *testing.T) {
+	user := setupTestDB(t)
+	router := progressRouter()
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "book.fb2")
+	converted := filepath.Join(dir, "converted.epub")
+	for _, path := range []string{source, converted} {
+		if err := os.WriteFile(path, []byte("book"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	book := models.Book{ID: "fb2-book", LibraryID: DefaultLibraryID, Title: "War and Peace", FilePath: source, FileType: "fb2", AddedAt: time.Now()}
+	if err := insertBook(book, "hash"); err != nil {
+		t.Fatalf("inserting book: %v", err)
+	}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	saveEPUB := func() int {
+		return serveAs(router, user, "PUT", "/api/books/fb2-book/progress", epubPosition("phone", 0.5, start)).Code
+	}
+	if code := saveEPUB(); code != http.StatusBadRequest {
+		t.Errorf("EPUB position before conversion: status %d, want %d", code, http.StatusBadRequest)
+	}
+
+	modified, _ := sourceModified(source)
+	_, err := db.DB.Exec(
+		`INSERT INTO book_conversions (book_id, format, source_type, source_path, source_modified, file_path, status, created_at, updated_at)
+		VALUES ('fb2-book', 'epub', 'fb2', ?, ?, ?, ?, ?, ?)`,
+		source, modified, converted, models.ImportDone, time.Now(), time.Now(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := saveEPUB(); code != http.StatusOK {
+		t.Fatalf("EPUB position of the converted book: status %d, want %d", code, http.StatusOK)
+	}
+
+	// The web reader's own FB2 position is not mixed with the EPUB's
+	body := `{"format": "fb2", "cfi": "epubcfi(/6/2!/4/2)", "fraction": 0.1, "device": "phone", "timestamp": "` +
+		start.Add(time.Minute).Format(time.RFC3339) + `"}`
+	if w := serveAs(router, user, "PUT", "/api/books/fb2-book/progress", body); w.Code != http.StatusOK {
+		t.Fatalf("FB2 position: status %d: %s", w.Code, w.Body.String())
+	}
+	for format, want := range map[string]float64{"epub": 0.5, "fb2": 0.1} {
+		var state progressState
+		decodeResponse(t, serveAs(router, user, "GET", "/api/books/fb2-book/progress?format="+format, ""), &state)
+		if state.Progress == nil || state.Progress.Format != format || state.Progress.Fraction != want {
+			t.Errorf("%s progress = %+v, want fraction %g", format, state.Progress, want)
+		}
+	}
+
+	// Once the source changes, the EPUB is out of date
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(source, later, later)
+	if code := saveEPUB(); code != http.StatusBadRequest {
+		t.Errorf("EPUB position after the source changed: status %d, want %d", code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// MetadataProvider looks books up in an online catalogue.
+type MetadataProvider interface {
+	// Name identifies the provider in requests and in the cache.
+	Name() string
+	// Search finds candidates by ISBN, or by title and author.
+	Search(ctx context.Context, query models.MetadataQuery) ([]models.MetadataCandidate, error)
+	// Details fetches everything the provider has on one candidate.
+	Details(ctx context.Context, id string) (*models.MetadataCandidate, error)
+	// Cover downloads a candidate's cover image.
+	Cover(ctx context.Context, candidate *models.MetadataCandidate) ([]byte, error)
+}
+
+// MetadataProviders are consulted in order when looking a book up.
+var MetadataProviders []MetadataProvider
+
+// GoogleBooksAPIKey raises Google Books' anonymous rate limit when set.
+var GoogleBooksAPIKey string
+
+// FakeMetadataFile is a JSON list of candidates for the fake provider to
+// serve instead of its built-in ones.
+var FakeMetadataFile string
+
+// DefaultMetadataProviders are used when METADATA_PROVIDERS is not set.
+const DefaultMetadataProviders = "openlibrary,googlebooks"
+
+const (
+	metadataCacheTTL     = 7 * 24 * time.Hour
+	metadataTimeout      = 20 * time.Second
+	maxMetadataResponse  = 5 << 20
+	maxCoverDownload     = 10 << 20
+	maxMetadataResults   = 10
+	metadataUserAgent    = "Bookland"
+	metadataCacheSearch  = "search"
+	metadataCacheDetails = "details"
+)
+
+var errCandidateNotFound = errors.New("not found")
+
+// NewMetadataProvider returns the provider with the given name.
+func NewMetadataProvider(name string) (MetadataProvider, error) {
+	switch name {
+	case "openlibrary":
+		return &openLibraryProvider{baseURL: "https://openlibrary.org", coversURL: "https://covers.openlibrary.org"}, nil
+	case "googlebooks":
+		return &googleBooksProvider{baseURL: "https://www.googleapis.com/books/v1", apiKey: GoogleBooksAPIKey}, nil
+	case "fake":
+		return newFakeProvider(FakeMetadataFile)
+	}
+	return nil, fmt.Errorf("unknown metadata provider %q", name)
+}
+
+func metadataProvider(name string) MetadataProvider {
+	for _, provider := range MetadataProviders {
+		if provider.Name() == name {
+			return provider
+		}
+	}
+	return nil
+}
+
+// metadataClient shares the URL importer's transport, so covers cannot be
+// fetched from internal addresses either.
+var metadataClient = &http.Client{
+	Timeout:       metadataTimeout,
+	Transport:     importClient.Transport,
+	CheckRedirect: importClient.CheckRedirect,
+}
+
+func metadataGet(ctx context.Context, url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", metadataUserAgent)
+	req.Header.Set("Accept", "application/json, image/*")
+
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errCandidateNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the server responded %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("the response is too large")
+	}
+	return data, nil
+}
+
+// metadataJSON fetches url and decodes the JSON response into v.
+func metadataJSON(ctx context.Context, url string, v any) error {
+	data, err := metadataGet(ctx, url, maxMetadataResponse)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// fetchCover downloads a cover image, refusing anything that is not one.
+func fetchCover(ctx context.Context, url string) ([]byte, error) {
+	if url == "" {
+		return nil, errCandidateNotFound
+	}
+	data, err := metadataGet(ctx, url, maxCoverDownload)
+	if err != nil {
+		return nil, err
+	}
+	if !IsImageFile(data) {
+		return nil, fmt.Errorf("the cover is not an image")
+	}
+	return data, nil
+}
+
+// cachedMetadata returns a cached response for key, or fetches and caches a
+// fresh one. Failures are not cached, so they are retried next time.
+func cachedMetadata[T any](provider, kind, key string, fetch func() (T, error)) (T, error) {
+	var result T
+	var response string
+	err := db.DB.QueryRow(
+		"SELECT response FROM metadata_cache WHERE provider = ? AND kind = ? AND key = ? AND fetched_at > ?",
+		provider, kind, key, time.Now().Add(-metadataCacheTTL),
+	).Scan(&response)
+	if err == nil && json.Unmarshal([]byte(response), &result) == nil {
+		return result, nil
+	}
+
+	result, err = fetch()
+	if err != nil {
+		return result, err
+	}
+	if data, err := json.Marshal(result); err == nil {
+		_, err := db.DB.Exec(
+			"INSERT OR REPLACE INTO metadata_cache (provider, kind, key, response, fetched_at) VALUES (?, ?, ?, ?, ?)",
+			provider, kind, key, string(data), time.Now(),
+		)
+		if err != nil {
+			log.Printf("Failed to cache %s %s: %v", provider, kind, err)
+		}
+	}
+	return result, nil
+}
+
+func searchProvider(ctx context.Context, provider MetadataProvider, query models.MetadataQuery) ([]models.MetadataCandidate, error) {
+	key := strings.ToLower(url.Values{"isbn": {query.ISBN}, "title": {query.Title}, "author": {query.Author}}.Encode())
+	return cachedMetadata(provider.Name(), metadataCacheSearch, key, func() ([]models.MetadataCandidate, error) {
+		candidates, err := provider.Search(ctx, query)
+		if candidates == nil {
+			candidates = []models.MetadataCandidate{}
+		}
+		return candidates, err
+	})
+}
+
+func providerDetails(ctx context.Context, provider MetadataProvider, id string) (*models.MetadataCandidate, error) {
+	return cachedMetadata(provider.Name(), metadataCacheDetails, id, func() (*models.MetadataCandidate, error) {
+		return provider.Details(ctx, id)
+	})
+}
+
+// PurgeMetadataCache drops cached lookups too old to be used, returning how
+// many were removed.
+func PurgeMetadataCache() int {
+	result, err := db.DB.Exec("DELETE FROM metadata_cache WHERE fetched_at <= ?", time.Now().Add(-metadataCacheTTL))
+	if err != nil {
+		log.Printf("Failed to purge the metadata cache: %v", err)
+		return 0
+	}
+	n, _ := result.RowsAffected()
+	return int(n)
+}
+
+// firstOf returns the first non-empty value.
+func firstOf(values ...string) string {
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Progress thresholds (in percent) at which SaveProgress moves a book to
+// "reading" and "finished" on its own.
+const (
+	startedThreshold  = 0.5
+	finishedThreshold = 98.0
+)
+
+var validStatuses = map[string]bool{
+	"":                      true,
+	models.StatusWantToRead: true,
+	models.StatusReading:    true,
+	models.StatusFinished:   true,
+	models.StatusAbandoned:  true,
+}
+
+// UpdateReadingState sets any of status, rating, favorite and review for a book.
+// Fields omitted from the body are left unchanged.
+func UpdateReadingState(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bookID := vars["id"]
+
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Status   *string `json:"status"`
+		Rating   *int    `json:"rating"`
+		Favorite *bool   `json:"favorite"`
+		Review   *string `json:"review"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	book, err := scanBook(db.DB.QueryRow("SELECT "+bookColumns+bookFrom+" WHERE b.id = ?", user.ID, bookID))
+	if err != nil {
+		http.Error(w, "Book not found", http.StatusNotFound)
+		return
+	}
+
+	if input.Status != nil {
+		status := strings.ToLower(strings.TrimSpace(*input.Status))
+		if !validStatuses[status] {
+			http.Error(w, "Status must be one of want-to-read, reading, finished, abandoned", http.StatusBadRequest)
+			return
+		}
+		applyStatus(&book, status, time.Now())
+	}
+	if input.Rating != nil {
+		if *input.Rating < 0 || *input.Rating > 5 {
+			http.Error(w, "Rating must be between 1 and 5, or 0 to clear", http.StatusBadRequest)
+			return
+		}
+		book.Rating = *input.Rating
+	}
+	if input.Favorite != nil {
+		book.Favorite = *input.Favorite
+	}
+	if input.Review != nil {
+		book.Review = *input.Review
+	}
+
+	if err := saveUserBook(user.ID, &book); err != nil {
+		log.Printf("UpdateReadingState DB error for book %s: %v", bookID, err)
+		http.Error(w, "Failed to update reading state", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(book)
+}
+
+// applyStatus moves a book to status, stamping or clearing the started and
+// finished timestamps to match.
+func applyStatus(book *models.Book, status string, now time.Time) {
+	if book.Status == status {
+		return
+	}
+	switch status {
+	case "", models.StatusWantToRead:
+		book.StartedAt = nil
+		book.FinishedAt = nil
+	case models.StatusReading:
+		if book.StartedAt == nil {
+			book.StartedAt = &now
+		}
+		book.FinishedAt = nil
+	case models.StatusFinished:
+		if book.StartedAt == nil {
+			book.StartedAt = &now
+		}
+		book.FinishedAt = &now
+	case models.StatusAbandoned:
+		book.FinishedAt = nil
+	}
+	book.Status = status
+}
+
+// statusForProgress returns the status a book should move to after its progress
+// reaches percent, or the current status when no threshold was crossed.
+// Abandoned books are left alone so that merely reopening one does not undo it.
+func statusForProgress(current string, percent float64) string {
+	switch current {
+	case "", models.StatusWantToRead:
+		if percent >= finishedThreshold {
+			return models.StatusFinished
+		}
+		if percent >= startedThreshold {
+			return models.StatusReading
+		}
+	case models.StatusReading:
+		if percent >= finishedThreshold {
+			return models.StatusFinished
+		}
+	}
+	return current
+}
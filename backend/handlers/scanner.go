@@ -3,6 +3,7 @@ package handlers
 import (
 	"bookland/db"
 	"bookland/models"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
@@ -12,115 +13,185 @@ import (
 	"github.com/google/uuid"
 )
 
-// ScanDirectory scans a directory for book files and adds them to the database.
+// ScanDirectory scans a directory and its subfolders, other than those that
+// are another library's scan roots, for book files and adds
+// them to the given library. Metadata and covers in sidecar files beside a
+// book, such as Calibre's metadata.opf and cover.jpg, take precedence over
+// what is embedded in the file, and the library's path templates fill in
+// what neither provides.
 // Returns the list of added books and any error encountered.
-func ScanDirectory(booksDir string) ([]models.Book, error) {
-	entries, err := os.ReadDir(booksDir)
-	if err != nil {
+func ScanDirectory(booksDir, libraryID string) ([]models.Book, error) {
+	if _, err := os.ReadDir(booksDir); err != nil {
 		return nil, err
 	}
 
+	storageRoot := filepath.Join(DataPath, "books")
+	templates := libraryPathTemplates(libraryID)
+	otherRoots, err := otherLibraryRoots(libraryID)
+	if err != nil {
+		return nil, err
+	}
 	var addedBooks []models.Book
 
-	for _, entry := range entries {
+	err = filepath.WalkDir(booksDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if filePath == booksDir {
+				return err
+			}
+			log.Printf("Failed to read %s: %v", filePath, err)
+			return nil
+		}
 		if entry.IsDir() {
-			continue
+			if filePath == booksDir {
+				return nil
+			}
+			// Hidden folders, and the storage directories of uploaded books
+			// when the data directory is inside a scan root
+			if strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if filepath.Dir(filePath) == storageRoot && uuid.Validate(entry.Name()) == nil {
+				return filepath.SkipDir
+			}
+			// Folders scanned into another library belong to that one
+			if otherRoots[filepath.Clean(filePath)] {
+				return filepath.SkipDir
+			}
+			return nil
 		}
 
-		filename := entry.Name()
-		filePath := filepath.Join(booksDir, filename)
-
-		// Check if it's a supported format
-		supportedTypes := map[string]string{
-			".epub": "epub",
-			".pdf":  "pdf",
-			".mobi": "mobi",
-			".azw3": "azw3",
-			".fb2":  "fb2",
-			".cbz":  "cbz",
-		}
-		ext := strings.ToLower(filepath.Ext(filename))
-		fileType, ok := supportedTypes[ext]
-		if !ok {
-			continue
+		if book, ok := scanFile(booksDir, filePath, libraryID, templates); ok {
+			addedBooks = append(addedBooks, book)
 		}
+		return nil
+	})
 
-		// Check if book already exists in database by file path
-		var existingID string
-		err := db.DB.QueryRow(
-			"SELECT id FROM books WHERE file_path = ?",
-			filePath,
-		).Scan(&existingID)
+	return addedBooks, err
+}
 
-		if err == nil {
-			// Book already exists
-			continue
+// wasPurged reports whether a file's book was purged from the trash. A
+// different file put in its place is a new book, so the file is only skipped
+// while its contents are the same.
+func wasPurged(filePath string) bool {
+	var purgedHash string
+	if err := db.DB.QueryRow("SELECT file_hash FROM purged_files WHERE file_path = ?", filePath).Scan(&purgedHash); err != nil {
+		return false
+	}
+	if purgedHash != "" {
+		if fileHash, err := hashFile(filePath); err == nil && fileHash != purgedHash {
+			db.DB.Exec("DELETE FROM purged_files WHERE file_path = ?", filePath)
+			return false
 		}
+	}
+	return true
+}
 
-		// Get file info
-		info, err := os.Stat(filePath)
-		if err != nil {
-			log.Printf("Failed to stat file %s: %v", filename, err)
-			continue
-		}
+// scanFile adds a book file found under root to the library unless it is not
+// a book or is already known.
+func scanFile(root, filePath, libraryID string, templates []*pathTemplate) (models.Book, bool) {
+	filename := filepath.Base(filePath)
 
-		// Generate unique ID for the book
-		bookID := uuid.New().String()
+	// Check if it's a supported format
+	ext := strings.ToLower(filepath.Ext(filename))
+	fileType, ok := supportedTypes[ext]
+	if !ok {
+		return models.Book{}, false
+	}
 
-		// Extract metadata using shared functions
-		var title, author, coverPath string
+	// Check if the file already belongs to a book, as any of its formats
+	var existingID string
+	err := db.DB.QueryRow(
+		"SELECT book_id FROM book_formats WHERE file_path = ?",
+		filePath,
+	).Scan(&existingID)
 
-		originalName := strings.TrimSuffix(filename, filepath.Ext(filename))
+	if err == nil {
+		// Book already exists
+		return models.Book{}, false
+	}
+	if wasPurged(filePath) {
+		return models.Book{}, false
+	}
 
-		storageDir := filepath.Join(DataPath, "books", bookID)
+	// Get file info
+	info, err := os.Stat(filePath)
+	if err != nil {
+		log.Printf("Failed to stat file %s: %v", filename, err)
+		return models.Book{}, false
+	}
 
-		switch fileType {
-		case "epub":
-			title, author, coverPath = ExtractEPUBMetadata(filePath, storageDir, originalName)
-		case "pdf":
-			title, author = ExtractPDFMetadata(filePath, originalName)
+	// Generate unique ID for the book
+	bookID := uuid.New().String()
+
+	storageDir := filepath.Join(DataPath, "books", bookID)
+
+	// A sidecar cover saves extracting one from the file
+	sidecarCoverPath := sidecarCover(filePath)
+
+	// Extract metadata using shared functions
+	var title, author, coverPath string
+
+	originalName := strings.TrimSuffix(filename, filepath.Ext(filename))
+
+	switch fileType {
+	case "epub":
+		title, author, coverPath = ExtractEPUBMetadata(filePath, storageDir, originalName)
+	case "pdf":
+		title, author = ExtractPDFMetadata(filePath, originalName)
+		if sidecarCoverPath == "" {
 			coverPath = ExtractPDFCover(filePath, storageDir, bookID)
-		case "cbz":
-			title = originalName
-			author = ""
+		}
+	case "cbz":
+		title = originalName
+		author = ""
+		if sidecarCoverPath == "" {
 			coverPath = ExtractCBZCover(filePath, storageDir)
-		default:
-			title = originalName
-			author = ""
 		}
-
-		book := models.Book{
-			ID:        bookID,
-			Title:     title,
-			Author:    author,
-			CoverPath: coverPath,
-			FilePath:  filePath,
-			FileSize:  info.Size(),
-			FileType:  fileType,
-			AddedAt:   time.Now(),
+	default:
+		title = originalName
+		author = ""
+	}
+	if sidecarCoverPath != "" {
+		if coverPath != "" {
+			os.Remove(coverPath)
+		}
+		coverPath = filepath.Join(storageDir, "cover"+strings.ToLower(filepath.Ext(sidecarCoverPath)))
+		if err := copyFile(sidecarCoverPath, coverPath); err != nil {
+			log.Printf("Failed to copy cover %s: %v", sidecarCoverPath, err)
+			coverPath = ""
 		}
+	}
 
-		// Insert into database
-		_, err = db.DB.Exec(
-			"INSERT INTO books (id, title, author, cover_path, file_path, file_size, file_type, added_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
-			book.ID,
-			book.Title,
-			book.Author,
-			book.CoverPath,
-			book.FilePath,
-			book.FileSize,
-			book.FileType,
-			book.AddedAt,
-		)
+	book := models.Book{
+		ID:        bookID,
+		LibraryID: libraryID,
+		Title:     title,
+		Author:    author,
+		CoverPath: coverPath,
+		FilePath:  filePath,
+		FileSize:  info.Size(),
+		FileType:  fileType,
+		AddedAt:   time.Now(),
+	}
+	inferFromPath(&book, root, templates)
+	if sidecar := readSidecar(filePath); sidecar != nil {
+		applySidecar(&book, sidecar)
+	}
 
-		if err != nil {
-			log.Printf("Failed to insert book %s: %v", title, err)
-			continue
-		}
+	fileHash, err := hashFile(filePath)
+	if err != nil {
+		log.Printf("Failed to hash %s: %v", filename, err)
+	}
 
-		addedBooks = append(addedBooks, book)
-		log.Printf("Added book: %s by %s", title, author)
+	// Insert into database
+	err = insertBook(book, fileHash)
+	if err != nil {
+		log.Printf("Failed to insert book %s: %v", book.Title, err)
+		return models.Book{}, false
 	}
 
-	return addedBooks, nil
+	validateNewBook(book.ID, filePath, fileType)
+	detectNewBookISBN(book.ID, filePath, fileType)
+	log.Printf("Added book: %s by %s", book.Title, book.Author)
+	return book, true
 }
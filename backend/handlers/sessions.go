@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// sessionGap is how long progress updates may pause before the next update
+// starts a new reading session instead of extending the current one.
+const sessionGap = 10 * time.Minute
+
+// positionLabel returns the position as stored on a session: the CFI for
+// reflowable formats and the page number for PDFs.
+func positionLabel(p *models.ReadingProgress) string {
+	if p == nil {
+		return ""
+	}
+	if p.Format == "pdf" {
+		if p.Page > 0 {
+			return strconv.Itoa(p.Page)
+		}
+		return ""
+	}
+	return p.CFI
+}
+
+// recordSession extends the book's latest session if it ended recently, or
+// starts a new one running from previous to current.
+func recordSession(userID, bookID string, previous, current *models.ReadingProgress, now time.Time) error {
+	var sessionID, startPosition string
+	var endedAt time.Time
+	err := db.DB.QueryRow(
+		"SELECT id, ended_at, COALESCE(start_position, '') FROM reading_sessions WHERE user_id = ? AND book_id = ? ORDER BY ended_at DESC LIMIT 1",
+		userID, bookID,
+	).Scan(&sessionID, &endedAt, &startPosition)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if err == nil && now.Sub(endedAt) <= sessionGap {
+		_, err = db.DB.Exec(
+			"UPDATE reading_sessions SET ended_at = ?, end_position = ?, end_fraction = ?, pages_read = ? WHERE id = ?",
+			now, positionLabel(current), current.Fraction, pagesBetween(current.Format, startPosition, positionLabel(current)), sessionID,
+		)
+		return err
+	}
+
+	start := previous
+	if positionLabel(start) == "" || start.Format != current.Format {
+		start = current
+	}
+	_, err = db.DB.Exec(
+		`INSERT INTO reading_sessions (id, user_id, book_id, started_at, ended_at, start_position, end_position, start_fraction, end_fraction, pages_read)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		uuid.New().String(), userID, bookID, now, now, positionLabel(start), positionLabel(current), start.Fraction, current.Fraction,
+		pagesBetween(current.Format, positionLabel(start), positionLabel(current)),
+	)
+	return err
+}
+
+func pagesBetween(fileType, start, end string) int {
+	if fileType != "pdf" {
+		return 0
+	}
+	from, err1 := strconv.Atoi(start)
+	to, err2 := strconv.Atoi(end)
+	if err1 != nil || err2 != nil || to < from {
+		return 0
+	}
+	return to - from
+}
+
+func GetBookSessions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bookID := vars["id"]
+
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.DB.Query(
+		`SELECT id, book_id, started_at, ended_at, COALESCE(start_position, ''), COALESCE(end_position, ''), start_fraction, end_fraction, pages_read
+		FROM reading_sessions WHERE user_id = ? AND book_id = ? ORDER BY started_at DESC`,
+		user.ID, bookID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch sessions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := make([]models.ReadingSession, 0)
+	for rows.Next() {
+		var s models.ReadingSession
+		err := rows.Scan(&s.ID, &s.BookID, &s.StartedAt, &s.EndedAt, &s.StartPosition, &s.EndPosition, &s.StartFraction, &s.EndFraction, &s.PagesRead)
+		if err != nil {
+			log.Println("Scan error:", err)
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
@@ -0,0 +1,375 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// loadBooksWithFacts returns every book alongside the facts smart shelves
+// filter on, as seen by userID.
+func loadBooksWithFacts(userID string) ([]models.Book, []BookFacts, error) {
+	rows, err := db.DB.Query(`
+		SELECT `+bookColumns+`,
+			(SELECT COUNT(*) FROM annotations a WHERE a.book_id = b.id AND a.user_id = ?),
+			(SELECT COUNT(*) FROM annotations a WHERE a.book_id = b.id AND a.user_id = ? AND a.note IS NOT NULL AND a.note != ''),
+			(SELECT value FROM book_identifiers i WHERE i.book_id = b.id AND i.type = 'isbn')
+		`+bookFrom+`
+		ORDER BY b.added_at DESC`, userID, userID, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	books := make([]models.Book, 0)
+	facts := make([]BookFacts, 0)
+	for rows.Next() {
+		var annotations, notes int
+		var isbn sql.NullString
+		book, err := scanBook(rows, &annotations, &notes, &isbn)
+		if err != nil {
+			log.Println("Scan error:", err)
+			continue
+		}
+		books = append(books, book)
+		facts = append(facts, BookFacts{
+			Title:       book.Title,
+			Author:      book.Author,
+			ISBN:        normalizeISBN(isbn.String),
+			FileType:    book.FileType,
+			FileSize:    book.FileSize,
+			AddedAt:     book.AddedAt,
+			Progress:    book.ProgressPercent,
+			Status:      book.Status,
+			Rating:      book.Rating,
+			Favorite:    book.Favorite,
+			Annotations: annotations,
+			Notes:       notes,
+		})
+	}
+	return books, facts, rows.Err()
+}
+
+func matchingBooks(filter *Filter, books []models.Book, facts []BookFacts) []models.Book {
+	matched := make([]models.Book, 0)
+	for i := range books {
+		if filter.Match(&facts[i]) {
+			matched = append(matched, books[i])
+		}
+	}
+	return matched
+}
+
+func GetShelves(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT s.id, s.name, s.query, s.created_at,
+			(SELECT COUNT(*) FROM shelf_books sb JOIN books b ON b.id = sb.book_id`+bookAccess+` WHERE sb.shelf_id = s.id)
+		FROM shelves s WHERE s.user_id = ? ORDER BY s.name COLLATE NOCASE`, user.ID, user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch shelves", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	shelves := make([]models.Shelf, 0)
+	hasSmart := false
+	for rows.Next() {
+		var shelf models.Shelf
+		if err := rows.Scan(&shelf.ID, &shelf.Name, &shelf.Query, &shelf.CreatedAt, &shelf.BookCount); err != nil {
+			log.Println("Scan error:", err)
+			continue
+		}
+		shelf.Smart = shelf.Query != ""
+		hasSmart = hasSmart || shelf.Smart
+		shelves = append(shelves, shelf)
+	}
+	rows.Close()
+
+	if hasSmart {
+		books, facts, err := loadBooksWithFacts(user.ID)
+		if err != nil {
+			http.Error(w, "Failed to fetch shelves", http.StatusInternalServerError)
+			return
+		}
+		for i := range shelves {
+			if !shelves[i].Smart {
+				continue
+			}
+			filter, err := ParseFilter(shelves[i].Query)
+			if err != nil {
+				log.Printf("Shelf %s has invalid query: %v", shelves[i].ID, err)
+				shelves[i].BookCount = 0
+				continue
+			}
+			shelves[i].BookCount = len(matchingBooks(filter, books, facts))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shelves)
+}
+
+func CreateShelf(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	input.Name = strings.TrimSpace(input.Name)
+	input.Query = strings.TrimSpace(input.Query)
+	if input.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if input.Query != "" {
+		if _, err := ParseFilter(input.Query); err != nil {
+			http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	shelf := models.Shelf{
+		ID:        uuid.New().String(),
+		Name:      input.Name,
+		Query:     input.Query,
+		Smart:     input.Query != "",
+		CreatedAt: time.Now(),
+	}
+
+	_, err := db.DB.Exec(
+		"INSERT INTO shelves (id, user_id, name, query, created_at) VALUES (?, ?, ?, ?, ?)",
+		shelf.ID, user.ID, shelf.Name, shelf.Query, shelf.CreatedAt,
+	)
+	if err != nil {
+		http.Error(w, "Failed to create shelf", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(shelf)
+}
+
+func UpdateShelf(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	shelfID := vars["id"]
+
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	input.Name = strings.TrimSpace(input.Name)
+	input.Query = strings.TrimSpace(input.Query)
+	if input.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if input.Query != "" {
+		if _, err := ParseFilter(input.Query); err != nil {
+			http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := db.DB.Exec("UPDATE shelves SET name = ?, query = ? WHERE id = ? AND user_id = ?", input.Name, input.Query, shelfID, user.ID)
+	if err != nil {
+		http.Error(w, "Failed to update shelf", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Shelf not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func DeleteShelf(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	shelfID := vars["id"]
+
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var exists string
+	if err := db.DB.QueryRow("SELECT id FROM shelves WHERE id = ? AND user_id = ?", shelfID, user.ID).Scan(&exists); err != nil {
+		http.Error(w, "Shelf not found", http.StatusNotFound)
+		return
+	}
+
+	_, err := db.DB.Exec("DELETE FROM shelf_books WHERE shelf_id = ?", shelfID)
+	if err != nil {
+		http.Error(w, "Failed to delete shelf", http.StatusInternalServerError)
+		return
+	}
+	_, err = db.DB.Exec("DELETE FROM shelves WHERE id = ?", shelfID)
+	if err != nil {
+		http.Error(w, "Failed to delete shelf", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+func GetShelfBooks(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	shelfID := vars["id"]
+
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var query string
+	err := db.DB.QueryRow("SELECT query FROM shelves WHERE id = ? AND user_id = ?", shelfID, user.ID).Scan(&query)
+	if err != nil {
+		http.Error(w, "Shelf not found", http.StatusNotFound)
+		return
+	}
+
+	books, facts, err := loadBooksWithFacts(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch books", http.StatusInternalServerError)
+		return
+	}
+
+	var result []models.Book
+	if query != "" {
+		filter, err := ParseFilter(query)
+		if err != nil {
+			http.Error(w, "Invalid shelf query: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result = matchingBooks(filter, books, facts)
+	} else {
+		rows, err := db.DB.Query("SELECT book_id FROM shelf_books WHERE shelf_id = ?", shelfID)
+		if err != nil {
+			http.Error(w, "Failed to fetch books", http.StatusInternalServerError)
+			return
+		}
+		members := make(map[string]bool)
+		for rows.Next() {
+			var bookID string
+			if err := rows.Scan(&bookID); err == nil {
+				members[bookID] = true
+			}
+		}
+		rows.Close()
+
+		result = make([]models.Book, 0)
+		for _, book := range books {
+			if members[book.ID] {
+				result = append(result, book)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func AddBookToShelf(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	shelfID := vars["id"]
+
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		BookID string `json:"bookId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil || input.BookID == "" {
+		http.Error(w, "bookId is required", http.StatusBadRequest)
+		return
+	}
+
+	var query string
+	err := db.DB.QueryRow("SELECT query FROM shelves WHERE id = ? AND user_id = ?", shelfID, user.ID).Scan(&query)
+	if err != nil {
+		http.Error(w, "Shelf not found", http.StatusNotFound)
+		return
+	}
+	if query != "" {
+		http.Error(w, "Books cannot be added to a smart shelf", http.StatusBadRequest)
+		return
+	}
+
+	var exists string
+	if err := db.DB.QueryRow("SELECT b.id FROM books b"+bookAccess+" WHERE b.id = ?", user.ID, input.BookID).Scan(&exists); err != nil {
+		http.Error(w, "Book not found", http.StatusNotFound)
+		return
+	}
+
+	_, err = db.DB.Exec(
+		"INSERT OR IGNORE INTO shelf_books (shelf_id, book_id, added_at) VALUES (?, ?, ?)",
+		shelfID, input.BookID, time.Now(),
+	)
+	if err != nil {
+		http.Error(w, "Failed to add book to shelf", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func RemoveBookFromShelf(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	shelfID := vars["id"]
+	bookID := vars["bookId"]
+
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := db.DB.Exec(
+		"DELETE FROM shelf_books WHERE shelf_id = (SELECT id FROM shelves WHERE id = ? AND user_id = ?) AND book_id = ?",
+		shelfID, user.ID, bookID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to remove book from shelf", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
@@ -0,0 +1,502 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// maxSidecarSize bounds the metadata files the scanner reads.
+const maxSidecarSize = 1 << 20
+
+var sidecarMetadataExtensions = []string{".opf", ".json", ".nfo"}
+
+var sidecarCoverExtensions = []string{".jpg", ".jpeg", ".png", ".webp"}
+
+// ignoredIdentifiers are schemes that only mean something inside the library
+// that wrote the sidecar.
+var ignoredIdentifiers = map[string]bool{"calibre": true, "uuid": true, "bookland": true}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// sidecarBase returns a book file's path without its extension, which
+// sidecars beside it share.
+func sidecarBase(filePath string) string {
+	return strings.TrimSuffix(filePath, filepath.Ext(filePath))
+}
+
+// singleTitleDir reports whether every book file in dir is a format of the
+// same title, as in a Calibre library, so the folder's own metadata.opf and
+// cover.jpg describe it.
+func singleTitleDir(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	title := ""
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if _, ok := supportedTypes[strings.ToLower(filepath.Ext(entry.Name()))]; !ok {
+			continue
+		}
+		base := sidecarBase(entry.Name())
+		if title != "" && base != title {
+			return false
+		}
+		title = base
+	}
+	return title != ""
+}
+
+// sidecarCandidates lists where a sidecar for a book file may be, in order of
+// preference: named after the file, then named after the folder's purpose.
+func sidecarCandidates(filePath string, folderNames, extensions []string) []string {
+	var candidates []string
+	base := sidecarBase(filePath)
+	for _, ext := range extensions {
+		candidates = append(candidates, base+ext)
+	}
+	dir := filepath.Dir(filePath)
+	if singleTitleDir(dir) {
+		for _, name := range folderNames {
+			for _, ext := range extensions {
+				candidates = append(candidates, filepath.Join(dir, name+ext))
+			}
+		}
+	}
+	return candidates
+}
+
+// readSidecar returns the metadata in the first sidecar found beside a book
+// file, or nil if there is none.
+func readSidecar(filePath string) *models.Book {
+	for _, candidate := range sidecarCandidates(filePath, []string{"metadata"}, sidecarMetadataExtensions) {
+		file, err := os.Open(candidate)
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(file, maxSidecarSize))
+		file.Close()
+		if err != nil {
+			continue
+		}
+
+		var book *models.Book
+		switch filepath.Ext(candidate) {
+		case ".opf":
+			book, err = parseOPFSidecar(data)
+		case ".json":
+			book, err = parseJSONSidecar(data)
+		case ".nfo":
+			book, err = parseNFOSidecar(data)
+		}
+		if err != nil {
+			log.Printf("Ignoring sidecar %s: %v", candidate, err)
+			continue
+		}
+		return book
+	}
+	return nil
+}
+
+// sidecarCover returns the cover image beside a book file, or "".
+func sidecarCover(filePath string) string {
+	for _, candidate := range sidecarCandidates(filePath, []string{"cover", "folder"}, sidecarCoverExtensions) {
+		file, err := os.Open(candidate)
+		if err != nil {
+			continue
+		}
+		head := make([]byte, 16)
+		n, _ := io.ReadFull(file, head)
+		file.Close()
+		if IsImageFile(head[:n]) {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// applySidecar overrides a book's metadata with what the sidecar provides.
+func applySidecar(book *models.Book, sidecar *models.Book) {
+	if sidecar.Title != "" {
+		book.Title = sidecar.Title
+	}
+	if sidecar.Author != "" {
+		book.Author = sidecar.Author
+	}
+	if sidecar.Series != "" {
+		book.Series = sidecar.Series
+		book.SeriesIndex = sidecar.SeriesIndex
+	}
+	if sidecar.Description != "" {
+		book.Description = sidecar.Description
+	}
+	if len(sidecar.Tags) > 0 {
+		book.Tags = sidecar.Tags
+	}
+	for kind, value := range sidecar.Identifiers {
+		if ignoredIdentifiers[kind] {
+			continue
+		}
+		if book.Identifiers == nil {
+			book.Identifiers = map[string]string{}
+		}
+		book.Identifiers[kind] = value
+	}
+}
+
+// opfSidecar is the metadata section of an OPF file, such as Calibre's
+// metadata.opf.
+type opfSidecar struct {
+	Metadata struct {
+		Titles   []string `xml:"title"`
+		Creators []struct {
+			Name string `xml:",chardata"`
+			Role string `xml:"role,attr"`
+		} `xml:"creator"`
+		Description string   `xml:"description"`
+		Subjects    []string `xml:"subject"`
+		Identifiers []struct {
+			Value  string `xml:",chardata"`
+			Scheme string `xml:"scheme,attr"`
+		} `xml:"identifier"`
+		Metas []struct {
+			ID       string `xml:"id,attr"`
+			Name     string `xml:"name,attr"`
+			Content  string `xml:"content,attr"`
+			Property string `xml:"property,attr"`
+			Refines  string `xml:"refines,attr"`
+			Value    string `xml:",chardata"`
+		} `xml:"meta"`
+	} `xml:"metadata"`
+}
+
+func parseOPFSidecar(data []byte) (*models.Book, error) {
+	var opf opfSidecar
+	if err := xml.Unmarshal(data, &opf); err != nil {
+		return nil, err
+	}
+	m := opf.Metadata
+
+	book := &models.Book{Identifiers: map[string]string{}}
+	if len(m.Titles) > 0 {
+		book.Title = strings.TrimSpace(m.Titles[0])
+	}
+	var authors []string
+	for _, creator := range m.Creators {
+		if creator.Role == "" || creator.Role == "aut" {
+			authors = append(authors, strings.TrimSpace(creator.Name))
+		}
+	}
+	book.Author = strings.Join(authors, " & ")
+	book.Description = strings.TrimSpace(m.Description)
+	book.Tags = m.Subjects
+
+	for _, identifier := range m.Identifiers {
+		scheme, value := strings.ToLower(identifier.Scheme), strings.TrimSpace(identifier.Value)
+		if scheme == "" {
+			// EPUB 3 puts the scheme in the value, as in urn:isbn:….
+			if rest, ok := strings.CutPrefix(strings.ToLower(value), "urn:"); ok {
+				scheme, value, _ = strings.Cut(rest, ":")
+			}
+		}
+		if scheme != "" && value != "" {
+			book.Identifiers[scheme] = value
+		}
+	}
+
+	// Calibre's series metadata, then EPUB 3 collections.
+	collections := map[string]string{}
+	for _, meta := range m.Metas {
+		switch {
+		case meta.Name == "calibre:series":
+			book.Series = meta.Content
+		case meta.Name == "calibre:series_index":
+			if index, err := strconv.ParseFloat(meta.Content, 64); err == nil {
+				book.SeriesIndex = &index
+			}
+		case meta.Property == "belongs-to-collection" && book.Series == "":
+			book.Series = strings.TrimSpace(meta.Value)
+			collections["#"+meta.ID] = book.Series
+		}
+	}
+	for _, meta := range m.Metas {
+		if meta.Property == "group-position" && collections[meta.Refines] == book.Series && book.SeriesIndex == nil {
+			if index, err := strconv.ParseFloat(strings.TrimSpace(meta.Value), 64); err == nil {
+				book.SeriesIndex = &index
+			}
+		}
+	}
+	return book, nil
+}
+
+// parseJSONSidecar reads metadata in the shape of Bookland's own book JSON,
+// also accepting a list of authors.
+func parseJSONSidecar(data []byte) (*models.Book, error) {
+	var sidecar struct {
+		models.Book
+		Authors []string `json:"authors"`
+	}
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		return nil, err
+	}
+	book := sidecar.Book
+	if book.Author == "" && len(sidecar.Authors) > 0 {
+		book.Author = strings.Join(sidecar.Authors, " & ")
+	}
+	return &book, nil
+}
+
+// parseNFOSidecar reads an NFO file, either XML as media managers write them
+// or plain "Key: value" lines.
+func parseNFOSidecar(data []byte) (*models.Book, error) {
+	fields := map[string][]string{}
+	if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte("<")) {
+		decoder := xml.NewDecoder(bytes.NewReader(trimmed))
+		decoder.Strict = false
+		var element string
+		for {
+			token, err := decoder.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			switch t := token.(type) {
+			case xml.StartElement:
+				element = strings.ToLower(t.Name.Local)
+			case xml.CharData:
+				if value := strings.TrimSpace(string(t)); value != "" && element != "" {
+					fields[element] = append(fields[element], value)
+				}
+			case xml.EndElement:
+				element = ""
+			}
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			key, value, ok := strings.Cut(scanner.Text(), ":")
+			if value = strings.TrimSpace(value); ok && value != "" {
+				key = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(key), " ", ""))
+				fields[key] = append(fields[key], value)
+			}
+		}
+	}
+
+	first := func(keys ...string) string {
+		for _, key := range keys {
+			if values := fields[key]; len(values) > 0 {
+				return values[0]
+			}
+		}
+		return ""
+	}
+	all := func(keys ...string) []string {
+		var values []string
+		for _, key := range keys {
+			values = append(values, fields[key]...)
+		}
+		return values
+	}
+
+	book := &models.Book{
+		Title:       first("title"),
+		Author:      strings.Join(all("author", "creator", "writer"), " & "),
+		Series:      first("series", "set"),
+		Description: first("description", "plot", "summary", "synopsis", "outline"),
+		Tags:        all("genre", "tag", "subject"),
+		Identifiers: map[string]string{},
+	}
+	if index, err := strconv.ParseFloat(first("seriesindex", "series_index", "seriesnumber", "volume"), 64); err == nil {
+		book.SeriesIndex = &index
+	}
+	if isbn := first("isbn"); isbn != "" {
+		book.Identifiers["isbn"] = isbn
+	}
+	if book.Title == "" && book.Author == "" {
+		return nil, fmt.Errorf("no title or author found")
+	}
+	return book, nil
+}
+
+// opfText escapes text for an OPF file.
+func opfText(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// writeOPFSidecar writes a book's metadata in the form Calibre reads.
+func writeOPFSidecar(w io.Writer, book *models.Book) error {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	b.WriteString(`<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="bookland_id">` + "\n")
+	b.WriteString(`  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">` + "\n")
+	fmt.Fprintf(&b, "    <dc:identifier opf:scheme=\"bookland\" id=\"bookland_id\">%s</dc:identifier>\n", opfText(book.ID))
+	fmt.Fprintf(&b, "    <dc:title>%s</dc:title>\n", opfText(book.Title))
+	if book.Author != "" {
+		for _, author := range strings.Split(book.Author, " & ") {
+			fmt.Fprintf(&b, "    <dc:creator opf:role=\"aut\">%s</dc:creator>\n", opfText(author))
+		}
+	}
+	if book.Description != "" {
+		fmt.Fprintf(&b, "    <dc:description>%s</dc:description>\n", opfText(book.Description))
+	}
+	for _, tag := range book.Tags {
+		fmt.Fprintf(&b, "    <dc:subject>%s</dc:subject>\n", opfText(tag))
+	}
+	for kind, value := range book.Identifiers {
+		fmt.Fprintf(&b, "    <dc:identifier opf:scheme=\"%s\">%s</dc:identifier>\n", opfText(kind), opfText(value))
+	}
+	if book.Series != "" {
+		fmt.Fprintf(&b, "    <meta name=\"calibre:series\" content=\"%s\"/>\n", opfText(book.Series))
+		if book.SeriesIndex != nil {
+			fmt.Fprintf(&b, "    <meta name=\"calibre:series_index\" content=\"%s\"/>\n", strconv.FormatFloat(*book.SeriesIndex, 'f', -1, 64))
+		}
+	}
+	b.WriteString("  </metadata>\n</package>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeSidecarFile replaces path with what write produces, via a temporary
+// file so a failed export leaves the old sidecar in place.
+func writeSidecarFile(path string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".sidecar-*")
+	if err != nil {
+		return err
+	}
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	os.Chmod(tmp.Name(), 0644)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// ExportSidecars writes a metadata sidecar beside every book in a library,
+// and its cover when there is none beside it yet, so the metadata travels
+// with the files. ?format=json writes Bookland's JSON instead of OPF.
+func ExportSidecars(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	libraryID := vars["id"]
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "opf"
+	}
+	if format != "opf" && format != "json" {
+		http.Error(w, "format must be opf or json", http.StatusBadRequest)
+		return
+	}
+
+	var exists string
+	if err := db.DB.QueryRow("SELECT id FROM libraries WHERE id = ?", libraryID).Scan(&exists); err != nil {
+		http.Error(w, "Library not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := db.DB.Query(
+		"SELECT "+bookColumns+bookFrom+" WHERE b.library_id = ? ORDER BY b.title",
+		currentUserID(r), libraryID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch books", http.StatusInternalServerError)
+		return
+	}
+	var books []models.Book
+	for rows.Next() {
+		if book, err := scanBook(rows); err == nil {
+			books = append(books, book)
+		}
+	}
+	rows.Close()
+
+	result := models.SidecarExport{Failures: []models.ImportFailure{}}
+	for i := range books {
+		book := &books[i]
+		if err := loadBookMetadata(book); err != nil {
+			result.Failed++
+			result.Failures = append(result.Failures, models.ImportFailure{Title: book.Title, Reason: "Failed to load metadata"})
+			continue
+		}
+		if err := exportSidecar(book, format); err != nil {
+			log.Printf("Failed to write sidecar for %s: %v", book.FilePath, err)
+			result.Failed++
+			if len(result.Failures) < maxImportFailures {
+				result.Failures = append(result.Failures, models.ImportFailure{Title: book.Title, Reason: err.Error()})
+			}
+			continue
+		}
+		result.Written++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func exportSidecar(book *models.Book, format string) error {
+	base := sidecarBase(book.FilePath)
+	path := base + "." + format
+	// A folder's own metadata.opf is kept up to date rather than shadowed
+	if folderPath := filepath.Join(filepath.Dir(path), "metadata."+format); !fileExists(path) && fileExists(folderPath) && singleTitleDir(filepath.Dir(path)) {
+		path = folderPath
+	}
+	err := writeSidecarFile(path, func(out io.Writer) error {
+		if format == "json" {
+			encoder := json.NewEncoder(out)
+			encoder.SetEscapeHTML(false)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(struct {
+				Title       string            `json:"title"`
+				Author      string            `json:"author,omitempty"`
+				Series      string            `json:"series,omitempty"`
+				SeriesIndex *float64          `json:"seriesIndex,omitempty"`
+				Description string            `json:"description,omitempty"`
+				Tags        []string          `json:"tags,omitempty"`
+				Identifiers map[string]string `json:"identifiers,omitempty"`
+			}{book.Title, book.Author, book.Series, book.SeriesIndex, book.Description, book.Tags, book.Identifiers})
+		}
+		return writeOPFSidecar(out, book)
+	})
+	if err != nil {
+		return fmt.Errorf("could not write the sidecar")
+	}
+
+	if book.CoverPath != "" && sidecarCover(book.FilePath) == "" {
+		ext := strings.ToLower(filepath.Ext(book.CoverPath))
+		if err := copyFile(book.CoverPath, base+ext); err != nil {
+			return fmt.Errorf("could not write the cover")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type dayTotal struct {
+	Date    string  `json:"date"`
+	Seconds float64 `json:"seconds"`
+}
+
+type weekTotal struct {
+	WeekStart string  `json:"weekStart"`
+	Seconds   float64 `json:"seconds"`
+}
+
+type monthCount struct {
+	Month string `json:"month"`
+	Count int    `json:"count"`
+}
+
+type formatSpeed struct {
+	Format         string  `json:"format"`
+	Seconds        float64 `json:"seconds"`
+	PercentRead    float64 `json:"percentRead"`
+	PercentPerHour float64 `json:"percentPerHour"`
+	PagesPerHour   float64 `json:"pagesPerHour,omitempty"`
+}
+
+type finishEstimate struct {
+	BookID           string     `json:"bookId"`
+	Title            string     `json:"title"`
+	Percent          float64    `json:"percent"`
+	SecondsRead      float64    `json:"secondsRead"`
+	SecondsRemaining float64    `json:"secondsRemaining"`
+	EstimatedFinish  *time.Time `json:"estimatedFinish,omitempty"`
+	// Basis is "book" when the estimate uses this book's own reading speed and
+	// "format" when it falls back to the average for the book's format.
+	Basis string `json:"basis"`
+}
+
+type readingStats struct {
+	TotalSeconds     float64          `json:"totalSeconds"`
+	Daily            []dayTotal       `json:"daily"`
+	Weekly           []weekTotal      `json:"weekly"`
+	FinishedPerMonth []monthCount     `json:"finishedPerMonth"`
+	CurrentStreak    int              `json:"currentStreak"`
+	LongestStreak    int              `json:"longestStreak"`
+	SpeedByFormat    []formatSpeed    `json:"speedByFormat"`
+	Estimates        []finishEstimate `json:"estimates"`
+}
+
+// readingTotals accumulates time and distance read for a book or a format.
+type readingTotals struct {
+	seconds float64
+	percent float64
+	pages   int
+}
+
+func (t *readingTotals) add(seconds, percent float64, pages int) {
+	t.seconds += seconds
+	t.percent += percent
+	t.pages += pages
+}
+
+// speed returns the reading speed in percent per second.
+func (t *readingTotals) speed() float64 {
+	if t.seconds <= 0 || t.percent <= 0 {
+		return 0
+	}
+	return t.percent / t.seconds
+}
+
+type sessionWithFormat struct {
+	models.ReadingSession
+	format string
+}
+
+// GetStats summarises reading sessions. The days, weeks and months query
+// parameters control how far back the daily, weekly and monthly series go.
+func GetStats(w http.ResponseWriter, r *http.Request) {
+	days := intParam(r, "days", 30)
+	weeks := intParam(r, "weeks", 12)
+	months := intParam(r, "months", 12)
+	now := time.Now()
+
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT s.id, s.book_id, s.started_at, s.ended_at, s.start_fraction, s.end_fraction, s.pages_read, b.file_type
+		FROM reading_sessions s JOIN books b ON b.id = s.book_id
+		WHERE s.user_id = ?
+		ORDER BY s.started_at`, user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch sessions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var sessions []sessionWithFormat
+	for rows.Next() {
+		var s sessionWithFormat
+		err := rows.Scan(&s.ID, &s.BookID, &s.StartedAt, &s.EndedAt, &s.StartFraction, &s.EndFraction, &s.PagesRead, &s.format)
+		if err != nil {
+			log.Println("Scan error:", err)
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	rows.Close()
+
+	stats := readingStats{
+		Daily:            make([]dayTotal, 0, days),
+		Weekly:           make([]weekTotal, 0, weeks),
+		FinishedPerMonth: make([]monthCount, 0, months),
+		SpeedByFormat:    make([]formatSpeed, 0),
+		Estimates:        make([]finishEstimate, 0),
+	}
+
+	perDay := make(map[string]float64)
+	perWeek := make(map[string]float64)
+	perBook := make(map[string]*readingTotals)
+	perFormat := make(map[string]*readingTotals)
+	for _, s := range sessions {
+		seconds := s.EndedAt.Sub(s.StartedAt).Seconds()
+		start := s.StartedAt.In(now.Location())
+		stats.TotalSeconds += seconds
+		perDay[start.Format("2006-01-02")] += seconds
+		perWeek[weekStart(start).Format("2006-01-02")] += seconds
+
+		read := (s.EndFraction - s.StartFraction) * 100
+		if read < 0 {
+			read = 0
+		}
+		book := perBook[s.BookID]
+		if book == nil {
+			book = &readingTotals{}
+			perBook[s.BookID] = book
+		}
+		book.add(seconds, read, s.PagesRead)
+
+		format := perFormat[s.format]
+		if format == nil {
+			format = &readingTotals{}
+			perFormat[s.format] = format
+		}
+		format.add(seconds, read, s.PagesRead)
+	}
+
+	today := startOfDay(now)
+	for i := days - 1; i >= 0; i-- {
+		date := today.AddDate(0, 0, -i).Format("2006-01-02")
+		stats.Daily = append(stats.Daily, dayTotal{Date: date, Seconds: perDay[date]})
+	}
+	thisWeek := weekStart(now)
+	for i := weeks - 1; i >= 0; i-- {
+		week := thisWeek.AddDate(0, 0, -7*i).Format("2006-01-02")
+		stats.Weekly = append(stats.Weekly, weekTotal{WeekStart: week, Seconds: perWeek[week]})
+	}
+
+	stats.CurrentStreak, stats.LongestStreak = streaks(perDay, today)
+
+	for name, format := range perFormat {
+		speed := formatSpeed{Format: name, Seconds: format.seconds, PercentRead: format.percent}
+		if format.seconds > 0 {
+			hours := format.seconds / 3600
+			speed.PercentPerHour = format.percent / hours
+			speed.PagesPerHour = float64(format.pages) / hours
+		}
+		stats.SpeedByFormat = append(stats.SpeedByFormat, speed)
+	}
+	sort.Slice(stats.SpeedByFormat, func(i, j int) bool {
+		return stats.SpeedByFormat[i].Format < stats.SpeedByFormat[j].Format
+	})
+
+	finished := make(map[string]int)
+	finishedRows, err := db.DB.Query(
+		"SELECT finished_at FROM user_books WHERE user_id = ? AND status = ? AND finished_at IS NOT NULL",
+		user.ID, models.StatusFinished,
+	)
+	if err == nil {
+		for finishedRows.Next() {
+			var finishedAt time.Time
+			if err := finishedRows.Scan(&finishedAt); err == nil {
+				finished[finishedAt.In(now.Location()).Format("2006-01")]++
+			}
+		}
+		finishedRows.Close()
+	}
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	for i := months - 1; i >= 0; i-- {
+		month := thisMonth.AddDate(0, -i, 0).Format("2006-01")
+		stats.FinishedPerMonth = append(stats.FinishedPerMonth, monthCount{Month: month, Count: finished[month]})
+	}
+
+	readingRows, err := db.DB.Query("SELECT "+bookColumns+bookFrom+" WHERE ub.status = ? ORDER BY b.title", user.ID, models.StatusReading)
+	if err == nil {
+		for readingRows.Next() {
+			book, err := scanBook(readingRows)
+			if err != nil {
+				continue
+			}
+			estimate := finishEstimate{
+				BookID:  book.ID,
+				Title:   book.Title,
+				Percent: book.ProgressPercent,
+			}
+			var speed float64 // percent per second
+			if own := perBook[book.ID]; own != nil {
+				estimate.SecondsRead = own.seconds
+				if speed = own.speed(); speed > 0 {
+					estimate.Basis = "book"
+				}
+			}
+			if speed == 0 {
+				if format := perFormat[book.FileType]; format != nil {
+					if speed = format.speed(); speed > 0 {
+						estimate.Basis = "format"
+					}
+				}
+			}
+			if speed > 0 {
+				estimate.SecondsRemaining = (100 - estimate.Percent) / speed
+				if estimate.SecondsRemaining < 0 {
+					estimate.SecondsRemaining = 0
+				}
+				if avg := averageDailySeconds(stats.Daily); avg > 0 {
+					daysLeft := estimate.SecondsRemaining / avg
+					finish := now.Add(time.Duration(daysLeft * 24 * float64(time.Hour)))
+					estimate.EstimatedFinish = &finish
+				}
+			}
+			stats.Estimates = append(stats.Estimates, estimate)
+		}
+		readingRows.Close()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func intParam(r *http.Request, name string, fallback int) int {
+	n, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || n <= 0 || n > 3660 {
+		return fallback
+	}
+	return n
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// weekStart returns midnight on the Monday of t's week.
+func weekStart(t time.Time) time.Time {
+	day := startOfDay(t)
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// streaks counts consecutive days with any reading. The current streak is
+// still alive if the last reading day was today or yesterday.
+func streaks(perDay map[string]float64, today time.Time) (current, longest int) {
+	if len(perDay) == 0 {
+		return 0, 0
+	}
+	dates := make([]string, 0, len(perDay))
+	for date := range perDay {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+
+	run := 0
+	var prev time.Time
+	for _, date := range dates {
+		day, err := time.ParseInLocation("2006-01-02", date, today.Location())
+		if err != nil {
+			continue
+		}
+		if run > 0 && day.Equal(prev.AddDate(0, 0, 1)) {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longest {
+			longest = run
+		}
+		prev = day
+	}
+
+	if prev.Equal(today) || prev.Equal(today.AddDate(0, 0, -1)) {
+		current = run
+	}
+	return current, longest
+}
+
+func averageDailySeconds(daily []dayTotal) float64 {
+	if len(daily) == 0 {
+		return 0
+	}
+	var total float64
+	for _, d := range daily {
+		total += d.Seconds
+	}
+	return total / float64(len(daily))
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Token scopes limit what a request made with the token may do, on top of
+// the owner's role: read only fetches, upload also adds books and records
+// reading data, and admin allows whatever the role does. Web sessions and
+// Basic logins with the account password act with the admin scope.
+const (
+	ScopeRead   = "read"
+	ScopeUpload = "upload"
+	ScopeAdmin  = "admin"
+)
+
+// apiTokenPrefix marks API tokens so they can be told apart from passwords
+// in Basic credentials.
+const apiTokenPrefix = "bl_"
+
+// How often last_used_at is refreshed for a token in constant use.
+const tokenUsageResolution = time.Minute
+
+func userForToken(token string) (*models.User, string, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, "", errInvalidCredentials
+	}
+
+	var user models.User
+	var tokenID, scope string
+	var lastUsed *time.Time
+	err := db.DB.QueryRow(
+		`SELECT t.id, t.scope, t.last_used_at, u.id, u.username, u.role, u.created_at
+		FROM api_tokens t JOIN users u ON u.id = t.user_id WHERE t.token_hash = ?`,
+		hashToken(token),
+	).Scan(&tokenID, &scope, &lastUsed, &user.ID, &user.Username, &user.Role, &user.CreatedAt)
+	if err != nil {
+		return nil, "", errInvalidCredentials
+	}
+
+	now := time.Now()
+	if lastUsed == nil || now.Sub(*lastUsed) >= tokenUsageResolution {
+		if _, err := db.DB.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", now, tokenID); err != nil {
+			log.Printf("Failed to record token use: %v", err)
+		}
+	}
+	return &user, scope, nil
+}
+
+func GetTokens(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.DB.Query(
+		"SELECT id, name, scope, created_at, last_used_at FROM api_tokens WHERE user_id = ? ORDER BY created_at DESC",
+		user.ID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch tokens", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tokens := make([]models.APIToken, 0)
+	for rows.Next() {
+		var t models.APIToken
+		if err := rows.Scan(&t.ID, &t.Name, &t.Scope, &t.CreatedAt, &t.LastUsedAt); err != nil {
+			continue
+		}
+		tokens = append(tokens, t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// CreateToken issues a new API token. The secret is only ever shown in this
+// response; the database keeps a hash.
+func CreateToken(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Name  string `json:"name"`
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" {
+		http.Error(w, "Token name is required", http.StatusBadRequest)
+		return
+	}
+	if _, ok := scopePermissions[input.Scope]; !ok {
+		http.Error(w, "Scope must be read, upload or admin", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	token := models.APIToken{
+		ID:        uuid.New().String(),
+		Name:      input.Name,
+		Scope:     input.Scope,
+		Token:     apiTokenPrefix + secret,
+		CreatedAt: time.Now(),
+	}
+	_, err = db.DB.Exec(
+		"INSERT INTO api_tokens (id, user_id, name, token_hash, scope, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		token.ID, user.ID, token.Name, hashToken(token.Token), token.Scope, token.CreatedAt,
+	)
+	if err != nil {
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+func RevokeToken(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenID := vars["id"]
+
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := db.DB.Exec("DELETE FROM api_tokens WHERE id = ? AND user_id = ?", tokenID, user.ID)
+	if err != nil {
+		http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TrashRetention is how long deleted books stay in the trash before they are
+// purged automatically. Zero keeps them until the trash is emptied.
+var TrashRetention = 30 * 24 * time.Hour
+
+// bookStorageDir is where a book's uploaded file, extracted cover and other
+// generated files live.
+func bookStorageDir(bookID string) string {
+	return filepath.Join(DataPath, "books", bookID)
+}
+
+func removeBookStorage(bookID string) {
+	if err := os.RemoveAll(bookStorageDir(bookID)); err != nil {
+		log.Printf("Warning: failed to delete storage for book %s: %v", bookID, err)
+	}
+}
+
+// purgeBooks removes books, everyone's reading data for them, and their
+// storage directories. Files in scan roots are left alone, but remembered so
+// that scans do not add them again.
+func purgeBooks(bookIDs []string) error {
+	var scanned []bookFormat
+	for _, bookID := range bookIDs {
+		formats, err := loadBookFormats(bookID)
+		if err != nil {
+			return err
+		}
+		for _, format := range formats {
+			if !inStorageDir(bookID, format.FilePath) {
+				scanned = append(scanned, format)
+			}
+		}
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	for _, format := range scanned {
+		_, err := tx.Exec(
+			`INSERT OR REPLACE INTO purged_files (file_path, file_hash, purged_at)
+			SELECT file_path, COALESCE(file_hash, ''), ? FROM book_formats WHERE book_id = ? AND file_type = ?`,
+			now, format.BookID, format.FileType,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	for _, bookID := range bookIDs {
+		for _, statement := range []string{
+			"DELETE FROM shelf_books WHERE book_id = ?",
+			"DELETE FROM annotations WHERE book_id = ?",
+			"DELETE FROM reading_sessions WHERE book_id = ?",
+			"DELETE FROM device_progress WHERE book_id = ?",
+			"DELETE FROM user_books WHERE book_id = ?",
+			"DELETE FROM book_validations WHERE book_id = ?",
+			"DELETE FROM book_tags WHERE book_id = ?",
+			"DELETE FROM book_identifiers WHERE book_id = ?",
+			"DELETE FROM book_formats WHERE book_id = ?",
+			"DELETE FROM book_conversions WHERE book_id = ?",
+			"DELETE FROM books WHERE id = ?",
+		} {
+			if _, err := tx.Exec(statement, bookID); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, bookID := range bookIDs {
+		removeBookStorage(bookID)
+	}
+	return nil
+}
+
+// trashedBookIDs lists the trashed books the user may see, optionally only one.
+func trashedBookIDs(r *http.Request, bookID string) ([]string, error) {
+	query := "SELECT b.id FROM books b" + bookVisible + " WHERE b.deleted_at IS NOT NULL"
+	args := []any{currentUserID(r)}
+	if bookID != "" {
+		query += " AND b.id = ?"
+		args = append(args, bookID)
+	}
+
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, rows.Err()
+}
+
+// PurgeExpiredTrash purges books that have been in the trash longer than
+// TrashRetention, returning how many were removed.
+func PurgeExpiredTrash() int {
+	if TrashRetention <= 0 {
+		return 0
+	}
+
+	rows, err := db.DB.Query("SELECT id FROM books WHERE deleted_at IS NOT NULL AND deleted_at < ?", time.Now().Add(-TrashRetention))
+	if err != nil {
+		log.Printf("Warning: Failed to list expired trash: %v", err)
+		return 0
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return 0
+	}
+
+	records := make(map[string]*bookRecord, len(ids))
+	for _, id := range ids {
+		records[id], _ = loadBookRecord(id)
+	}
+	if err := purgeBooks(ids); err != nil {
+		log.Printf("Warning: Failed to purge expired trash: %v", err)
+		return 0
+	}
+	for _, id := range ids {
+		recordAudit(nil, AuditBookPurge, "book", id, records[id], nil)
+	}
+	return len(ids)
+}
+
+// GetTrash lists the trashed books in the user's libraries, most recently
+// deleted first.
+func GetTrash(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.DB.Query(
+		"SELECT "+bookColumns+" FROM books b"+bookVisible+
+			" LEFT JOIN user_books ub ON ub.book_id = b.id AND ub.user_id = u.id WHERE b.deleted_at IS NOT NULL ORDER BY b.deleted_at DESC",
+		currentUserID(r),
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch trash", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	books := make([]models.Book, 0)
+	for rows.Next() {
+		book, err := scanBook(rows)
+		if err != nil {
+			continue
+		}
+		books = append(books, book)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(books)
+}
+
+// RestoreBook takes a book out of the trash. Annotations, progress and shelf
+// entries were kept while it was there.
+func RestoreBook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bookID := vars["id"]
+
+	ids, err := trashedBookIDs(r, bookID)
+	if err != nil {
+		http.Error(w, "Failed to restore book", http.StatusInternalServerError)
+		return
+	}
+	if len(ids) == 0 {
+		http.Error(w, "Book not found in trash", http.StatusNotFound)
+		return
+	}
+
+	if _, err := db.DB.Exec("UPDATE books SET deleted_at = NULL WHERE id = ?", bookID); err != nil {
+		http.Error(w, "Failed to restore book", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, AuditBookRestore, "book", bookID, nil, nil)
+
+	book, err := scanBook(db.DB.QueryRow("SELECT "+bookColumns+bookFrom+" WHERE b.id = ?", currentUserID(r), bookID))
+	if err != nil {
+		http.Error(w, "Failed to restore book", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(book)
+}
+
+// PurgeBook permanently deletes one trashed book.
+func PurgeBook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	purgeTrash(w, r, vars["id"])
+}
+
+// EmptyTrash permanently deletes every trashed book in the user's libraries.
+func EmptyTrash(w http.ResponseWriter, r *http.Request) {
+	purgeTrash(w, r, "")
+}
+
+func purgeTrash(w http.ResponseWriter, r *http.Request, bookID string) {
+	ids, err := trashedBookIDs(r, bookID)
+	if err != nil {
+		http.Error(w, "Failed to empty trash", http.StatusInternalServerError)
+		return
+	}
+	if bookID != "" && len(ids) == 0 {
+		http.Error(w, "Book not found in trash", http.StatusNotFound)
+		return
+	}
+
+	records := make(map[string]*bookRecord, len(ids))
+	for _, id := range ids {
+		records[id], _ = loadBookRecord(id)
+	}
+	if err := purgeBooks(ids); err != nil {
+		http.Error(w, "Failed to empty trash", http.StatusInternalServerError)
+		return
+	}
+	for _, id := range ids {
+		recordAudit(r, AuditBookPurge, "book", id, records[id], nil)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"status": "deleted", "purged": len(ids)})
+}
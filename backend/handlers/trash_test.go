@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"bookland/db"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPurgedScannedBookStaysPurged(t *testing.T) {
+	user := setupTestDB(t)
+	router := mux.NewRouter()
+	router.HandleFunc("/api/trash", EmptyTrash).Methods("DELETE")
+
+	root := t.TempDir()
+	kept := filepath.Join(root, "Kept.fb2")
+	purged := filepath.Join(root, "Purged.fb2")
+	for _, path := range []string{kept, purged} {
+		if err := os.WriteFile(path, []byte("<FictionBook>"+path+"</FictionBook>"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	added, err := ScanDirectory(root, DefaultLibraryID)
+	if err != nil || len(added) != 2 {
+		t.Fatalf("first scan added %d books: %v", len(added), err)
+	}
+	var purgedID string
+	if err := db.DB.QueryRow("SELECT book_id FROM book_formats WHERE file_path = ?", purged).Scan(&purgedID); err != nil {
+		t.Fatal(err)
+	}
+	db.DB.Exec("UPDATE books SET deleted_at = ? WHERE id = ?", time.Now(), purgedID)
+	if w := serveAs(router, user, "DELETE", "/api/trash", ""); w.Code != http.StatusOK {
+		t.Fatalf("emptying the trash: status %d: %s", w.Code, w.Body.String())
+	}
+
+	if _, err := os.Stat(purged); err != nil {
+		t.Errorf("the purged book's file was removed from the scan root: %v", err)
+	}
+	added, err = ScanDirectory(root, DefaultLibraryID)
+	if err != nil || len(added) != 0 {
+		t.Errorf("scanning after the purge added %d books, want 0: %v", len(added), err)
+	}
+
+	// A different file in its place is a new book
+	if err := os.WriteFile(purged, []byte("<FictionBook>another book</FictionBook>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	added, err = ScanDirectory(root, DefaultLibraryID)
+	if err != nil || len(added) != 1 || added[0].FilePath != purged {
+		t.Errorf("scanning a replaced file added %d books, want it: %v", len(added), err)
+	}
+}
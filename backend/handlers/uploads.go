@@ -0,0 +1,360 @@
+package handlers
+
+import (
+	"bookland/db"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Resumable uploads follow the tus protocol (https://tus.io/protocols/resumable-upload)
+// with the creation and termination extensions. A client creates an upload
+// with its length, sends the file in as many PATCH requests as it takes, and
+// after a dropped connection asks with HEAD how much arrived before carrying
+// on from there. Once the last byte is in, the file is added to the library
+// as if it had been sent to UploadBook.
+
+const tusVersion = "1.0.0"
+
+// uploadLifetime is how long an unfinished upload is kept since it last
+// received data.
+const uploadLifetime = 24 * time.Hour
+
+// uploadsInProgress holds the IDs of uploads currently receiving a PATCH, so a
+// client retrying too early cannot interleave writes.
+var uploadsInProgress = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+type resumableUpload struct {
+	ID        string
+	UserID    string
+	LibraryID string
+	Filename  string
+	Length    int64
+	Offset    int64
+	BookID    string
+}
+
+func uploadPath(uploadID string) string {
+	return filepath.Join(DataPath, "uploads", uploadID)
+}
+
+// UploadOptions describes the supported protocol to clients discovering it.
+func UploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(MaxUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusRequest checks the client speaks the supported protocol version.
+func tusRequest(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported Tus-Resumable version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header: comma separated
+// pairs of a key and a base64 encoded value.
+func parseUploadMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(value)
+	}
+	return metadata
+}
+
+// loadUpload returns the user's upload with the given ID.
+func loadUpload(r *http.Request, uploadID string) (*resumableUpload, error) {
+	var u resumableUpload
+	var bookID sql.NullString
+	err := db.DB.QueryRow(
+		"SELECT id, user_id, library_id, filename, length, received, book_id FROM uploads WHERE id = ? AND user_id = ?",
+		uploadID, currentUserID(r),
+	).Scan(&u.ID, &u.UserID, &u.LibraryID, &u.Filename, &u.Length, &u.Offset, &bookID)
+	if err != nil {
+		return nil, err
+	}
+	u.BookID = bookID.String
+	return &u, nil
+}
+
+// CreateUpload starts a resumable upload. The Upload-Metadata header carries
+// the filename and, optionally, the library to add the book to.
+func CreateUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusRequest(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 1 {
+		http.Error(w, "Upload-Length is required", http.StatusBadRequest)
+		return
+	}
+	if length > MaxUploadSize {
+		uploadTooLarge(w)
+		return
+	}
+
+	metadata := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	filename := sanitizeFilename(metadata["filename"])
+	if _, ok := supportedTypes[strings.ToLower(filepath.Ext(filename))]; !ok {
+		http.Error(w, "Unsupported file format", http.StatusBadRequest)
+		return
+	}
+	libraryID := metadata["library"]
+	if libraryID == "" {
+		libraryID = DefaultLibraryID
+	}
+	if !canAccessLibrary(r, libraryID) {
+		http.Error(w, "Library not found", http.StatusNotFound)
+		return
+	}
+
+	uploadID := uuid.New().String()
+	if err := os.MkdirAll(filepath.Dir(uploadPath(uploadID)), 0755); err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	file, err := os.OpenFile(uploadPath(uploadID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	file.Close()
+
+	now := time.Now()
+	_, err = db.DB.Exec(
+		"INSERT INTO uploads (id, user_id, library_id, filename, length, received, created_at, updated_at) VALUES (?, ?, ?, ?, ?, 0, ?, ?)",
+		uploadID, currentUserID(r), libraryID, filename, length, now, now,
+	)
+	if err != nil {
+		os.Remove(uploadPath(uploadID))
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/api/uploads/"+uploadID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// GetUploadOffset reports how much of an upload has been received. Once the
+// book has been added its ID is returned in Book-Id.
+func GetUploadOffset(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !tusRequest(w, r) {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	upload, err := loadUpload(r, vars["id"])
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.BookID != "" {
+		w.Header().Set("Book-Id", upload.BookID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// PatchUpload appends the request body to an upload at Upload-Offset. Whatever
+// arrives is kept even if the connection drops part way through.
+func PatchUpload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	uploadID := vars["id"]
+	if !tusRequest(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Upload-Offset is required", http.StatusBadRequest)
+		return
+	}
+
+	uploadsInProgress.Lock()
+	busy := uploadsInProgress.ids[uploadID]
+	uploadsInProgress.ids[uploadID] = true
+	uploadsInProgress.Unlock()
+	if busy {
+		http.Error(w, "The upload is already receiving data", http.StatusConflict)
+		return
+	}
+	defer func() {
+		uploadsInProgress.Lock()
+		delete(uploadsInProgress.ids, uploadID)
+		uploadsInProgress.Unlock()
+	}()
+
+	upload, err := loadUpload(r, uploadID)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if upload.BookID != "" {
+		http.Error(w, "The upload is already complete", http.StatusConflict)
+		return
+	}
+	if offset != upload.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		http.Error(w, "Upload-Offset does not match the data received so far", http.StatusConflict)
+		return
+	}
+
+	file, err := os.OpenFile(uploadPath(uploadID), os.O_WRONLY, 0644)
+	if err != nil {
+		http.Error(w, "Failed to write upload", http.StatusInternalServerError)
+		return
+	}
+	written, copyErr := copyAt(file, io.LimitReader(r.Body, upload.Length-upload.Offset), upload.Offset)
+	if err := file.Sync(); copyErr == nil {
+		copyErr = err
+	}
+	file.Close()
+
+	upload.Offset += written
+	if _, err := db.DB.Exec("UPDATE uploads SET received = ?, updated_at = ? WHERE id = ?", upload.Offset, time.Now(), uploadID); err != nil {
+		http.Error(w, "Failed to write upload", http.StatusInternalServerError)
+		return
+	}
+	if copyErr != nil {
+		log.Printf("Upload %s interrupted at %d of %d bytes: %v", uploadID, upload.Offset, upload.Length, copyErr)
+		http.Error(w, "Failed to receive upload data", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if upload.Offset == upload.Length {
+		bookID, err := completeUpload(r, upload)
+		var invalid invalidBookError
+		if errors.Is(err, errUnsupportedFormat) || errors.As(err, &invalid) {
+			// The file will not become valid by retrying, so discard it.
+			db.DB.Exec("DELETE FROM uploads WHERE id = ?", uploadID)
+			os.Remove(uploadPath(uploadID))
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to add upload %s: %v", uploadID, err)
+			http.Error(w, "Failed to save book metadata", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Book-Id", bookID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// copyAt writes src to file starting at offset, returning how many bytes were written.
+func copyAt(file *os.File, src io.Reader, offset int64) (int64, error) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(file, src)
+}
+
+// completeUpload moves a finished upload into a book storage directory and
+// adds it to the library. If that fails the upload is left as it was, so the
+// client can retry.
+func completeUpload(r *http.Request, upload *resumableUpload) (string, error) {
+	hash, err := hashFile(uploadPath(upload.ID))
+	if err != nil {
+		return "", err
+	}
+	staged := stagedFile{
+		Filename: upload.Filename,
+		Path:     uploadPath(upload.ID),
+		Size:     upload.Length,
+		Hash:     hash,
+	}
+	book, _, err := storeBook(r, upload.LibraryID, &staged, false)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := db.DB.Exec("UPDATE uploads SET book_id = ? WHERE id = ?", book.ID, upload.ID); err != nil {
+		log.Printf("Warning: failed to record book for upload %s: %v", upload.ID, err)
+	}
+	return book.ID, nil
+}
+
+// DeleteUpload abandons an upload and discards what was received.
+func DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !tusRequest(w, r) {
+		return
+	}
+
+	upload, err := loadUpload(r, vars["id"])
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if _, err := db.DB.Exec("DELETE FROM uploads WHERE id = ?", upload.ID); err != nil {
+		http.Error(w, "Failed to delete upload", http.StatusInternalServerError)
+		return
+	}
+	os.Remove(uploadPath(upload.ID))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PurgeStaleUploads removes uploads that have not received data within
+// uploadLifetime, and records of completed ones, returning how many were removed.
+func PurgeStaleUploads() int {
+	rows, err := db.DB.Query("SELECT id FROM uploads WHERE updated_at < ?", time.Now().Add(-uploadLifetime))
+	if err != nil {
+		log.Printf("Warning: Failed to list stale uploads: %v", err)
+		return 0
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if _, err := db.DB.Exec("DELETE FROM uploads WHERE id = ?", id); err != nil {
+			continue
+		}
+		os.Remove(uploadPath(id))
+	}
+	return len(ids)
+}
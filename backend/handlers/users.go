@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"bookland/db"
+	"bookland/models"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// GetUsers lists every account. Admin only.
+func GetUsers(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.DB.Query("SELECT id, username, role, created_at FROM users ORDER BY username COLLATE NOCASE")
+	if err != nil {
+		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := make([]models.User, 0)
+	for rows.Next() {
+		var u models.User
+		if err := rows.Scan(&u.ID, &u.Username, &u.Role, &u.CreatedAt); err != nil {
+			continue
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+
+	for i := range users {
+		users[i].Libraries, _ = userLibraries(users[i].ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// CreateUser adds an account with the given role, which defaults to reader,
+// and access to the given libraries, which default to the default library.
+func CreateUser(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Username  string   `json:"username"`
+		Password  string   `json:"password"`
+		Role      string   `json:"role"`
+		Libraries []string `json:"libraries"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if message := validateCredentials(input.Username, input.Password); message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+	if input.Role == "" {
+		input.Role = RoleReader
+	}
+	if _, ok := rolePermissions[input.Role]; !ok {
+		http.Error(w, "Role must be admin, editor, reader or guest", http.StatusBadRequest)
+		return
+	}
+
+	user, err := insertUser(input.Username, input.Password, input.Role, false)
+	if err == errUsernameTaken {
+		http.Error(w, "Username already taken", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+	if input.Libraries != nil {
+		if err := grantLibraries(user.ID, input.Libraries); err != nil {
+			http.Error(w, "Failed to grant libraries", http.StatusInternalServerError)
+			return
+		}
+		user.Libraries, _ = userLibraries(user.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+// UpdateUser changes an account's role and, optionally, resets its password.
+// The last administrator cannot be demoted.
+func UpdateUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["id"]
+
+	var input struct {
+		Role     *string `json:"role"`
+		Password *string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var user models.User
+	err := db.DB.QueryRow("SELECT id, username, role, created_at FROM users WHERE id = ?", userID).
+		Scan(&user.ID, &user.Username, &user.Role, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+
+	if input.Role != nil {
+		if _, ok := rolePermissions[*input.Role]; !ok {
+			http.Error(w, "Role must be admin, editor, reader or guest", http.StatusBadRequest)
+			return
+		}
+		if user.Role == RoleAdmin && *input.Role != RoleAdmin {
+			if last, err := isLastAdmin(user.ID); err != nil || last {
+				http.Error(w, "The last administrator cannot be demoted", http.StatusConflict)
+				return
+			}
+		}
+		if _, err := db.DB.Exec("UPDATE users SET role = ? WHERE id = ?", *input.Role, user.ID); err != nil {
+			http.Error(w, "Failed to update user", http.StatusInternalServerError)
+			return
+		}
+		user.Role = *input.Role
+		passwordCache.forget(user.ID)
+	}
+
+	if input.Password != nil {
+		if message := validateCredentials(user.Username, *input.Password); message != "" {
+			http.Error(w, message, http.StatusBadRequest)
+			return
+		}
+		hash, err := hashPassword(*input.Password)
+		if err != nil {
+			http.Error(w, "Failed to update user", http.StatusInternalServerError)
+			return
+		}
+		if _, err := db.DB.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, user.ID); err != nil {
+			http.Error(w, "Failed to update user", http.StatusInternalServerError)
+			return
+		}
+		if _, err := db.DB.Exec("DELETE FROM sessions WHERE user_id = ?", user.ID); err != nil {
+			http.Error(w, "Failed to update user", http.StatusInternalServerError)
+			return
+		}
+		passwordCache.forget(user.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// DeleteUser removes an account along with its sessions, tokens and reading
+// data. The last administrator cannot be deleted.
+func DeleteUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["id"]
+
+	var role string
+	err := db.DB.QueryRow("SELECT role FROM users WHERE id = ?", userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	if role == RoleAdmin {
+		if last, err := isLastAdmin(userID); err != nil || last {
+			http.Error(w, "The last administrator cannot be deleted", http.StatusConflict)
+			return
+		}
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, statement := range []string{
+		"DELETE FROM shelf_books WHERE shelf_id IN (SELECT id FROM shelves WHERE user_id = ?)",
+		"DELETE FROM shelves WHERE user_id = ?",
+		"DELETE FROM annotations WHERE user_id = ?",
+		"DELETE FROM reading_sessions WHERE user_id = ?",
+		"DELETE FROM device_progress WHERE user_id = ?",
+		"DELETE FROM user_books WHERE user_id = ?",
+		"DELETE FROM api_tokens WHERE user_id = ?",
+		"DELETE FROM uploads WHERE user_id = ?",
+		"DELETE FROM url_imports WHERE user_id = ?",
+		"DELETE FROM calibre_imports WHERE user_id = ?",
+		"DELETE FROM library_grants WHERE user_id = ?",
+		"DELETE FROM sessions WHERE user_id = ?",
+		"DELETE FROM users WHERE id = ?",
+	} {
+		if _, err := tx.Exec(statement, userID); err != nil {
+			http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	passwordCache.forget(userID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+func isLastAdmin(userID string) (bool, error) {
+	var others int
+	err := db.DB.QueryRow("SELECT COUNT(*) FROM users WHERE role = ? AND id != ?", RoleAdmin, userID).Scan(&others)
+	return others == 0, err
+}
@@ -0,0 +1,549 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bookland/db"
+	"bookland/models"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxCheckedEntrySize bounds how much of a single EPUB entry the checker
+// reads; documents larger than this are only checked for presence.
+const maxCheckedEntrySize = 10 << 20
+
+var fontExtensions = map[string]bool{
+	".ttf": true, ".otf": true, ".woff": true, ".woff2": true,
+}
+
+var cssURL = regexp.MustCompile(`url\(\s*['"]?([^'")]+?)['"]?\s*\)`)
+
+// epubContainer is META-INF/container.xml, which points at the package document.
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+// epubPackage is the part of the OPF package document the checker reads.
+type epubPackage struct {
+	Version  string `xml:"version,attr"`
+	Manifest []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+	Spine struct {
+		Toc      string `xml:"toc,attr"`
+		Itemrefs []struct {
+			IDRef  string `xml:"idref,attr"`
+			Linear string `xml:"linear,attr"`
+		} `xml:"itemref"`
+	} `xml:"spine"`
+}
+
+// epubChecker collects the problems found in one EPUB.
+type epubChecker struct {
+	names  []string
+	files  map[string]*zip.File
+	issues []models.ValidationIssue
+}
+
+func (c *epubChecker) add(severity, code, filePath, format string, args ...any) {
+	c.issues = append(c.issues, models.ValidationIssue{
+		Severity: severity,
+		Code:     code,
+		Message:  fmt.Sprintf(format, args...),
+		Path:     filePath,
+	})
+}
+
+func (c *epubChecker) read(name string) ([]byte, error) {
+	f, ok := c.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s is missing", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, maxCheckedEntrySize))
+}
+
+// resolve turns an href found in the document at base into the name of a
+// file in the EPUB. It returns "" for links to other sites, and ok is false
+// for hrefs that cannot be resolved inside the EPUB at all.
+func resolve(base, href string) (name string, ok bool) {
+	link, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return "", false
+	}
+	if link.Scheme != "" || link.Host != "" {
+		return "", true
+	}
+	if link.Path == "" {
+		return "", true
+	}
+	name = path.Join(path.Dir(base), link.Path)
+	if name == ".." || strings.HasPrefix(name, "../") || path.IsAbs(link.Path) {
+		return "", false
+	}
+	return name, true
+}
+
+// checkEPUB reports structural problems in an EPUB: its mimetype, container,
+// package manifest and spine, navigation, and stylesheet resources.
+func checkEPUB(filePath string) []models.ValidationIssue {
+	c := &epubChecker{files: map[string]*zip.File{}}
+
+	archive, err := zip.OpenReader(filePath)
+	if err != nil {
+		c.add(models.ValidationError, "not-zip", "", "The file is not a zip archive")
+		return c.issues
+	}
+	defer archive.Close()
+	for _, f := range archive.File {
+		c.names = append(c.names, f.Name)
+		c.files[f.Name] = f
+	}
+
+	c.checkMimetype(archive.File)
+
+	opfPath, pkg := c.checkPackage()
+	if pkg == nil {
+		return c.issues
+	}
+	declared, stylesheets := c.checkManifest(opfPath, pkg)
+	c.checkSpine(pkg)
+	if strings.HasPrefix(pkg.Version, "3") {
+		c.checkNav(opfPath, pkg)
+	} else {
+		c.checkNCX(opfPath, pkg)
+	}
+	c.checkResources(declared, stylesheets)
+	return c.issues
+}
+
+func (c *epubChecker) checkMimetype(files []*zip.File) {
+	f, ok := c.files["mimetype"]
+	if !ok {
+		c.add(models.ValidationError, "mimetype-missing", "mimetype", "The mimetype file is missing")
+		return
+	}
+	if files[0] != f {
+		c.add(models.ValidationError, "mimetype-not-first", "mimetype", "The mimetype file is not the first file in the archive")
+	}
+	if f.Method != zip.Store {
+		c.add(models.ValidationError, "mimetype-compressed", "mimetype", "The mimetype file is compressed")
+	}
+	if data, err := c.read("mimetype"); err != nil || string(data) != "application/epub+zip" {
+		c.add(models.ValidationError, "mimetype-invalid", "mimetype", "The mimetype file does not contain exactly application/epub+zip")
+	}
+}
+
+// checkPackage finds and parses the package document, returning nil if there
+// is none to check further.
+func (c *epubChecker) checkPackage() (string, *epubPackage) {
+	const containerPath = "META-INF/container.xml"
+	data, err := c.read(containerPath)
+	if err != nil {
+		c.add(models.ValidationError, "container-missing", containerPath, "The container file is missing")
+		return "", nil
+	}
+	var container epubContainer
+	if err := xml.Unmarshal(data, &container); err != nil {
+		c.add(models.ValidationError, "container-invalid", containerPath, "The container file is not valid XML: %v", err)
+		return "", nil
+	}
+	if len(container.Rootfiles) == 0 || container.Rootfiles[0].FullPath == "" {
+		c.add(models.ValidationError, "rootfile-missing", containerPath, "The container file does not name a package document")
+		return "", nil
+	}
+
+	opfPath := container.Rootfiles[0].FullPath
+	data, err = c.read(opfPath)
+	if err != nil {
+		c.add(models.ValidationError, "package-missing", opfPath, "The package document is missing")
+		return "", nil
+	}
+	var pkg epubPackage
+	if err := xml.Unmarshal(data, &pkg); err != nil {
+		c.add(models.ValidationError, "package-invalid", opfPath, "The package document is not valid XML: %v", err)
+		return "", nil
+	}
+	return opfPath, &pkg
+}
+
+// checkManifest checks that every manifest item exists, and returns the files
+// the manifest declares and which of them are stylesheets.
+func (c *epubChecker) checkManifest(opfPath string, pkg *epubPackage) (declared map[string]bool, stylesheets []string) {
+	declared = map[string]bool{opfPath: true}
+	ids := map[string]bool{}
+
+	if len(pkg.Manifest) == 0 {
+		c.add(models.ValidationError, "manifest-empty", opfPath, "The manifest lists no files")
+	}
+	for _, item := range pkg.Manifest {
+		if item.ID == "" {
+			c.add(models.ValidationError, "manifest-missing-id", opfPath, "A manifest item for %q has no id", item.Href)
+		} else if ids[item.ID] {
+			c.add(models.ValidationError, "manifest-duplicate-id", opfPath, "The manifest id %q is used more than once", item.ID)
+		}
+		ids[item.ID] = true
+
+		if item.MediaType == "" {
+			c.add(models.ValidationWarning, "manifest-missing-media-type", opfPath, "The manifest item %q has no media type", item.ID)
+		}
+		if item.Href == "" {
+			c.add(models.ValidationError, "manifest-missing-href", opfPath, "The manifest item %q has no href", item.ID)
+			continue
+		}
+		name, ok := resolve(opfPath, item.Href)
+		if !ok {
+			c.add(models.ValidationError, "manifest-broken-href", opfPath, "The manifest item %q points outside the book: %s", item.ID, item.Href)
+			continue
+		}
+		if name == "" {
+			continue
+		}
+		if _, exists := c.files[name]; !exists {
+			c.add(models.ValidationError, "manifest-broken-href", name, "The manifest item %q refers to a missing file", item.ID)
+			continue
+		}
+		declared[name] = true
+		if item.MediaType == "text/css" {
+			stylesheets = append(stylesheets, name)
+		}
+	}
+	return declared, stylesheets
+}
+
+func (c *epubChecker) checkSpine(pkg *epubPackage) {
+	items := map[string]string{}
+	for _, item := range pkg.Manifest {
+		items[item.ID] = item.MediaType
+	}
+
+	if len(pkg.Spine.Itemrefs) == 0 {
+		c.add(models.ValidationError, "spine-empty", "", "The spine lists no content to read")
+	}
+	for _, ref := range pkg.Spine.Itemrefs {
+		mediaType, ok := items[ref.IDRef]
+		if !ok {
+			c.add(models.ValidationError, "spine-missing-item", "", "The spine refers to %q, which is not in the manifest", ref.IDRef)
+			continue
+		}
+		if ref.Linear != "no" && mediaType != "application/xhtml+xml" && mediaType != "image/svg+xml" {
+			c.add(models.ValidationWarning, "spine-not-content", "", "The spine item %q is %s, not a content document", ref.IDRef, mediaType)
+		}
+	}
+}
+
+// checkNav checks an EPUB 3 navigation document: there must be exactly one,
+// with a table of contents whose links lead somewhere.
+func (c *epubChecker) checkNav(opfPath string, pkg *epubPackage) {
+	var navs []string
+	for _, item := range pkg.Manifest {
+		if hasProperty(item.Properties, "nav") {
+			navs = append(navs, item.Href)
+		}
+	}
+	switch {
+	case len(navs) == 0:
+		c.add(models.ValidationError, "nav-missing", opfPath, "No manifest item is marked as the navigation document")
+		return
+	case len(navs) > 1:
+		c.add(models.ValidationError, "nav-multiple", opfPath, "More than one manifest item is marked as the navigation document")
+	}
+
+	navPath, ok := resolve(opfPath, navs[0])
+	if !ok || navPath == "" {
+		return
+	}
+	data, err := c.read(navPath)
+	if err != nil {
+		// Already reported as a broken manifest href.
+		return
+	}
+
+	decoder := xml.NewDecoder(strings.NewReader(string(data)))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	var links []string
+	foundTOC, navDepth, tocDepth := false, 0, 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.add(models.ValidationError, "nav-invalid", navPath, "The navigation document is not valid XHTML: %v", err)
+			return
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "nav":
+				navDepth++
+				if tocDepth == 0 && hasProperty(attribute(t, "type"), "toc") {
+					foundTOC, tocDepth = true, navDepth
+				}
+			case "a":
+				if tocDepth > 0 {
+					links = append(links, attribute(t, "href"))
+				}
+			}
+		case xml.EndElement:
+			if t.Name.Local == "nav" {
+				if navDepth == tocDepth {
+					tocDepth = 0
+				}
+				navDepth--
+			}
+		}
+	}
+
+	if !foundTOC {
+		c.add(models.ValidationError, "nav-missing-toc", navPath, `The navigation document has no nav element of type "toc"`)
+		return
+	}
+	if len(links) == 0 {
+		c.add(models.ValidationWarning, "nav-empty-toc", navPath, "The table of contents has no entries")
+	}
+	c.checkLinks("nav-broken-link", navPath, links)
+}
+
+// checkNCX checks an EPUB 2 book's NCX table of contents.
+func (c *epubChecker) checkNCX(opfPath string, pkg *epubPackage) {
+	if pkg.Spine.Toc == "" {
+		c.add(models.ValidationError, "ncx-missing", opfPath, "The spine does not name an NCX table of contents")
+		return
+	}
+	var href string
+	for _, item := range pkg.Manifest {
+		if item.ID == pkg.Spine.Toc {
+			href = item.Href
+		}
+	}
+	if href == "" {
+		c.add(models.ValidationError, "ncx-missing", opfPath, "The spine's table of contents %q is not in the manifest", pkg.Spine.Toc)
+		return
+	}
+	ncxPath, ok := resolve(opfPath, href)
+	if !ok || ncxPath == "" {
+		return
+	}
+	data, err := c.read(ncxPath)
+	if err != nil {
+		return
+	}
+
+	var ncx struct {
+		Content []struct {
+			Src string `xml:"src,attr"`
+		} `xml:"navMap>navPoint>content"`
+	}
+	if err := xml.Unmarshal(data, &ncx); err != nil {
+		c.add(models.ValidationError, "ncx-invalid", ncxPath, "The NCX table of contents is not valid XML: %v", err)
+		return
+	}
+	links := make([]string, 0, len(ncx.Content))
+	for _, content := range ncx.Content {
+		links = append(links, content.Src)
+	}
+	c.checkLinks("ncx-broken-link", ncxPath, links)
+}
+
+// checkLinks reports links in a table of contents that lead to missing files.
+func (c *epubChecker) checkLinks(code, base string, links []string) {
+	for _, link := range links {
+		name, ok := resolve(base, link)
+		if ok && name == "" {
+			continue
+		}
+		if _, exists := c.files[name]; !ok || !exists {
+			c.add(models.ValidationError, code, base, "The table of contents links to a missing file: %s", link)
+		}
+	}
+}
+
+// checkResources reports fonts in the archive that the manifest does not
+// declare, and files that stylesheets use but that are missing or undeclared.
+func (c *epubChecker) checkResources(declared map[string]bool, stylesheets []string) {
+	reported := map[string]bool{}
+	undeclared := func(name string) {
+		if reported[name] {
+			return
+		}
+		reported[name] = true
+		if fontExtensions[strings.ToLower(path.Ext(name))] {
+			c.add(models.ValidationWarning, "font-undeclared", name, "The font is not declared in the manifest, so reading systems may not load it")
+		} else {
+			c.add(models.ValidationWarning, "resource-undeclared", name, "The file is used but not declared in the manifest")
+		}
+	}
+
+	for _, name := range stylesheets {
+		data, err := c.read(name)
+		if err != nil {
+			continue
+		}
+		for _, match := range cssURL.FindAllStringSubmatch(string(data), -1) {
+			if strings.HasPrefix(match[1], "data:") {
+				continue
+			}
+			target, ok := resolve(name, match[1])
+			if ok && target == "" {
+				continue
+			}
+			if _, exists := c.files[target]; !ok || !exists {
+				c.add(models.ValidationError, "css-missing-resource", name, "The stylesheet refers to a missing file: %s", match[1])
+				continue
+			}
+			if !declared[target] {
+				undeclared(target)
+			}
+		}
+	}
+
+	for _, name := range c.names {
+		if fontExtensions[strings.ToLower(path.Ext(name))] && !declared[name] {
+			undeclared(name)
+		}
+	}
+}
+
+func hasProperty(properties, property string) bool {
+	for _, p := range strings.Fields(properties) {
+		if p == property {
+			return true
+		}
+	}
+	return false
+}
+
+func attribute(element xml.StartElement, name string) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// validateEPUBBook checks a book's EPUB and stores the report.
+func validateEPUBBook(bookID, filePath string) (models.ValidationReport, error) {
+	issues := checkEPUB(filePath)
+	report := models.ValidationReport{
+		BookID:    bookID,
+		CheckedAt: time.Now(),
+		Valid:     true,
+		Issues:    issues,
+	}
+	if report.Issues == nil {
+		report.Issues = []models.ValidationIssue{}
+	}
+	for _, issue := range issues {
+		if issue.Severity == models.ValidationError {
+			report.Valid = false
+		}
+	}
+
+	data, err := json.Marshal(report.Issues)
+	if err != nil {
+		return report, err
+	}
+	_, err = db.DB.Exec(
+		`INSERT INTO book_validations (book_id, checked_at, valid, issues) VALUES (?, ?, ?, ?)
+		ON CONFLICT(book_id) DO UPDATE SET checked_at = excluded.checked_at, valid = excluded.valid, issues = excluded.issues`,
+		report.BookID, report.CheckedAt, report.Valid, string(data),
+	)
+	return report, err
+}
+
+// validateNewBook checks a book as it is added, logging rather than failing
+// if the report cannot be stored.
+func validateNewBook(bookID, filePath, fileType string) {
+	if fileType != "epub" {
+		return
+	}
+	if _, err := validateEPUBBook(bookID, filePath); err != nil {
+		log.Printf("Warning: Failed to store validation of book %s: %v", bookID, err)
+	}
+}
+
+// validationBook looks up a book the user can see and the file of its EPUB
+// format, writing an error response if it has none.
+func validationBook(w http.ResponseWriter, r *http.Request) (models.Book, bool) {
+	book, err := scanBook(db.DB.QueryRow("SELECT "+bookColumns+bookFrom+" WHERE b.id = ?", currentUserID(r), mux.Vars(r)["id"]))
+	if err != nil {
+		http.Error(w, "Book not found", http.StatusNotFound)
+		return book, false
+	}
+	book.FilePath, err = bookFormatPath(book.ID, "epub")
+	if err != nil {
+		http.Error(w, "Only EPUB books can be validated", http.StatusBadRequest)
+		return book, false
+	}
+	return book, true
+}
+
+// GetBookValidation returns the stored validation report for an EPUB,
+// checking it first if it has never been checked.
+func GetBookValidation(w http.ResponseWriter, r *http.Request) {
+	book, ok := validationBook(w, r)
+	if !ok {
+		return
+	}
+
+	report := models.ValidationReport{BookID: book.ID}
+	var issues string
+	err := db.DB.QueryRow(
+		"SELECT checked_at, valid, issues FROM book_validations WHERE book_id = ?", book.ID,
+	).Scan(&report.CheckedAt, &report.Valid, &issues)
+	if err == nil {
+		err = json.Unmarshal([]byte(issues), &report.Issues)
+	}
+	if err != nil {
+		report, err = validateEPUBBook(book.ID, book.FilePath)
+		if err != nil {
+			http.Error(w, "Failed to validate book", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// ValidateBook checks an EPUB again and returns the new report.
+func ValidateBook(w http.ResponseWriter, r *http.Request) {
+	book, ok := validationBook(w, r)
+	if !ok {
+		return
+	}
+
+	report, err := validateEPUBBook(book.ID, book.FilePath)
+	if err != nil {
+		http.Error(w, "Failed to validate book", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
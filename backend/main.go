@@ -5,9 +5,12 @@ import (
 	"bookland/handlers"
 	"log"
 	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -40,6 +43,64 @@ func main() {
 	booksPath = absBooksPath
 
 	handlers.DataPath = dataPath
+	handlers.BooksPath = booksPath
+
+	switch strategy := os.Getenv("PROGRESS_STRATEGY"); strategy {
+	case "":
+	case handlers.StrategyRecent, handlers.StrategyFurthest:
+		handlers.ProgressStrategy = strategy
+	default:
+		log.Fatalf("Invalid PROGRESS_STRATEGY %q (expected %q or %q)", strategy, handlers.StrategyRecent, handlers.StrategyFurthest)
+	}
+
+	if size := os.Getenv("MAX_UPLOAD_MB"); size != "" {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid MAX_UPLOAD_MB %q (expected a positive number of megabytes)", size)
+		}
+		handlers.MaxUploadSize = n << 20
+	}
+
+	for _, network := range strings.Split(os.Getenv("IMPORT_ALLOWED_NETWORKS"), ",") {
+		if network = strings.TrimSpace(network); network == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			log.Fatalf("Invalid network %q in IMPORT_ALLOWED_NETWORKS (expected CIDR notation such as 192.168.1.0/24)", network)
+		}
+		handlers.ImportAllowedNetworks = append(handlers.ImportAllowedNetworks, prefix)
+	}
+
+	if days := os.Getenv("TRASH_RETENTION_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid TRASH_RETENTION_DAYS %q (expected a number of days, or 0 to keep deleted books until the trash is emptied)", days)
+		}
+		handlers.TrashRetention = time.Duration(n) * 24 * time.Hour
+	}
+
+	handlers.GoogleBooksAPIKey = os.Getenv("GOOGLE_BOOKS_API_KEY")
+	handlers.FakeMetadataFile = os.Getenv("METADATA_FAKE_FILE")
+	providers, ok := os.LookupEnv("METADATA_PROVIDERS")
+	if !ok {
+		providers = handlers.DefaultMetadataProviders
+	}
+	for _, name := range strings.Split(providers, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		provider, err := handlers.NewMetadataProvider(name)
+		if err != nil {
+			log.Fatalf("Invalid METADATA_PROVIDERS: %v (expected openlibrary, googlebooks or fake)", err)
+		}
+		handlers.MetadataProviders = append(handlers.MetadataProviders, provider)
+	}
+
+	if os.Getenv("OIDC_ISSUER") != "" {
+		handlers.OIDC = oidcConfigFromEnv()
+		log.Printf("Single sign-on enabled with %s", handlers.OIDC.Issuer)
+	}
 
 	if err := os.MkdirAll(dataPath, 0755); err != nil {
 		log.Fatal("Failed to create data directory:", err)
@@ -50,28 +111,109 @@ func main() {
 		log.Fatal("Failed to initialize database:", err)
 	}
 
-	// Scan books directory on startup
-	log.Printf("Scanning books directory: %s", booksPath)
-	scanBooksOnStartup(booksPath)
+	handlers.FailInterruptedImports()
+	handlers.ForgetInterruptedConversions()
+
+	// Scan every library's directories on startup
+	if err := handlers.AddDefaultLibraryRoot(booksPath); err != nil {
+		log.Printf("Warning: Failed to register books directory: %v", err)
+	}
+	scanBooksOnStartup()
+	go handlers.DetectMissingISBNs()
+	go cleanUpPeriodically()
 
 	r := mux.NewRouter()
 	r.Use(securityMiddleware)
 	r.Use(corsMiddleware)
 
 	api := r.PathPrefix("/api").Subrouter()
-	api.HandleFunc("/books", handlers.GetBooks).Methods("GET")
-	api.HandleFunc("/books", handlers.UploadBook).Methods("POST")
-	api.HandleFunc("/books/{id}", handlers.GetBook).Methods("GET")
-	api.HandleFunc("/books/{id}/file", handlers.ServeBookFile).Methods("GET")
-	api.HandleFunc("/books/{id}/cover", handlers.ServeCover).Methods("GET")
-	api.HandleFunc("/books/{id}/cover", handlers.UploadCover).Methods("POST")
-	api.HandleFunc("/books/{id}/progress", handlers.SaveProgress).Methods("PUT")
-	api.HandleFunc("/books/{id}", handlers.DeleteBook).Methods("DELETE")
-
-	api.HandleFunc("/books/{id}/annotations", handlers.GetAnnotations).Methods("GET")
-	api.HandleFunc("/books/{id}/annotations", handlers.CreateAnnotation).Methods("POST")
-	api.HandleFunc("/books/{id}/annotations/{annotationId}", handlers.UpdateAnnotation).Methods("PUT")
-	api.HandleFunc("/books/{id}/annotations/{annotationId}", handlers.DeleteAnnotation).Methods("DELETE")
+	api.Use(handlers.AuthMiddleware)
+
+	read := handlers.Require(handlers.PermRead)
+	track := handlers.Require(handlers.PermTrack)
+	account := handlers.Require(handlers.PermAccount)
+	upload := handlers.Require(handlers.PermUpload)
+	remove := handlers.Require(handlers.PermDelete)
+	manageUsers := handlers.Require(handlers.PermManageUsers)
+	manageLibraries := handlers.Require(handlers.PermManageLibraries)
+	viewAudit := handlers.Require(handlers.PermViewAudit)
+
+	api.HandleFunc("/auth/session", handlers.GetAuthSession).Methods("GET")
+	api.HandleFunc("/auth/register", handlers.Register).Methods("POST")
+	api.HandleFunc("/auth/login", handlers.Login).Methods("POST")
+	api.HandleFunc("/auth/logout", handlers.Logout).Methods("POST")
+	api.HandleFunc("/auth/oidc/login", handlers.OIDCLogin).Methods("GET")
+	api.HandleFunc("/auth/oidc/callback", handlers.OIDCCallback).Methods("GET")
+	api.HandleFunc("/auth/password", account(handlers.ChangePassword)).Methods("PUT")
+
+	api.HandleFunc("/tokens", account(handlers.GetTokens)).Methods("GET")
+	api.HandleFunc("/tokens", account(handlers.CreateToken)).Methods("POST")
+	api.HandleFunc("/tokens/{id}", account(handlers.RevokeToken)).Methods("DELETE")
+
+	api.HandleFunc("/admin/users", manageUsers(handlers.GetUsers)).Methods("GET")
+	api.HandleFunc("/admin/users", manageUsers(handlers.CreateUser)).Methods("POST")
+	api.HandleFunc("/admin/users/{id}", manageUsers(handlers.UpdateUser)).Methods("PUT")
+	api.HandleFunc("/admin/users/{id}", manageUsers(handlers.DeleteUser)).Methods("DELETE")
+	api.HandleFunc("/admin/users/{id}/libraries", manageUsers(handlers.SetUserLibraries)).Methods("PUT")
+
+	api.HandleFunc("/audit", viewAudit(handlers.GetAudit)).Methods("GET")
+
+	api.HandleFunc("/libraries", read(handlers.GetLibraries)).Methods("GET")
+	api.HandleFunc("/libraries", manageLibraries(handlers.CreateLibrary)).Methods("POST")
+	api.HandleFunc("/libraries/{id}", manageLibraries(handlers.UpdateLibrary)).Methods("PUT")
+	api.HandleFunc("/libraries/{id}", manageLibraries(handlers.DeleteLibrary)).Methods("DELETE")
+	api.HandleFunc("/libraries/{id}/sidecars", manageLibraries(handlers.ExportSidecars)).Methods("POST")
+
+	api.HandleFunc("/books", read(handlers.GetBooks)).Methods("GET")
+	api.HandleFunc("/books", upload(handlers.UploadBook)).Methods("POST")
+	api.HandleFunc("/uploads", handlers.UploadOptions).Methods("OPTIONS")
+	api.HandleFunc("/uploads/{id}", handlers.UploadOptions).Methods("OPTIONS")
+	api.HandleFunc("/uploads", upload(handlers.CreateUpload)).Methods("POST")
+	api.HandleFunc("/uploads/{id}", upload(handlers.GetUploadOffset)).Methods("HEAD")
+	api.HandleFunc("/uploads/{id}", upload(handlers.PatchUpload)).Methods("PATCH")
+	api.HandleFunc("/uploads/{id}", upload(handlers.DeleteUpload)).Methods("DELETE")
+	api.HandleFunc("/books/import-url", upload(handlers.ImportFromURL)).Methods("POST")
+	api.HandleFunc("/books/import-url/{id}", upload(handlers.GetImport)).Methods("GET")
+	api.HandleFunc("/books/import-calibre", manageLibraries(handlers.ImportCalibre)).Methods("POST")
+	api.HandleFunc("/books/import-calibre/{id}", manageLibraries(handlers.GetCalibreImport)).Methods("GET")
+	api.HandleFunc("/books/{id}", read(handlers.GetBook)).Methods("GET")
+	api.HandleFunc("/books/{id}", upload(handlers.UpdateBook)).Methods("PUT")
+	api.HandleFunc("/books/{id}/file", read(handlers.ServeBookFile)).Methods("GET")
+	api.HandleFunc("/books/{id}/cover", read(handlers.ServeCover)).Methods("GET")
+	api.HandleFunc("/books/{id}/cover", upload(handlers.UploadCover)).Methods("POST")
+	api.HandleFunc("/books/{id}/validation", read(handlers.GetBookValidation)).Methods("GET")
+	api.HandleFunc("/books/{id}/validation", upload(handlers.ValidateBook)).Methods("POST")
+	api.HandleFunc("/books/{id}/isbn", upload(handlers.DetectBookISBN)).Methods("POST")
+	api.HandleFunc("/books/{id}/convert", read(handlers.GetBookConversion)).Methods("GET")
+	api.HandleFunc("/books/{id}/convert", read(handlers.ConvertBook)).Methods("POST")
+	api.HandleFunc("/books/{id}/metadata/search", upload(handlers.SearchBookMetadata)).Methods("GET")
+	api.HandleFunc("/books/{id}/metadata/review", upload(handlers.ReviewBookMetadata)).Methods("GET")
+	api.HandleFunc("/books/{id}/metadata/apply", upload(handlers.ApplyBookMetadata)).Methods("POST")
+	api.HandleFunc("/books/{id}/progress", read(handlers.GetProgress)).Methods("GET")
+	api.HandleFunc("/books/{id}/progress", track(handlers.SaveProgress)).Methods("PUT")
+	api.HandleFunc("/books/{id}/state", track(handlers.UpdateReadingState)).Methods("PUT")
+	api.HandleFunc("/books/{id}/sessions", read(handlers.GetBookSessions)).Methods("GET")
+	api.HandleFunc("/stats", read(handlers.GetStats)).Methods("GET")
+	api.HandleFunc("/books/{id}", remove(handlers.DeleteBook)).Methods("DELETE")
+	api.HandleFunc("/books/{id}/merge", remove(handlers.MergeBooks)).Methods("POST")
+
+	api.HandleFunc("/trash", remove(handlers.GetTrash)).Methods("GET")
+	api.HandleFunc("/trash", remove(handlers.EmptyTrash)).Methods("DELETE")
+	api.HandleFunc("/trash/{id}/restore", remove(handlers.RestoreBook)).Methods("POST")
+	api.HandleFunc("/trash/{id}", remove(handlers.PurgeBook)).Methods("DELETE")
+
+	api.HandleFunc("/books/{id}/annotations", read(handlers.GetAnnotations)).Methods("GET")
+	api.HandleFunc("/books/{id}/annotations", track(handlers.CreateAnnotation)).Methods("POST")
+	api.HandleFunc("/books/{id}/annotations/{annotationId}", track(handlers.UpdateAnnotation)).Methods("PUT")
+	api.HandleFunc("/books/{id}/annotations/{annotationId}", track(handlers.DeleteAnnotation)).Methods("DELETE")
+
+	api.HandleFunc("/shelves", read(handlers.GetShelves)).Methods("GET")
+	api.HandleFunc("/shelves", track(handlers.CreateShelf)).Methods("POST")
+	api.HandleFunc("/shelves/{id}", track(handlers.UpdateShelf)).Methods("PUT")
+	api.HandleFunc("/shelves/{id}", track(handlers.DeleteShelf)).Methods("DELETE")
+	api.HandleFunc("/shelves/{id}/books", read(handlers.GetShelfBooks)).Methods("GET")
+	api.HandleFunc("/shelves/{id}/books", track(handlers.AddBookToShelf)).Methods("POST")
+	api.HandleFunc("/shelves/{id}/books/{bookId}", track(handlers.RemoveBookFromShelf)).Methods("DELETE")
 
 	// Serve static frontend files in production
 	staticPath := os.Getenv("STATIC_PATH")
@@ -90,6 +232,68 @@ func main() {
 	log.Fatal(http.ListenAndServe(":"+port, r))
 }
 
+// oidcConfigFromEnv reads the OIDC_* variables, exiting on invalid settings.
+func oidcConfigFromEnv() *handlers.OIDCConfig {
+	config := &handlers.OIDCConfig{
+		Name:           os.Getenv("OIDC_NAME"),
+		Issuer:         os.Getenv("OIDC_ISSUER"),
+		ClientID:       os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:   os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:    os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:         strings.Fields(os.Getenv("OIDC_SCOPES")),
+		UsernameClaim:  os.Getenv("OIDC_USERNAME_CLAIM"),
+		RolesClaim:     os.Getenv("OIDC_ROLES_CLAIM"),
+		RoleMap:        make(map[string]string),
+		DefaultRole:    os.Getenv("OIDC_DEFAULT_ROLE"),
+		LinkByUsername: os.Getenv("OIDC_LINK_BY_USERNAME") == "true",
+	}
+	if config.ClientID == "" || config.RedirectURL == "" {
+		log.Fatal("OIDC_ISSUER requires OIDC_CLIENT_ID and OIDC_REDIRECT_URL")
+	}
+	if config.Name == "" {
+		config.Name = "Single sign-on"
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email", "groups"}
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	if config.RolesClaim == "" {
+		config.RolesClaim = "groups"
+	}
+
+	validRole := func(role string) bool {
+		switch role {
+		case handlers.RoleAdmin, handlers.RoleEditor, handlers.RoleReader, handlers.RoleGuest:
+			return true
+		}
+		return false
+	}
+	switch config.DefaultRole {
+	case "":
+		config.DefaultRole = handlers.RoleReader
+	case "none":
+		config.DefaultRole = ""
+	default:
+		if !validRole(config.DefaultRole) {
+			log.Fatalf("Invalid OIDC_DEFAULT_ROLE %q", config.DefaultRole)
+		}
+	}
+	for _, pair := range strings.Split(os.Getenv("OIDC_ROLE_MAP"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, "=")
+		role = strings.TrimSpace(role)
+		if !ok || !validRole(role) {
+			log.Fatalf("Invalid OIDC_ROLE_MAP entry %q (expected group=role)", pair)
+		}
+		config.RoleMap[strings.TrimSpace(group)] = role
+	}
+	return config
+}
+
 func securityMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Security-Policy",
@@ -112,13 +316,16 @@ func corsMiddleware(next http.Handler) http.Handler {
 		origin := r.Header.Get("Origin")
 		if allowedOrigin != "" && origin == allowedOrigin {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset")
+			w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Book-Id")
 			w.Header().Set("Access-Control-Max-Age", "86400")
 			w.Header().Set("Vary", "Origin")
 		}
 
-		if r.Method == http.MethodOptions {
+		// Answer preflight requests here, except for resumable uploads, whose
+		// clients discover the protocol with OPTIONS
+		if r.Method == http.MethodOptions && !strings.HasPrefix(r.URL.Path, "/api/uploads") {
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
@@ -155,15 +362,26 @@ func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.FileServer(http.Dir(h.staticPath)).ServeHTTP(w, r)
 }
 
-func scanBooksOnStartup(booksPath string) {
-	addedBooks, err := handlers.ScanDirectory(booksPath)
-	if err != nil {
-		log.Printf("Warning: Failed to scan books directory: %v", err)
-		return
+// cleanUpPeriodically purges books whose time in the trash has run out and
+// abandoned resumable uploads.
+func cleanUpPeriodically() {
+	for {
+		if purged := handlers.PurgeExpiredTrash(); purged > 0 {
+			log.Printf("Purged %d books from the trash", purged)
+		}
+		if purged := handlers.PurgeStaleUploads(); purged > 0 {
+			log.Printf("Removed %d abandoned uploads", purged)
+		}
+		handlers.PurgeMetadataCache()
+		time.Sleep(time.Hour)
 	}
+}
+
+func scanBooksOnStartup() {
+	added := handlers.ScanLibraries()
 
-	if len(addedBooks) > 0 {
-		log.Printf("Scan complete: Added %d books from directory", len(addedBooks))
+	if added > 0 {
+		log.Printf("Scan complete: Added %d books from directory", added)
 	} else {
 		log.Println("Scan complete: No new books found")
 	}
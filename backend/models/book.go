@@ -1,17 +1,67 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type Book struct {
-	ID              string    `json:"id"`
-	Title           string    `json:"title"`
-	Author          string    `json:"author"`
-	CoverPath       string    `json:"coverPath"`
-	FilePath        string    `json:"filePath"`
-	FileSize        int64     `json:"fileSize"`
-	FileType        string    `json:"fileType"`
-	AddedAt         time.Time `json:"addedAt"`
-	ReadingProgress string    `json:"readingProgress,omitempty"`
+	ID        string     `json:"id"`
+	LibraryID string     `json:"libraryId"`
+	Title     string     `json:"title"`
+	Author    string     `json:"author"`
+	CoverPath string     `json:"coverPath"`
+	FilePath  string     `json:"filePath"`
+	FileSize  int64      `json:"fileSize"`
+	FileType  string     `json:"fileType"`
+	Formats   []string   `json:"formats"`
+	AddedAt   time.Time  `json:"addedAt"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+
+	Series      string            `json:"series,omitempty"`
+	SeriesIndex *float64          `json:"seriesIndex,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Identifiers map[string]string `json:"identifiers,omitempty"`
+
+	Progress        *ReadingProgress `json:"progress,omitempty"`
+	ProgressPercent float64          `json:"progressPercent"`
+
+	Status     string     `json:"status,omitempty"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Rating     int        `json:"rating,omitempty"`
+	Favorite   bool       `json:"favorite"`
+	Review     string     `json:"review,omitempty"`
+}
+
+// Reading statuses a book can be in. An empty status means the book has not been touched yet.
+const (
+	StatusWantToRead = "want-to-read"
+	StatusReading    = "reading"
+	StatusFinished   = "finished"
+	StatusAbandoned  = "abandoned"
+)
+
+// ReadingProgress is a reader's position within a book. PDFs are located by
+// page; every other format by CFI and fraction.
+type ReadingProgress struct {
+	Format     string    `json:"format"`
+	CFI        string    `json:"cfi,omitempty"`
+	Page       int       `json:"page,omitempty"`
+	TotalPages int       `json:"totalPages,omitempty"`
+	Fraction   float64   `json:"fraction"`
+	Chapter    string    `json:"chapter,omitempty"`
+	Device     string    `json:"device,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// Percent returns how far through the book the position is, from 0 to 100.
+func (p *ReadingProgress) Percent() float64 {
+	if p == nil {
+		return 0
+	}
+	return p.Fraction * 100
 }
 
 type Annotation struct {
@@ -23,3 +73,232 @@ type Annotation struct {
 	Color     string    `json:"color"`
 	CreatedAt time.Time `json:"createdAt"`
 }
+
+type ReadingSession struct {
+	ID            string    `json:"id"`
+	BookID        string    `json:"bookId"`
+	StartedAt     time.Time `json:"startedAt"`
+	EndedAt       time.Time `json:"endedAt"`
+	StartPosition string    `json:"startPosition,omitempty"`
+	EndPosition   string    `json:"endPosition,omitempty"`
+	StartFraction float64   `json:"startFraction"`
+	EndFraction   float64   `json:"endFraction"`
+	PagesRead     int       `json:"pagesRead,omitempty"`
+}
+
+type User struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	Libraries []string  `json:"libraries,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Outcomes of a file in a bulk upload.
+const (
+	UploadCreated   = "created"
+	UploadDuplicate = "duplicate"
+	UploadFailed    = "error"
+)
+
+// UploadResult describes what happened to one file of a bulk upload. BookID
+// is the new book, or for a duplicate the book already in the library.
+type UploadResult struct {
+	File   string `json:"file"`
+	Status string `json:"status"`
+	BookID string `json:"bookId,omitempty"`
+	Title  string `json:"title,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Stages of an import from a URL.
+const (
+	ImportPending     = "pending"
+	ImportDownloading = "downloading"
+	ImportRunning     = "running"
+	ImportDone        = "done"
+	ImportDuplicate   = "duplicate"
+	ImportFailed      = "failed"
+)
+
+// CalibreImport is a Calibre library being brought into a library in the
+// background. Failures lists the books that could not be imported and why.
+type CalibreImport struct {
+	ID        string          `json:"id"`
+	Path      string          `json:"path"`
+	LibraryID string          `json:"libraryId"`
+	Status    string          `json:"status"`
+	Error     string          `json:"error,omitempty"`
+	Total     int             `json:"total"`
+	Imported  int             `json:"imported"`
+	Skipped   int             `json:"skipped"`
+	Failed    int             `json:"failed"`
+	Failures  []ImportFailure `json:"failures"`
+	CreatedAt time.Time       `json:"createdAt"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// ImportFailure is a book an import could not bring in.
+type ImportFailure struct {
+	Title  string `json:"title"`
+	Reason string `json:"reason"`
+}
+
+// SidecarExport reports how many sidecars an export wrote.
+type SidecarExport struct {
+	Written  int             `json:"written"`
+	Failed   int             `json:"failed"`
+	Failures []ImportFailure `json:"failures"`
+}
+
+// ImportJob is a book being fetched from a URL in the background. BookID is
+// set once it is done, or for a duplicate, to the book already in the library.
+type ImportJob struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	LibraryID string    `json:"libraryId"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	BookID    string    `json:"bookId,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Severities of the problems an EPUB check reports.
+const (
+	ValidationError   = "error"
+	ValidationWarning = "warning"
+)
+
+// ValidationIssue is one problem found in a book's file. Path is the file
+// inside the EPUB it concerns, when there is one.
+type ValidationIssue struct {
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Path     string `json:"path,omitempty"`
+}
+
+// ValidationReport is the result of checking an EPUB's structure. Valid is
+// false when any issue is an error; warnings alone leave it true.
+type ValidationReport struct {
+	BookID    string            `json:"bookId"`
+	CheckedAt time.Time         `json:"checkedAt"`
+	Valid     bool              `json:"valid"`
+	Issues    []ValidationIssue `json:"issues"`
+}
+
+// AuditEntry records a change to the library: who made it, when, and what the
+// target looked like before and after.
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	At         time.Time       `json:"at"`
+	ActorID    string          `json:"actorId"`
+	ActorName  string          `json:"actorName"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"targetType"`
+	TargetID   string          `json:"targetId"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+}
+
+// Library is a separately shared part of the catalog, filled from its own
+// scan roots and by uploads.
+type Library struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Roots         []string  `json:"roots,omitempty"`
+	PathTemplates []string  `json:"pathTemplates,omitempty"`
+	BookCount     int       `json:"bookCount"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// APIToken is a long-lived credential for scripts and reading apps. The
+// secret itself is only returned when the token is created.
+type APIToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scope      string     `json:"scope"`
+	Token      string     `json:"token,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+type Shelf struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Query     string    `json:"query,omitempty"`
+	Smart     bool      `json:"smart"`
+	BookCount int       `json:"bookCount"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ISBNDetection is what searching a book's text for ISBNs found.
+type ISBNDetection struct {
+	// ISBN is the book's ISBN after detection, which may have come from
+	// elsewhere before
+	ISBN  string   `json:"isbn"`
+	Found []string `json:"found"`
+}
+
+// MetadataCandidate is a record a metadata provider found for a book.
+type MetadataCandidate struct {
+	Provider      string            `json:"provider"`
+	ID            string            `json:"id"`
+	Title         string            `json:"title"`
+	Author        string            `json:"author,omitempty"`
+	Series        string            `json:"series,omitempty"`
+	SeriesIndex   *float64          `json:"seriesIndex,omitempty"`
+	Description   string            `json:"description,omitempty"`
+	Publisher     string            `json:"publisher,omitempty"`
+	PublishedDate string            `json:"publishedDate,omitempty"`
+	Tags          []string          `json:"tags,omitempty"`
+	Identifiers   map[string]string `json:"identifiers,omitempty"`
+	CoverURL      string            `json:"coverUrl,omitempty"`
+}
+
+// MetadataSearch is what the metadata providers found for a book.
+type MetadataSearch struct {
+	Query   MetadataQuery       `json:"query"`
+	Results []MetadataCandidate `json:"results"`
+	Errors  []ProviderError     `json:"errors,omitempty"`
+}
+
+// MetadataQuery is what a book is looked up by.
+type MetadataQuery struct {
+	ISBN   string `json:"isbn,omitempty"`
+	Title  string `json:"title,omitempty"`
+	Author string `json:"author,omitempty"`
+}
+
+// ProviderError is a provider that could not be reached during a search.
+type ProviderError struct {
+	Provider string `json:"provider"`
+	Error    string `json:"error"`
+}
+
+// MetadataReview compares a candidate with the book it would be applied to.
+type MetadataReview struct {
+	Candidate MetadataCandidate `json:"candidate"`
+	Changes   []MetadataChange  `json:"changes"`
+}
+
+// MetadataChange is one field applying a candidate would change.
+type MetadataChange struct {
+	Field    string `json:"field"`
+	Current  any    `json:"current"`
+	Proposed any    `json:"proposed"`
+}
+
+// BookConversion is a derivative of a book in another format, such as an EPUB
+// made from an FB2 or MOBI, built in the background. Source is the format it
+// is made from.
+type BookConversion struct {
+	BookID    string    `json:"bookId"`
+	Format    string    `json:"format"`
+	Source    string    `json:"source"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
@@ -3,4 +3,5 @@ export const TEXT_FORMATS = ["epub", "mobi", "azw3", "fb2"];
 
 export const SUPPORTED_EXTENSIONS = [".epub", ".pdf", ".mobi", ".azw3", ".fb2", ".cbz"];
 
-export const FILE_ACCEPT = SUPPORTED_EXTENSIONS.join(",");
+// Zips of books can be uploaded too; the server unpacks them.
+export const FILE_ACCEPT = [...SUPPORTED_EXTENSIONS, ".zip"].join(",");
@@ -0,0 +1,10 @@
+// A stable identifier for this browser, sent with progress updates so the
+// server can keep one position per device.
+export const getDeviceId = () => {
+  let deviceId = localStorage.getItem("deviceId");
+  if (!deviceId) {
+    deviceId = crypto.randomUUID();
+    localStorage.setItem("deviceId", deviceId);
+  }
+  return deviceId;
+};
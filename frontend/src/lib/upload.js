@@ -0,0 +1,101 @@
+// Uploads a book with the server's resumable (tus) upload API, in chunks, so a
+// dropped connection only costs the chunk in flight. The upload URL is kept
+// in localStorage so reloading the page and choosing the same file again
+// carries on where it stopped.
+
+const CHUNK_SIZE = 8 * 1024 * 1024;
+const RETRY_DELAYS = [1000, 3000, 5000, 10000, 20000];
+const TUS_HEADERS = { "Tus-Resumable": "1.0.0" };
+
+const encodeMetadata = (metadata) =>
+  Object.entries(metadata)
+    .map(([key, value]) => `${key} ${btoa(unescape(encodeURIComponent(value)))}`)
+    .join(",");
+
+const storageKey = (file, library) =>
+  `upload:${library}:${file.name}:${file.size}:${file.lastModified}`;
+
+const sleep = (ms) => new Promise((resolve) => setTimeout(resolve, ms));
+
+const createUpload = async (file, library) => {
+  const metadata = { filename: file.name };
+  if (library) {
+    metadata.library = library;
+  }
+  const response = await fetch("/api/uploads", {
+    method: "POST",
+    headers: {
+      ...TUS_HEADERS,
+      "Upload-Length": String(file.size),
+      "Upload-Metadata": encodeMetadata(metadata),
+    },
+  });
+  if (!response.ok) {
+    throw new Error((await response.text()).trim() || "Failed to start upload");
+  }
+  return response.headers.get("Location");
+};
+
+const currentOffset = async (url) => {
+  const response = await fetch(url, { method: "HEAD", headers: TUS_HEADERS });
+  if (!response.ok) {
+    return null;
+  }
+  return Number(response.headers.get("Upload-Offset"));
+};
+
+// Returns the ID of the book the upload was added as. onProgress is called
+// with the fraction of the file received by the server.
+export const resumableUpload = async (file, library, onProgress = () => {}) => {
+  const key = storageKey(file, library);
+  let url = localStorage.getItem(key);
+  let offset = url ? await currentOffset(url) : null;
+  if (offset === null) {
+    url = await createUpload(file, library);
+    localStorage.setItem(key, url);
+    offset = 0;
+  }
+
+  let attempt = 0;
+  for (;;) {
+    onProgress(offset / file.size);
+    let response;
+    try {
+      response = await fetch(url, {
+        method: "PATCH",
+        headers: {
+          ...TUS_HEADERS,
+          "Upload-Offset": String(offset),
+          "Content-Type": "application/offset+octet-stream",
+        },
+        body: file.slice(offset, offset + CHUNK_SIZE),
+      });
+    } catch (error) {
+      response = null;
+    }
+
+    if (response?.ok) {
+      attempt = 0;
+      offset = Number(response.headers.get("Upload-Offset"));
+      const bookId = response.headers.get("Book-Id");
+      if (bookId) {
+        localStorage.removeItem(key);
+        onProgress(1);
+        return bookId;
+      }
+      continue;
+    }
+    if (response && response.status !== 409 && response.status < 500) {
+      localStorage.removeItem(key);
+      throw new Error((await response.text()).trim() || "Upload failed");
+    }
+    if (attempt >= RETRY_DELAYS.length) {
+      throw new Error("Upload interrupted; choose the file again to resume");
+    }
+    await sleep(RETRY_DELAYS[attempt++]);
+    const resumed = await currentOffset(url).catch(() => null);
+    if (resumed !== null) {
+      offset = resumed;
+    }
+  }
+};